@@ -3,6 +3,7 @@ module llm
 go 1.23.0
 
 require (
-	github.com/blevesearch/segment v0.9.1 // indirect
-	gonum.org/v1/gonum v0.16.0 // indirect
+	github.com/blevesearch/segment v0.9.1
+	github.com/klauspost/compress v1.18.0
+	gonum.org/v1/gonum v0.16.0
 )
@@ -1,4 +1,150 @@
 package main
 
+import (
+	"flag"
+	"fmt"
+	"llm/pkg/backend"
+	"llm/pkg/bpe"
+	"llm/pkg/dirreader"
+	"llm/pkg/llm"
+	"llm/pkg/server"
+	"llm/pkg/shard"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+var commands = map[string]func(args []string){
+	"prepare": prepare,
+	"untie":   untie,
+	"serve":   serve,
+}
+
 func main() {
+	backend.FromEnv()
+
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	command, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
+	}
+
+	command(os.Args[2:])
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "использование: llm <команда> [флаги]")
+	fmt.Fprintln(os.Stderr, "команды:")
+	for name := range commands {
+		fmt.Fprintln(os.Stderr, "\t"+name)
+	}
+	fmt.Fprintf(os.Stderr, "реализация вычислений задается %s: %s\n", backend.EnvName, strings.Join(backend.Names(), ", "))
+	os.Exit(2)
+}
+
+func prepare(args []string) {
+	set := flag.NewFlagSet("prepare", flag.ExitOnError)
+	src := set.String("src", "", "каталог с текстами")
+	trg := set.String("trg", "", "каталог для шардов")
+	vocab := set.String("bpe", "", "файл токенизатора")
+	size := set.Int("size", shard.DefaultSize, "число токенов в шарде")
+	opts := readerFlags(set)
+	set.Parse(args)
+
+	tok := bpe.Load(*vocab)
+	shard.Prepare(llm.FileSource(*src, tok, opts()), *trg, tok.Hash(), tok.Len(), *size)
+}
+
+func untie(args []string) {
+	set := flag.NewFlagSet("untie", flag.ExitOnError)
+	src := set.String("src", "", "чекпоинт с общей выходной проекцией")
+	trg := set.String("trg", "", "файл для новой модели")
+	set.Parse(args)
+
+	if *src == "" || *trg == "" {
+		set.Usage()
+		os.Exit(2)
+	}
+
+	model := llm.Load(*src)
+	model.Untie()
+	model.Save(*trg)
+}
+
+func serve(args []string) {
+	set := flag.NewFlagSet("serve", flag.ExitOnError)
+	model := set.String("model", "", "чекпоинт модели")
+	vocab := set.String("bpe", "", "файл токенизатора")
+	addr := set.String("addr", ":8080", "адрес сервера")
+	name := set.String("name", "llm", "имя модели в ответах")
+	concurrency := set.Int("concurrency", 0, "число одновременных запросов генерации, 0 - размер шага")
+	batch := set.Int("batch", llm.DefaultMaxBatch, "число последовательностей в одном шаге модели")
+	prefill := set.Int("prefill", 0, "число токенов запросов в одном шаге, 0 - размер окна")
+	timeout := set.Duration("timeout", time.Minute, "ограничение времени запроса, 0 - без ограничения")
+	maxtokens := set.Int("maxtokens", server.DefaultMaxTokens, "наибольшее число новых токенов")
+	set.Parse(args)
+
+	if *model == "" || *vocab == "" {
+		set.Usage()
+		os.Exit(2)
+	}
+
+	srv := server.New(llm.Load(*model), bpe.Load(*vocab), server.Config{
+		Name:        *name,
+		Concurrency: *concurrency,
+		Timeout:     *timeout,
+		MaxTokens:   *maxtokens,
+		Scheduler: llm.SchedulerConfig{
+			MaxBatch:   *batch,
+			MaxPrefill: *prefill,
+		},
+	})
+
+	log.Printf("сервер слушает %s", *addr)
+
+	err := http.ListenAndServe(*addr, srv)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func readerFlags(set *flag.FlagSet) func() dirreader.Options {
+	include := set.String("include", "", "шаблоны включаемых файлов через запятую")
+	exclude := set.String("exclude", "", "шаблоны исключаемых файлов через запятую")
+	exts := set.String("exts", "", "допустимые расширения через запятую")
+	maxsize := set.Int64("maxsize", 0, "максимальный размер файла в байтах")
+	hidden := set.Bool("hidden", false, "читать скрытые файлы")
+	links := set.Bool("links", false, "переходить по ссылкам на каталоги")
+	unpack := set.Bool("unpack", true, "читать содержимое архивов")
+
+	split := func(s string) []string {
+		if s == "" {
+			return nil
+		}
+		return strings.Split(s, ",")
+	}
+
+	return func() dirreader.Options {
+		opts := dirreader.Options{
+			Include:    split(*include),
+			Exclude:    split(*exclude),
+			Exts:       split(*exts),
+			MaxSize:    *maxsize,
+			SkipHidden: !*hidden,
+			Links:      dirreader.LinksFiles,
+			Invalid:    dirreader.InvalidSkip,
+			Unpack:     *unpack,
+		}
+
+		if *links {
+			opts.Links = dirreader.LinksFollow
+		}
+
+		return opts
+	}
 }
@@ -0,0 +1,185 @@
+/*
+Package backend задает реализацию численных операций модели: умножения
+матриц, поэлементных операций, softmax и сумм по строкам и столбцам.
+
+Модули вызывают операции через lib, а lib - через текущую реализацию
+Current. По умолчанию используется Gonum, другую реализацию можно
+выбрать во время работы через Set или Use, например по переменной
+окружения LLM_BACKEND. Реализация меняется до начала вычислений,
+переключение во время прохода модели не поддерживается.
+
+Реализации различаются только порядком округления, поэтому результаты
+разных реализаций совпадают с точностью до ошибок округления.
+Каждая реализация должна проходить проверку Check.
+*/
+package backend
+
+import (
+	"fmt"
+	"gonum.org/v1/gonum/mat"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// EnvName - переменная окружения с именем реализации, см. FromEnv.
+const EnvName = "LLM_BACKEND"
+
+/*
+Backend - реализация численных операций. Приемник trg может быть пустым,
+тогда он получает нужный размер, иначе его размер должен совпадать
+с размером результата. В поэлементных операциях trg может совпадать
+с аргументами, в Mul не должна пересекаться с ними. Методы могут
+вызываться одновременно из нескольких горутин с разными trg.
+*/
+type Backend interface {
+	// Name - имя реализации для Use.
+	Name() string
+	/*
+		Mul записывает в trg произведение a·b, при at вместо a берется aᵀ,
+		при bt вместо b - bᵀ. Флаги заменяют метод T, результат которого
+		выделяет память при каждом вызове.
+	*/
+	Mul(trg, a, b *mat.Dense, at, bt bool)
+	// Add записывает в trg сумму a+b.
+	Add(trg, a, b *mat.Dense)
+	// MulElem записывает в trg поэлементное произведение a⊙b.
+	MulElem(trg, a, b *mat.Dense)
+	// Scale записывает в trg произведение f·a.
+	Scale(trg *mat.Dense, f float64, a *mat.Dense)
+	// AddScaled прибавляет к trg произведение f·a.
+	AddScaled(trg *mat.Dense, f float64, a *mat.Dense)
+	// Apply записывает в trg значения f элементов src.
+	Apply(trg, src *mat.Dense, f func(float64) float64)
+	/*
+		Softmax записывает в trg softmax строк src. Элементы -Inf
+		получают вероятность 0.
+	*/
+	Softmax(trg, src *mat.Dense)
+	// RowSums записывает в trg суммы строк src.
+	RowSums(trg []float64, src *mat.Dense)
+	// ColSums записывает в trg суммы столбцов src.
+	ColSums(trg []float64, src *mat.Dense)
+}
+
+var (
+	// current - текущая реализация, см. Current.
+	current atomic.Pointer[Backend]
+
+	mut      sync.Mutex
+	registry = map[string]Backend{}
+)
+
+func init() {
+	Register(Gonum{})
+	Register(Blocked{})
+	Set(Gonum{})
+}
+
+// Current возвращает текущую реализацию.
+func Current() Backend {
+	return *current.Load()
+}
+
+// Set делает backend текущей реализацией.
+func Set(backend Backend) {
+	current.Store(&backend)
+}
+
+// Register добавляет реализацию, доступную Use по ее имени.
+func Register(backend Backend) {
+	mut.Lock()
+	defer mut.Unlock()
+
+	registry[backend.Name()] = backend
+}
+
+// Names возвращает имена доступных реализаций по порядку.
+func Names() []string {
+	mut.Lock()
+	defer mut.Unlock()
+
+	return slices.Sorted(maps.Keys(registry))
+}
+
+// Lookup возвращает реализацию по имени или nil, если ее нет.
+func Lookup(name string) Backend {
+	mut.Lock()
+	defer mut.Unlock()
+
+	return registry[name]
+}
+
+// Use делает текущей реализацию с именем name.
+func Use(name string) {
+	backend := Lookup(name)
+	if backend == nil {
+		panic(fmt.Sprintf("неизвестная реализация %q, доступны: %s", name, strings.Join(Names(), ", ")))
+	}
+
+	Set(backend)
+}
+
+// FromEnv выбирает реализацию по переменной окружения LLM_BACKEND, если она задана.
+func FromEnv() {
+	if name, ok := os.LookupEnv(EnvName); ok && name != "" {
+		Use(name)
+	}
+}
+
+/*
+shape задает пустому trg размер r×c, а для непустого проверяет,
+что размер совпадает.
+*/
+func shape(trg *mat.Dense, r, c int) {
+	if trg.IsEmpty() {
+		trg.ReuseAs(r, c)
+		return
+	}
+
+	if rown, coln := trg.Dims(); rown != r || coln != c {
+		panic(mat.ErrShape)
+	}
+}
+
+// same проверяет, что a и b одного размера, и возвращает его.
+func same(a, b *mat.Dense) (r, c int) {
+	r, c = a.Dims()
+	if rown, coln := b.Dims(); rown != r || coln != c {
+		panic(mat.ErrShape)
+	}
+	return r, c
+}
+
+// length проверяет, что в trg n элементов.
+func length(trg []float64, n int) {
+	if len(trg) != n {
+		panic(mat.ErrShape)
+	}
+}
+
+/*
+mulDims проверяет размеры множителей Mul и задает размер trg.
+Возвращает размеры произведения m×n и общую размерность k.
+*/
+func mulDims(trg, a, b *mat.Dense, at, bt bool) (m, n, k int) {
+	m, k = a.Dims()
+	if at {
+		m, k = k, m
+	}
+
+	br, n := b.Dims()
+	if bt {
+		br, n = n, br
+	}
+
+	if k != br {
+		panic(mat.ErrShape)
+	}
+	shape(trg, m, n)
+
+	return m, n, k
+}
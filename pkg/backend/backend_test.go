@@ -0,0 +1,130 @@
+package backend
+
+import (
+	"gonum.org/v1/gonum/mat"
+	"math/rand/v2"
+	"runtime"
+	"slices"
+	"testing"
+)
+
+func Test_Check(t *testing.T) {
+	for _, name := range Names() {
+		for _, res := range Check(Lookup(name)) {
+			t.Errorf("%s: %v", name, res)
+		}
+	}
+}
+
+// broken портит одну операцию, чтобы Check ее обнаружил.
+type broken struct {
+	Gonum
+}
+
+func (broken) Name() string {
+	return "broken"
+}
+
+func (broken) Mul(trg, a, b *mat.Dense, at, bt bool) {
+	Gonum{}.Mul(trg, a, b, at, bt)
+	trg.Set(0, 0, trg.At(0, 0)+1e-6)
+}
+
+func Test_Check_Broken(t *testing.T) {
+	results := Check(broken{})
+
+	if len(results) == 0 {
+		t.Fatalf("expected failures")
+	}
+
+	for i, res := range results {
+		if res.Op[:3] != "Mul" {
+			t.Errorf("%d: unexpected failure %v", i, res)
+		}
+	}
+}
+
+// Test_Blocked_Serial - при GOMAXPROCS = 1 Blocked.Mul считает без горутин и не выделяет память.
+func Test_Blocked_Serial(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(1))
+
+	rng := rand.New(rand.NewPCG(1, 2))
+
+	for i, dims := range [][3]int{{64, 64, 64}, {130, 70, 200}, {256, 300, 64}} {
+		m, k, n := dims[0], dims[1], dims[2]
+
+		for _, trans := range [][2]bool{{false, false}, {false, true}, {true, false}, {true, true}} {
+			a, b := operand(rng, m, k, trans[0], true), operand(rng, k, n, trans[1], false)
+
+			var want mat.Dense
+			want.Mul(view(a, trans[0]), view(b, trans[1]))
+
+			got := receiver(rng, m, n, false)
+			Blocked{}.Mul(got, a, b, trans[0], trans[1])
+
+			if !mat.EqualApprox(got, &want, 1e-10) {
+				t.Errorf("%d %v: expected equal to mat.Dense.Mul", i, trans)
+			}
+
+			if allocs := testing.AllocsPerRun(5, func() {
+				Blocked{}.Mul(got, a, b, trans[0], trans[1])
+			}); allocs != 0 {
+				t.Errorf("%d %v: expected no allocations, got %v", i, trans, allocs)
+			}
+		}
+	}
+}
+
+func Test_Use(t *testing.T) {
+	defer Set(Current())
+
+	if names := Names(); !slices.Equal(names, []string{"blocked", "gonum"}) {
+		t.Errorf("expected blocked and gonum, got %v", names)
+	}
+
+	if Current().Name() != "gonum" {
+		t.Errorf("expected default gonum, got %s", Current().Name())
+	}
+
+	t.Setenv(EnvName, "blocked")
+	FromEnv()
+
+	if Current().Name() != "blocked" {
+		t.Errorf("expected blocked, got %s", Current().Name())
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("expected panic")
+			}
+		}()
+
+		Use("unknown")
+	}()
+}
+
+func Benchmark_Mul(b *testing.B) {
+	rng := rand.New(rand.NewPCG(1, 2))
+	x, y := random(rng, 256, 256), random(rng, 256, 1024)
+
+	for _, name := range Names() {
+		backend := Lookup(name)
+
+		b.Run(name, func(b *testing.B) {
+			var trg mat.Dense
+			b.ReportAllocs()
+			for range b.N {
+				backend.Mul(&trg, x, y, false, false)
+			}
+		})
+
+		b.Run(name+"_T", func(b *testing.B) {
+			var trg mat.Dense
+			b.ReportAllocs()
+			for range b.N {
+				backend.Mul(&trg, y, y, true, false)
+			}
+		})
+	}
+}
@@ -0,0 +1,289 @@
+package backend
+
+import (
+	"gonum.org/v1/gonum/blas/blas64"
+	"gonum.org/v1/gonum/mat"
+	"math"
+	"runtime"
+	"sync"
+)
+
+const (
+	// blockK и blockJ - размеры блока множителя b в Mul, помещающегося в кэш.
+	blockK = 128
+	blockJ = 256
+	// parallelMin - наименьшее число умножений Mul, которое делится между горутинами.
+	parallelMin = 1 << 16
+)
+
+/*
+Blocked - реализация на чистом Go без BLAS. Умножение матриц обходит
+множитель b блоками blockK×blockJ, которые остаются в кэше процессора,
+пока по ним проходят все строки, а строки больших произведений
+считаются параллельно. Внутренние циклы развернуты по четыре элемента
+с независимыми суммами, чтобы компилятор держал их в регистрах.
+*/
+type Blocked struct{}
+
+func (Blocked) Name() string {
+	return "blocked"
+}
+
+func (Blocked) Mul(trg, a, b *mat.Dense, at, bt bool) {
+	ar, bc, ac := mulDims(trg, a, b, at, bt)
+	am, bm, cm := a.RawMatrix(), b.RawMatrix(), trg.RawMatrix()
+
+	workers := min(runtime.GOMAXPROCS(0), ar)
+	if workers == 1 || ar*ac*bc < parallelMin {
+		mulRows(cm, am, bm, at, bt, ac, 0, ar)
+		return
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for worker := range workers {
+		go func() {
+			defer wg.Done()
+			mulRows(cm, am, bm, at, bt, ac, ar*worker/workers, ar*(worker+1)/workers)
+		}()
+	}
+	wg.Wait()
+}
+
+/*
+mulRows записывает в строки [start, end) c произведение a·b с общей
+размерностью k. at и bt означают, что a и b хранятся транспонированными.
+*/
+func mulRows(c, a, b blas64.General, at, bt bool, k, start, end int) {
+	n := c.Cols
+
+	for i := start; i < end; i++ {
+		clear(c.Data[i*c.Stride : i*c.Stride+n])
+	}
+
+	// a[i, p] = a.Data[i*ars+p*acs]
+	ars, acs := a.Stride, 1
+	if at {
+		ars, acs = 1, a.Stride
+	}
+
+	if !bt {
+		for jj := 0; jj < n; jj += blockJ {
+			je := min(jj+blockJ, n)
+
+			for pp := 0; pp < k; pp += blockK {
+				pe := min(pp+blockK, k)
+
+				i := start
+				// по четыре строки c за проход, чтобы каждая строка b читалась реже
+				for ; i+4 <= end; i += 4 {
+					c0 := c.Data[i*c.Stride+jj : i*c.Stride+je]
+					c1 := c.Data[(i+1)*c.Stride+jj : (i+1)*c.Stride+je]
+					c2 := c.Data[(i+2)*c.Stride+jj : (i+2)*c.Stride+je]
+					c3 := c.Data[(i+3)*c.Stride+jj : (i+3)*c.Stride+je]
+
+					for p := pp; p < pe; p++ {
+						a0, a1 := a.Data[i*ars+p*acs], a.Data[(i+1)*ars+p*acs]
+						a2, a3 := a.Data[(i+2)*ars+p*acs], a.Data[(i+3)*ars+p*acs]
+						// нулевые элементы a, например после relu, пропускаются
+						if a0 != 0 || a1 != 0 || a2 != 0 || a3 != 0 {
+							axpy4(c0, c1, c2, c3, a0, a1, a2, a3, b.Data[p*b.Stride+jj:p*b.Stride+je])
+						}
+					}
+				}
+
+				for ; i < end; i++ {
+					crow := c.Data[i*c.Stride+jj : i*c.Stride+je]
+
+					for p := pp; p < pe; p++ {
+						if val := a.Data[i*ars+p*acs]; val != 0 {
+							axpy(crow, val, b.Data[p*b.Stride+jj:p*b.Stride+je])
+						}
+					}
+				}
+			}
+		}
+		return
+	}
+
+	// b хранится по строкам произведения: c[i, j] = a[i, :]·b.Data[j, :]
+	var buf [blockK]float64
+
+	for jj := 0; jj < n; jj += blockJ {
+		je := min(jj+blockJ, n)
+
+		for pp := 0; pp < k; pp += blockK {
+			pe := min(pp+blockK, k)
+
+			for i := start; i < end; i++ {
+				arow := buf[:pe-pp]
+				if at {
+					for p := pp; p < pe; p++ {
+						arow[p-pp] = a.Data[p*a.Stride+i]
+					}
+				} else {
+					arow = a.Data[i*a.Stride+pp : i*a.Stride+pe]
+				}
+
+				crow := c.Data[i*c.Stride : i*c.Stride+n]
+				for j := jj; j < je; j++ {
+					crow[j] += dot(arow, b.Data[j*b.Stride+pp:j*b.Stride+pe])
+				}
+			}
+		}
+	}
+}
+
+// axpy прибавляет к dst произведение alpha·x.
+func axpy(dst []float64, alpha float64, x []float64) {
+	x = x[:len(dst)]
+
+	var i int
+	for ; i+4 <= len(dst); i += 4 {
+		d, s := dst[i:i+4:i+4], x[i:i+4:i+4]
+		d[0] += alpha * s[0]
+		d[1] += alpha * s[1]
+		d[2] += alpha * s[2]
+		d[3] += alpha * s[3]
+	}
+
+	for ; i < len(dst); i++ {
+		dst[i] += alpha * x[i]
+	}
+}
+
+// axpy4 прибавляет к c0..c3 произведения a0..a3 на общую строку x.
+func axpy4(c0, c1, c2, c3 []float64, a0, a1, a2, a3 float64, x []float64) {
+	n := len(x)
+	c0, c1, c2, c3 = c0[:n], c1[:n], c2[:n], c3[:n]
+
+	for j, val := range x {
+		c0[j] += a0 * val
+		c1[j] += a1 * val
+		c2[j] += a2 * val
+		c3[j] += a3 * val
+	}
+}
+
+func dot(x, y []float64) float64 {
+	y = y[:len(x)]
+
+	var s0, s1, s2, s3 float64
+
+	var i int
+	for ; i+4 <= len(x); i += 4 {
+		a, b := x[i:i+4:i+4], y[i:i+4:i+4]
+		s0 += a[0] * b[0]
+		s1 += a[1] * b[1]
+		s2 += a[2] * b[2]
+		s3 += a[3] * b[3]
+	}
+
+	for ; i < len(x); i++ {
+		s0 += x[i] * y[i]
+	}
+
+	return (s0 + s1) + (s2 + s3)
+}
+
+func (Blocked) Add(trg, a, b *mat.Dense) {
+	rown, coln := same(a, b)
+	shape(trg, rown, coln)
+
+	for row := range rown {
+		trgRow, aRow, bRow := trg.RawRowView(row), a.RawRowView(row), b.RawRowView(row)
+
+		for col, val := range aRow {
+			trgRow[col] = val + bRow[col]
+		}
+	}
+}
+
+func (Blocked) MulElem(trg, a, b *mat.Dense) {
+	rown, coln := same(a, b)
+	shape(trg, rown, coln)
+
+	for row := range rown {
+		trgRow, aRow, bRow := trg.RawRowView(row), a.RawRowView(row), b.RawRowView(row)
+
+		for col, val := range aRow {
+			trgRow[col] = val * bRow[col]
+		}
+	}
+}
+
+func (Blocked) Scale(trg *mat.Dense, f float64, a *mat.Dense) {
+	rown, coln := a.Dims()
+	shape(trg, rown, coln)
+
+	for row := range rown {
+		trgRow := trg.RawRowView(row)
+
+		for col, val := range a.RawRowView(row) {
+			trgRow[col] = f * val
+		}
+	}
+}
+
+func (Blocked) AddScaled(trg *mat.Dense, f float64, a *mat.Dense) {
+	rown, _ := same(trg, a)
+
+	for row := range rown {
+		axpy(trg.RawRowView(row), f, a.RawRowView(row))
+	}
+}
+
+// Apply совпадает с Gonum.Apply, который не использует BLAS.
+func (Blocked) Apply(trg, src *mat.Dense, f func(float64) float64) {
+	Gonum{}.Apply(trg, src, f)
+}
+
+func (Blocked) Softmax(trg, src *mat.Dense) {
+	rown, coln := src.Dims()
+	shape(trg, rown, coln)
+
+	for row := range rown {
+		trgRow, srcRow := trg.RawRowView(row), src.RawRowView(row)
+
+		m := math.Inf(-1)
+		for _, val := range srcRow {
+			m = max(m, val)
+		}
+
+		var sum float64
+		for col, val := range srcRow {
+			exp := math.Exp(val - m)
+			trgRow[col] = exp
+			sum += exp
+		}
+
+		for col := range trgRow {
+			trgRow[col] /= sum
+		}
+	}
+}
+
+func (Blocked) RowSums(trg []float64, src *mat.Dense) {
+	rown, _ := src.Dims()
+	length(trg, rown)
+
+	for row := range rown {
+		var sum float64
+		for _, val := range src.RawRowView(row) {
+			sum += val
+		}
+		trg[row] = sum
+	}
+}
+
+func (Blocked) ColSums(trg []float64, src *mat.Dense) {
+	rown, coln := src.Dims()
+	length(trg, coln)
+	clear(trg)
+
+	for row := range rown {
+		for col, val := range src.RawRowView(row) {
+			trg[col] += val
+		}
+	}
+}
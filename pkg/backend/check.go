@@ -0,0 +1,284 @@
+package backend
+
+import (
+	"fmt"
+	"gonum.org/v1/gonum/mat"
+	"math"
+	"math/rand/v2"
+)
+
+// Tolerance - допустимая относительная ошибка операции в Check.
+const Tolerance = 1e-12
+
+/*
+Result - наибольшее расхождение операции Op с эталоном в случае Case.
+Err = |результат-эталон| / max(|эталон|, 1), неверный размер дает +Inf.
+*/
+type Result struct {
+	Op   string
+	Case int
+	Err  float64
+}
+
+func (res Result) String() string {
+	return fmt.Sprintf("%s, случай %d: ошибка %.2g", res.Op, res.Case, res.Err)
+}
+
+// mulCases - размеры m×k·k×n случаев Mul, включая неполные блоки Blocked и Gonum.
+var mulCases = [][3]int{
+	{1, 1, 1},
+	{3, 5, 2},
+	{17, 33, 9},
+	{64, 64, 64},
+	{5, 300, 600},
+	{200, 40, 300},
+}
+
+/*
+Check сравнивает операции backend с простыми вычислениями по определению:
+Mul на матрицах разных размеров со всеми сочетаниями транспонирования,
+поэлементные операции, softmax и суммы. Аргументы бывают частями
+матриц с шагом строк больше ширины, приемники - пустыми, заполненными
+мусором или совпадающими с аргументом. Возвращает случаи с ошибкой
+больше Tolerance, пустой результат означает, что backend прошел проверку.
+*/
+func Check(backend Backend) []Result {
+	var (
+		rng     = rand.New(rand.NewPCG(1, 2))
+		results []Result
+	)
+
+	fail := func(op string, index int, got, want *mat.Dense) {
+		if err := diff(got, want); err > Tolerance {
+			results = append(results, Result{Op: op, Case: index, Err: err})
+		}
+	}
+
+	var index int
+	for _, dims := range mulCases {
+		m, k, n := dims[0], dims[1], dims[2]
+
+		for _, trans := range [][2]bool{{false, false}, {false, true}, {true, false}, {true, true}} {
+			a, b := operand(rng, m, k, trans[0], index%2 == 1), operand(rng, k, n, trans[1], index%3 == 1)
+
+			got := receiver(rng, m, n, index%2 == 0)
+			backend.Mul(got, a, b, trans[0], trans[1])
+			fail(fmt.Sprintf("Mul %dx%dx%d %v", m, k, n, trans), index, got, mul(view(a, trans[0]), view(b, trans[1])))
+
+			index++
+		}
+	}
+
+	elementwise := []struct {
+		op    string
+		apply func(trg, a, b *mat.Dense)
+		want  func(a, b float64) float64
+	}{
+		{"Add", backend.Add, func(a, b float64) float64 { return a + b }},
+		{"MulElem", backend.MulElem, func(a, b float64) float64 { return a * b }},
+		{
+			"Scale",
+			func(trg, a, _ *mat.Dense) { backend.Scale(trg, -1.5, a) },
+			func(a, _ float64) float64 { return -1.5 * a },
+		},
+		{
+			"AddScaled",
+			func(trg, a, b *mat.Dense) {
+				trg.Copy(b)
+				backend.AddScaled(trg, .25, a)
+			},
+			func(a, b float64) float64 { return b + .25*a },
+		},
+		{
+			"Apply",
+			func(trg, a, _ *mat.Dense) { backend.Apply(trg, a, math.Sin) },
+			func(a, _ float64) float64 { return math.Sin(a) },
+		},
+	}
+
+	for _, dims := range mulCases {
+		r, c := dims[0], dims[2]
+
+		for _, test := range elementwise {
+			a, b := operand(rng, r, c, false, true), operand(rng, r, c, false, false)
+
+			want := mat.NewDense(r, c, nil)
+			for row := range r {
+				for col := range c {
+					want.Set(row, col, test.want(a.At(row, col), b.At(row, col)))
+				}
+			}
+
+			got := receiver(rng, r, c, test.op != "AddScaled")
+			test.apply(got, a, b)
+			fail(test.op, index, got, want)
+
+			// приемник совпадает с первым аргументом
+			alias := mat.DenseCopyOf(a)
+			if test.op == "AddScaled" {
+				alias.Copy(b)
+				backend.AddScaled(alias, .25, a)
+			} else {
+				test.apply(alias, alias, b)
+			}
+			fail(test.op+" на месте", index, alias, want)
+
+			index++
+		}
+
+		src := random(rng, r, c)
+		src.Scale(30, src)
+		// маска внимания: запрещенные позиции -Inf, первая позиция строки остается
+		for row := range r {
+			for col := row + 1; col < c; col += 2 {
+				src.Set(row, col, math.Inf(-1))
+			}
+		}
+
+		// сдвиг не меняет softmax, но переполняет экспоненты без вычитания максимума
+		var shifted mat.Dense
+		shifted.Apply(func(_, _ int, val float64) float64 {
+			return val + 1000
+		}, src)
+		want := softmax(src)
+
+		got := receiver(rng, r, c, true)
+		backend.Softmax(got, &shifted)
+		fail("Softmax", index, got, want)
+
+		backend.Softmax(&shifted, &shifted)
+		fail("Softmax на месте", index, &shifted, want)
+
+		index++
+
+		sums := operand(rng, r, c, false, true)
+
+		rows, cols := filled(r, math.NaN()), filled(c, math.NaN())
+		backend.RowSums(rows, sums)
+		backend.ColSums(cols, sums)
+
+		fail("RowSums", index, mat.NewDense(r, 1, rows), mul(sums, mat.NewDense(c, 1, filled(c, 1))))
+		fail("ColSums", index, mat.NewDense(1, c, cols), mul(mat.NewDense(1, r, filled(r, 1)), sums))
+
+		index++
+	}
+
+	return results
+}
+
+/*
+operand возвращает случайный множитель r×c. Если trans, он хранится
+транспонированным, то есть возвращается матрица c×r, если strided -
+частью матрицы пошире.
+*/
+func operand(rng *rand.Rand, r, c int, trans, strided bool) *mat.Dense {
+	if trans {
+		r, c = c, r
+	}
+
+	m := random(rng, r, c+3)
+	res := m.Slice(0, r, 0, c).(*mat.Dense)
+	if !strided {
+		res = mat.DenseCopyOf(res)
+	}
+
+	return res
+}
+
+// view возвращает множитель, хранящийся в m, см. operand.
+func view(m *mat.Dense, trans bool) mat.Matrix {
+	if trans {
+		return m.T()
+	}
+	return m
+}
+
+// receiver возвращает пустую матрицу или матрицу r×c, заполненную мусором.
+func receiver(rng *rand.Rand, r, c int, empty bool) *mat.Dense {
+	if empty {
+		return new(mat.Dense)
+	}
+
+	m := random(rng, r, c)
+	m.Scale(1e3, m)
+	return m
+}
+
+func random(rng *rand.Rand, r, c int) *mat.Dense {
+	data := make([]float64, r*c)
+	for index := range data {
+		data[index] = rng.Float64()*2 - 1
+	}
+	return mat.NewDense(r, c, data)
+}
+
+func filled(n int, val float64) []float64 {
+	data := make([]float64, n)
+	for index := range data {
+		data[index] = val
+	}
+	return data
+}
+
+// mul вычисляет произведение a·b по определению.
+func mul(a, b mat.Matrix) *mat.Dense {
+	r, k := a.Dims()
+	_, c := b.Dims()
+	res := mat.NewDense(r, c, nil)
+
+	for row := range r {
+		for col := range c {
+			var sum float64
+			for p := range k {
+				sum += a.At(row, p) * b.At(p, col)
+			}
+			res.Set(row, col, sum)
+		}
+	}
+
+	return res
+}
+
+// softmax вычисляет softmax строк по определению.
+func softmax(src *mat.Dense) *mat.Dense {
+	r, c := src.Dims()
+	res := mat.NewDense(r, c, nil)
+
+	for row := range r {
+		var sum float64
+		for col := range c {
+			sum += math.Exp(src.At(row, col))
+		}
+
+		for col := range c {
+			res.Set(row, col, math.Exp(src.At(row, col))/sum)
+		}
+	}
+
+	return res
+}
+
+// diff возвращает наибольшую относительную ошибку got по сравнению с want.
+func diff(got, want *mat.Dense) float64 {
+	gr, gc := got.Dims()
+	wr, wc := want.Dims()
+	if gr != wr || gc != wc {
+		return math.Inf(1)
+	}
+
+	var res float64
+	for row := range wr {
+		for col := range wc {
+			g, w := got.At(row, col), want.At(row, col)
+
+			err := math.Abs(g-w) / max(math.Abs(w), 1)
+			if math.IsNaN(err) {
+				err = math.Inf(1)
+			}
+
+			res = max(res, err)
+		}
+	}
+
+	return res
+}
@@ -0,0 +1,112 @@
+package backend
+
+import (
+	"gonum.org/v1/gonum/blas"
+	"gonum.org/v1/gonum/blas/blas64"
+	"gonum.org/v1/gonum/floats"
+	"gonum.org/v1/gonum/mat"
+	"math"
+)
+
+/*
+Gonum - реализация по умолчанию на gonum: умножение матриц через BLAS
+gonum, суммы и поэлементные операции строк через floats.
+*/
+type Gonum struct{}
+
+func (Gonum) Name() string {
+	return "gonum"
+}
+
+func (Gonum) Mul(trg, a, b *mat.Dense, at, bt bool) {
+	mulDims(trg, a, b, at, bt)
+
+	ta, tb := blas.NoTrans, blas.NoTrans
+	if at {
+		ta = blas.Trans
+	}
+	if bt {
+		tb = blas.Trans
+	}
+
+	blas64.Gemm(ta, tb, 1, a.RawMatrix(), b.RawMatrix(), 0, trg.RawMatrix())
+}
+
+func (Gonum) Add(trg, a, b *mat.Dense) {
+	trg.Add(a, b)
+}
+
+func (Gonum) MulElem(trg, a, b *mat.Dense) {
+	trg.MulElem(a, b)
+}
+
+// Scale в отличие от trg.Scale не выделяет память при trg, совпадающей с a.
+func (Gonum) Scale(trg *mat.Dense, f float64, a *mat.Dense) {
+	rown, coln := a.Dims()
+	shape(trg, rown, coln)
+
+	for row := range rown {
+		floats.ScaleTo(trg.RawRowView(row), f, a.RawRowView(row))
+	}
+}
+
+func (Gonum) AddScaled(trg *mat.Dense, f float64, a *mat.Dense) {
+	rown, _ := same(trg, a)
+
+	for row := range rown {
+		floats.AddScaled(trg.RawRowView(row), f, a.RawRowView(row))
+	}
+}
+
+func (Gonum) Apply(trg, src *mat.Dense, f func(float64) float64) {
+	rown, coln := src.Dims()
+	shape(trg, rown, coln)
+
+	for row := range rown {
+		trgRow, srcRow := trg.RawRowView(row), src.RawRowView(row)
+
+		for col, val := range srcRow {
+			trgRow[col] = f(val)
+		}
+	}
+}
+
+func (Gonum) Softmax(trg, src *mat.Dense) {
+	rown, coln := src.Dims()
+	shape(trg, rown, coln)
+
+	for row := range rown {
+		trgRow, srcRow := trg.RawRowView(row), src.RawRowView(row)
+		m := floats.Max(srcRow)
+
+		var sum float64
+		for col, val := range srcRow {
+			exp := math.Exp(val - m)
+			trgRow[col] = exp
+			sum += exp
+		}
+
+		for col := range trgRow {
+			trgRow[col] /= sum
+		}
+	}
+}
+
+func (Gonum) RowSums(trg []float64, src *mat.Dense) {
+	rown, _ := src.Dims()
+	length(trg, rown)
+
+	for row := range trg {
+		trg[row] = floats.Sum(src.RawRowView(row))
+	}
+}
+
+func (Gonum) ColSums(trg []float64, src *mat.Dense) {
+	rown, coln := src.Dims()
+	length(trg, coln)
+	clear(trg)
+
+	for row := range rown {
+		floats.Add(trg, src.RawRowView(row))
+	}
+}
@@ -1,9 +1,12 @@
 package bpe
 
 import (
+	"crypto/sha256"
+	"encoding/binary"
 	"encoding/gob"
 	"github.com/blevesearch/segment"
 	"os"
+	"slices"
 	"strings"
 	"unicode"
 )
@@ -82,8 +85,44 @@ GetTok перед использованием необходимо вызват
 */
 func (bpe *BPE) GetTok(ind int) string { return bpe.inv[ind] }
 
+/*
+GetText собирает текст из индексов, заменяя eow пробелом, так что
+текст последовательности равен сумме текстов ее токенов.
+Как и GetTok, требует вызова PrepareInv.
+*/
+func (bpe *BPE) GetText(inds []int) string {
+	var text strings.Builder
+
+	for _, ind := range inds {
+		text.WriteString(strings.ReplaceAll(bpe.GetTok(ind), bpe.eow, " "))
+	}
+
+	return text.String()
+}
+
 func (bpe *BPE) Len() int { return len(bpe.val) }
 
+/*
+Hash возвращает отпечаток словаря: два токенизатора с одинаковым
+отпечатком разбивают любой текст одинаково.
+*/
+func (bpe *BPE) Hash() [sha256.Size]byte {
+	toks := make([]string, 0, len(bpe.val))
+	for tok := range bpe.val {
+		toks = append(toks, tok)
+	}
+	slices.Sort(toks)
+
+	hash := sha256.New()
+	for _, tok := range append(toks, bpe.eow, bpe.unk) {
+		binary.Write(hash, binary.LittleEndian, uint32(len(tok)))
+		hash.Write([]byte(tok))
+		binary.Write(hash, binary.LittleEndian, uint32(bpe.val[tok]))
+	}
+
+	return [sha256.Size]byte(hash.Sum(nil))
+}
+
 type data struct {
 	Val map[string]int
 	EOW,
@@ -106,10 +145,14 @@ func Load(src string) *BPE {
 		panic(err)
 	}
 
+	return New(d.Val, d.EOW, d.UNK)
+}
+
+func New(val map[string]int, eow, unk string) *BPE {
 	bpe := &BPE{
-		val: d.Val,
-		eow: d.EOW,
-		unk: d.UNK,
+		val: val,
+		eow: eow,
+		unk: unk,
 	}
 
 	if len(bpe.eow) == 0 {
@@ -108,3 +108,53 @@ func Test_GetTextInds(t *testing.T) {
 		}
 	}
 }
+
+func Test_Hash(t *testing.T) {
+	other := map[string]int{}
+	for tok, ind := range val {
+		other[tok] = ind
+	}
+
+	same := &BPE{val: other, eow: eow, unk: unk}
+
+	if bpe.Hash() != same.Hash() {
+		t.Errorf("equal vocabularies have different hashes")
+	}
+
+	other["день"+eow], other["в"+eow] = other["в"+eow], other["день"+eow]
+
+	if bpe.Hash() == same.Hash() {
+		t.Errorf("different vocabularies have equal hashes")
+	}
+
+	if bpe.Hash() == (&BPE{val: val, eow: unk, unk: eow}).Hash() {
+		t.Errorf("different special tokens have equal hashes")
+	}
+}
+
+func Test_GetText(t *testing.T) {
+	bpe.PrepareInv()
+
+	tests := []struct {
+		inds []int
+		out  string
+	}{
+		{
+			inds: []int{3, 4, 5, 6, 7},
+			out:  "другой день поутру ",
+		},
+		{
+			inds: []int{6, 1, 0, 8},
+			out:  "поunk в ",
+		},
+		{},
+	}
+
+	for _, test := range tests {
+		out := bpe.GetText(test.inds)
+
+		if out != test.out {
+			t.Errorf("GetText(%v)=%q, want %q", test.inds, out, test.out)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package dirreader
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// openArchive открывает архив для members, тесты подменяют ее для подсчета открытий.
+var openArchive = os.Open
+
+func isCompressed(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	return ext == ".gz" || ext == ".zst"
+}
+
+func isArchive(name string) bool {
+	name = strings.ToLower(name)
+
+	if strings.HasSuffix(name, ".zip") ||
+		strings.HasSuffix(name, ".tgz") {
+		return true
+	}
+
+	if isCompressed(name) {
+		name = strings.TrimSuffix(name, filepath.Ext(name))
+	}
+
+	return strings.HasSuffix(name, ".tar")
+}
+
+/*
+decompress оборачивает reader распаковщиком по расширению name.
+Файлы без расширения .gz и .zst возвращаются как есть.
+Результат закрывается вызывающим, reader при этом не закрывается.
+*/
+func decompress(name string, reader io.Reader) io.ReadCloser {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".gz", ".tgz":
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			panic(err)
+		}
+		return gz
+	case ".zst":
+		// поток читается один раз, лишние горутины распаковщика не нужны
+		zst, err := zstd.NewReader(reader, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			panic(err)
+		}
+		return zst.IOReadCloser()
+	}
+
+	return io.NopCloser(reader)
+}
+
+/*
+members вызывает yield для каждого обычного файла архива name.
+Путь файла складывается из пути архива и пути внутри него.
+Файлы с путями, выходящими за пределы архива, пропускаются.
+*/
+func members(name string, yield func(string, io.Reader) bool) bool {
+	if strings.ToLower(filepath.Ext(name)) == ".zip" {
+		return zipMembers(name, yield)
+	}
+
+	file, err := openArchive(name)
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+
+	unpacked := decompress(name, file)
+	defer unpacked.Close()
+
+	reader := tar.NewReader(unpacked)
+
+	for {
+		head, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			return true
+		}
+		if err != nil {
+			panic(err)
+		}
+
+		if head.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		member, ok := memberPath(name, head.Name)
+		if !ok {
+			continue
+		}
+
+		if !yield(member, reader) {
+			return false
+		}
+	}
+}
+
+func zipMembers(name string, yield func(string, io.Reader) bool) bool {
+	file, err := openArchive(name)
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		panic(err)
+	}
+
+	archive, err := zip.NewReader(file, info.Size())
+	if err != nil {
+		panic(err)
+	}
+
+	for _, file := range archive.File {
+		if !file.Mode().IsRegular() {
+			continue
+		}
+
+		member, ok := memberPath(name, file.Name)
+		if !ok {
+			continue
+		}
+
+		reader, err := file.Open()
+		if err != nil {
+			panic(err)
+		}
+
+		ok = yield(member, reader)
+		reader.Close()
+
+		if !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+func memberPath(archive, name string) (string, bool) {
+	name = path.Clean("/" + name)[1:]
+
+	if name == "" {
+		return "", false
+	}
+
+	return filepath.Join(archive, filepath.FromSlash(name)), true
+}
@@ -1,18 +1,431 @@
 package dirreader
 
 import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"io"
+	"io/fs"
 	"iter"
 	"os"
+	"path"
 	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"unicode/utf8"
 )
 
+type Links int
+
+const (
+	// LinksFollow переходит по ссылкам на файлы и каталоги.
+	LinksFollow Links = iota
+	// LinksFiles переходит только по ссылкам на файлы.
+	LinksFiles
+	// LinksSkip пропускает все ссылки.
+	LinksSkip
+)
+
+type Invalid int
+
+const (
+	// InvalidKeep оставляет содержимое без изменений.
+	InvalidKeep Invalid = iota
+	// InvalidSkip пропускает файлы, не являющиеся корректным UTF-8.
+	InvalidSkip
+	// InvalidReplace заменяет некорректные последовательности на U+FFFD.
+	InvalidReplace
+)
+
+/*
+Options ограничивает набор читаемых файлов. Нулевое значение
+читает все файлы так же, как Read.
+*/
+type Options struct {
+	/*
+		Include и Exclude - шаблоны filepath.Match. Шаблон со слешем
+		сравнивается с путем относительно корня, без слеша - с именем файла.
+		Пустой Include разрешает все файлы, Exclude применяется и к каталогам.
+	*/
+	Include,
+	Exclude []string
+	// Exts - допустимые расширения вида ".txt", пустой список разрешает все.
+	Exts []string
+	// MaxSize - максимальный размер содержимого в байтах, 0 - без ограничения.
+	MaxSize    int64
+	SkipHidden bool
+	Links      Links
+	Invalid    Invalid
+	// Unpack читает .gz, .zst, .tar и .zip как их содержимое.
+	Unpack bool
+}
+
 func Read(src string) iter.Seq2[string, []byte] {
+	return ReadWith(src, Options{})
+}
+
+func ReadWith(src string, opts Options) iter.Seq2[string, []byte] {
 	return func(yield func(string, []byte) bool) {
-		read(src, yield)
+		walk(src, opts, func(name string) bool {
+			return open(src, name, opts, yield)
+		})
+	}
+}
+
+/*
+Files возвращает пути всех файлов в src в том же порядке,
+в котором их обходит Read, не читая содержимое.
+*/
+func Files(src string) []string {
+	return FilesWith(src, Options{})
+}
+
+/*
+FilesWith возвращает пути, которые выдал бы ReadWith. Файлы внутри архивов
+получают пути вида archive.zip/dir/file, их читает ReadFile.
+Ограничения размера и кодировки проверяются только при чтении.
+*/
+func FilesWith(src string, opts Options) []string {
+	var files []string
+
+	walk(src, opts, func(name string) bool {
+		if !opts.Unpack || !isArchive(name) {
+			files = append(files, name)
+			return true
+		}
+
+		return members(name, func(member string, _ io.Reader) bool {
+			if opts.match(src, member) {
+				files = append(files, member)
+			}
+			return true
+		})
+	})
+
+	return files
+}
+
+/*
+ReadFile читает файл, выданный FilesWith. Второе значение ложно,
+если файл не проходит ограничения opts по размеру или кодировке.
+Файл архива ищется распаковкой архива с начала, для чтения многих
+файлов одного архива подходит Reader.
+*/
+func ReadFile(name string, opts Options) ([]byte, bool) {
+	info, err := os.Stat(name)
+	if err == nil && !info.IsDir() {
+		if opts.MaxSize > 0 && !isCompressed(name) && info.Size() > opts.MaxSize {
+			return nil, false
+		}
+
+		file, err := os.Open(name)
+		if err != nil {
+			panic(err)
+		}
+		defer file.Close()
+
+		if !opts.Unpack {
+			return opts.read(file)
+		}
+
+		reader := decompress(name, file)
+		defer reader.Close()
+
+		return opts.read(reader)
 	}
+
+	if archive := archiveOf(name); archive != "" {
+		var (
+			data []byte
+			ok,
+			found bool
+		)
+
+		members(archive, func(member string, reader io.Reader) bool {
+			if member != name {
+				return true
+			}
+
+			data, ok = opts.read(reader)
+			found = true
+			return false
+		})
+
+		if found {
+			return data, ok
+		}
+	}
+
+	panic(fmt.Sprintf("файл %s не найден", name))
 }
 
-func read(src string, yield func(string, []byte) bool) bool {
+// archiveOf возвращает путь архива, содержащего name, или пустую строку.
+func archiveOf(name string) string {
+	for archive := filepath.Dir(name); archive != filepath.Dir(archive); archive = filepath.Dir(archive) {
+		info, err := os.Stat(archive)
+		if err != nil || info.IsDir() || !isArchive(archive) {
+			continue
+		}
+
+		return archive
+	}
+
+	return ""
+}
+
+// DefaultLimit - объем файлов архивов, хранимых Reader, подходящий для обучения.
+const DefaultLimit int64 = 256 << 20
+
+/*
+Reader читает файлы src, выданные FilesWith, как ReadFile, но не распаковывает
+архив заново для каждого файла: при чтении файла архива Reader сохраняет
+следующие за ним файлы архива, прошедшие opts, пока их общий размер
+не превысит limit байт, вытесняя сохраненные раньше. Прочитанный файл
+из Reader удаляется. Без этого чтение N файлов сжатого tar по одному
+распаковывает архив N раз. Методы Reader можно вызывать одновременно
+из нескольких горутин, архивы при этом распаковываются по одному.
+*/
+type Reader struct {
+	src  string
+	opts Options
+	limit,
+	size int64
+	mut sync.Mutex
+	// files - сохраненные файлы архивов, order - они же от давно сохраненных.
+	files map[string]*list.Element
+	order list.List
+}
+
+// cached - сохраненный файл архива.
+type cached struct {
+	name string
+	data []byte
+	ok   bool
+}
+
+func NewReader(src string, opts Options, limit int64) *Reader {
+	return &Reader{
+		src:   src,
+		opts:  opts,
+		limit: limit,
+		files: make(map[string]*list.Element),
+	}
+}
+
+func (reader *Reader) ReadFile(name string) ([]byte, bool) {
+	info, err := os.Stat(name)
+	if err == nil && !info.IsDir() {
+		return ReadFile(name, reader.opts)
+	}
+
+	archive := archiveOf(name)
+	if archive == "" {
+		panic(fmt.Sprintf("файл %s не найден", name))
+	}
+
+	reader.mut.Lock()
+	defer reader.mut.Unlock()
+
+	if elem, ok := reader.files[name]; ok {
+		file := reader.remove(elem)
+		return file.data, file.ok
+	}
+
+	var (
+		file  cached
+		found bool
+		// added - число файлов, сохраненных при этой распаковке.
+		added int
+	)
+
+	members(archive, func(member string, unpacked io.Reader) bool {
+		if !found {
+			if member == name {
+				file.data, file.ok = reader.opts.read(unpacked)
+				found = true
+			}
+			return true
+		}
+
+		if _, ok := reader.files[member]; ok || !reader.opts.match(reader.src, member) {
+			return true
+		}
+
+		data, ok := reader.opts.read(unpacked)
+
+		// вытесняются только файлы прошлых распаковок
+		for reader.size+int64(len(data)) > reader.limit && reader.order.Len() > added {
+			reader.remove(reader.order.Front())
+		}
+		if reader.size+int64(len(data)) > reader.limit {
+			return false
+		}
+
+		reader.files[member] = reader.order.PushBack(cached{name: member, data: data, ok: ok})
+		reader.size += int64(len(data))
+		added++
+
+		return true
+	})
+
+	if !found {
+		panic(fmt.Sprintf("файл %s не найден", name))
+	}
+
+	return file.data, file.ok
+}
+
+// remove удаляет сохраненный файл elem и возвращает его.
+func (reader *Reader) remove(elem *list.Element) cached {
+	file := reader.order.Remove(elem).(cached)
+	delete(reader.files, file.name)
+	reader.size -= int64(len(file.data))
+	return file
+}
+
+func open(src, name string, opts Options, yield func(string, []byte) bool) bool {
+	if opts.Unpack && isArchive(name) {
+		return members(name, func(member string, reader io.Reader) bool {
+			if !opts.match(src, member) {
+				return true
+			}
+
+			data, ok := opts.read(reader)
+			if !ok {
+				return true
+			}
+
+			return yield(member, data)
+		})
+	}
+
+	data, ok := ReadFile(name, opts)
+	if !ok {
+		return true
+	}
+
+	return yield(name, data)
+}
+
+func (opts Options) read(reader io.Reader) ([]byte, bool) {
+	if opts.MaxSize > 0 {
+		reader = io.LimitReader(reader, opts.MaxSize+1)
+	}
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		panic(err)
+	}
+
+	if opts.MaxSize > 0 && int64(len(data)) > opts.MaxSize {
+		return nil, false
+	}
+
+	if utf8.Valid(data) {
+		return data, true
+	}
+
+	switch opts.Invalid {
+	case InvalidSkip:
+		return nil, false
+	case InvalidReplace:
+		return bytes.ToValidUTF8(data, []byte(string(utf8.RuneError))), true
+	}
+
+	return data, true
+}
+
+func rel(src, name string) string {
+	rel, err := filepath.Rel(src, name)
+	if err != nil {
+		panic(err)
+	}
+
+	return filepath.ToSlash(rel)
+}
+
+func matchAny(patterns []string, rel string) bool {
+	for _, pattern := range patterns {
+		name := rel
+		if !strings.Contains(pattern, "/") {
+			name = path.Base(rel)
+		}
+
+		ok, err := path.Match(pattern, name)
+		if err != nil {
+			panic(err)
+		}
+
+		if ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+func hidden(rel string) bool {
+	for _, part := range strings.Split(rel, "/") {
+		if strings.HasPrefix(part, ".") && part != "." && part != ".." {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (opts Options) matchDir(src, name string) bool {
+	rel := rel(src, name)
+
+	if opts.SkipHidden && hidden(rel) {
+		return false
+	}
+
+	return !matchAny(opts.Exclude, rel)
+}
+
+func (opts Options) match(src, name string) bool {
+	if !opts.matchDir(src, name) {
+		return false
+	}
+
+	rel := rel(src, name)
+
+	if len(opts.Include) != 0 && !matchAny(opts.Include, rel) {
+		return false
+	}
+
+	if len(opts.Exts) == 0 {
+		return true
+	}
+
+	base := path.Base(rel)
+	if opts.Unpack && isCompressed(base) {
+		base = strings.TrimSuffix(base, path.Ext(base))
+	}
+
+	return slices.Contains(opts.Exts, path.Ext(base))
+}
+
+/*
+walk обходит src и вызывает yield для каждого файла, прошедшего фильтры.
+Архивы при opts.Unpack проверяются только по Exclude и SkipHidden,
+их содержимое фильтруется отдельно.
+*/
+func walk(src string, opts Options, yield func(string) bool) bool {
+	visited := make(map[string]bool)
+	return walkDir(src, src, opts, visited, yield)
+}
+
+func walkDir(root, src string, opts Options, visited map[string]bool, yield func(string) bool) bool {
+	if real, err := filepath.EvalSymlinks(src); err == nil {
+		if visited[real] {
+			return true
+		}
+		visited[real] = true
+	}
+
 	dir, err := os.ReadDir(src)
 	if err != nil {
 		panic(err)
@@ -21,20 +434,49 @@ func read(src string, yield func(string, []byte) bool) bool {
 	for _, entry := range dir {
 		newsrc := filepath.Join(src, entry.Name())
 
-		if entry.IsDir() {
-			if !read(newsrc, yield) {
+		mode := entry.Type()
+		if mode&fs.ModeSymlink != 0 {
+			if opts.Links == LinksSkip {
+				continue
+			}
+
+			info, err := os.Stat(newsrc)
+			if err != nil {
+				continue
+			}
+
+			if info.IsDir() && opts.Links == LinksFiles {
+				continue
+			}
+
+			mode = info.Mode().Type()
+		}
+
+		if mode.IsDir() {
+			if !opts.matchDir(root, newsrc) {
+				continue
+			}
+
+			if !walkDir(root, newsrc, opts, visited, yield) {
 				return false
 			}
 
 			continue
 		}
 
-		data, err := os.ReadFile(newsrc)
-		if err != nil {
-			panic(err)
+		if !mode.IsRegular() {
+			continue
+		}
+
+		if opts.Unpack && isArchive(newsrc) {
+			if !opts.matchDir(root, newsrc) {
+				continue
+			}
+		} else if !opts.match(root, newsrc) {
+			continue
 		}
 
-		if !yield(newsrc, data) {
+		if !yield(newsrc) {
 			return false
 		}
 	}
@@ -1,8 +1,15 @@
 package dirreader
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
 	"os"
 	"path/filepath"
+	"reflect"
 	"testing"
 )
 
@@ -73,3 +80,395 @@ func Test_Read(t *testing.T) {
 		panic(err)
 	}
 }
+
+func Test_Files(t *testing.T) {
+	const root = ".\\TEMP_FILES"
+
+	paths := []string{
+		filepath.Join(root, "b", "c"),
+		filepath.Join(root, "a"),
+		filepath.Join(root, "b", "a"),
+	}
+
+	for _, path := range paths {
+		err := os.MkdirAll(filepath.Dir(path), os.ModePerm)
+		if err != nil {
+			panic(err)
+		}
+
+		err = os.WriteFile(path, []byte(path), os.ModePerm)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	var read []string
+	for path := range Read(root) {
+		read = append(read, path)
+	}
+
+	files := Files(root)
+
+	if !reflect.DeepEqual(files, read) {
+		t.Errorf("expected %v, got %v", read, files)
+	}
+
+	if len(files) != len(paths) {
+		t.Errorf("expected %d files, got %d", len(paths), len(files))
+	}
+
+	err := os.RemoveAll(root)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func write(root string, files map[string][]byte) {
+	for name, data := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+
+		err := os.MkdirAll(filepath.Dir(path), os.ModePerm)
+		if err != nil {
+			panic(err)
+		}
+
+		err = os.WriteFile(path, data, os.ModePerm)
+		if err != nil {
+			panic(err)
+		}
+	}
+}
+
+func collect(root string, opts Options) map[string]string {
+	read := make(map[string]string)
+
+	for path, data := range ReadWith(root, opts) {
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			panic(err)
+		}
+
+		read[filepath.ToSlash(rel)] = string(data)
+	}
+
+	return read
+}
+
+func Test_ReadWith(t *testing.T) {
+	root := t.TempDir()
+
+	write(root, map[string][]byte{
+		"a.txt":          []byte("a"),
+		"b.md":           []byte("b"),
+		"big.txt":        []byte("0123456789"),
+		".hidden/c.txt":  []byte("c"),
+		".d.txt":         []byte("d"),
+		"logs/e.txt":     []byte("e"),
+		"src/f.txt":      []byte("f"),
+		"src/bin.txt":    {'g', 0xff, 0xfe, 'h'},
+		"src/deep/g.txt": []byte("g"),
+	})
+
+	tests := []struct {
+		opts   Options
+		output map[string]string
+	}{
+		{
+			opts: Options{
+				Exts:       []string{".txt"},
+				Exclude:    []string{"logs", "bin.*"},
+				MaxSize:    4,
+				SkipHidden: true,
+			},
+			output: map[string]string{
+				"a.txt":          "a",
+				"src/f.txt":      "f",
+				"src/deep/g.txt": "g",
+			},
+		},
+		{
+			opts: Options{
+				Include: []string{"src/*", ".*"},
+			},
+			output: map[string]string{
+				".d.txt":      "d",
+				"src/f.txt":   "f",
+				"src/bin.txt": "g\xff\xfeh",
+			},
+		},
+		{
+			opts: Options{
+				Include: []string{"src/*"},
+				Invalid: InvalidSkip,
+			},
+			output: map[string]string{
+				"src/f.txt": "f",
+			},
+		},
+		{
+			opts: Options{
+				Include: []string{"bin.txt"},
+				Invalid: InvalidReplace,
+			},
+			output: map[string]string{
+				"src/bin.txt": "g�h",
+			},
+		},
+	}
+
+	for i, test := range tests {
+		output := collect(root, test.opts)
+
+		if !reflect.DeepEqual(output, test.output) {
+			t.Errorf("%d: expected %v, got %v", i, test.output, output)
+		}
+	}
+}
+
+func Test_ReadWith_Links(t *testing.T) {
+	root := t.TempDir()
+	other := t.TempDir()
+
+	write(root, map[string][]byte{"dir/a": []byte("a")})
+	write(other, map[string][]byte{"b": []byte("b"), "c/d": []byte("d")})
+
+	links := map[string]string{
+		filepath.Join(other, "b"):   filepath.Join(root, "b"),
+		filepath.Join(other, "c"):   filepath.Join(root, "c"),
+		filepath.Join(root, "dir"):  filepath.Join(root, "dir", "loop"),
+		filepath.Join(root, "none"): filepath.Join(root, "broken"),
+	}
+
+	for oldname, newname := range links {
+		err := os.Symlink(oldname, newname)
+		if err != nil {
+			t.Skip(err)
+		}
+	}
+
+	tests := []struct {
+		links  Links
+		output map[string]string
+	}{
+		{
+			links: LinksFollow,
+			output: map[string]string{
+				"dir/a": "a",
+				"b":     "b",
+				"c/d":   "d",
+			},
+		},
+		{
+			links: LinksFiles,
+			output: map[string]string{
+				"dir/a": "a",
+				"b":     "b",
+			},
+		},
+		{
+			links: LinksSkip,
+			output: map[string]string{
+				"dir/a": "a",
+			},
+		},
+	}
+
+	for i, test := range tests {
+		output := collect(root, Options{Links: test.links})
+
+		if !reflect.DeepEqual(output, test.output) {
+			t.Errorf("%d: expected %v, got %v", i, test.output, output)
+		}
+	}
+}
+
+func Test_ReadWith_Unpack(t *testing.T) {
+	root := t.TempDir()
+
+	var gz bytes.Buffer
+	gzw := gzip.NewWriter(&gz)
+	gzw.Write([]byte("gz"))
+	gzw.Close()
+
+	var zst bytes.Buffer
+	zstw, err := zstd.NewWriter(&zst)
+	if err != nil {
+		panic(err)
+	}
+	zstw.Write([]byte("zst"))
+	zstw.Close()
+
+	var tarb bytes.Buffer
+	tarw := tar.NewWriter(&tarb)
+	for name, data := range map[string]string{"t/a.txt": "ta", "t/b.bin": "tb"} {
+		tarw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: int64(len(data))})
+		tarw.Write([]byte(data))
+	}
+	tarw.Close()
+
+	var targz bytes.Buffer
+	targzw := gzip.NewWriter(&targz)
+	targzw.Write(tarb.Bytes())
+	targzw.Close()
+
+	var zipb bytes.Buffer
+	zipw := zip.NewWriter(&zipb)
+	for name, data := range map[string]string{"z/a.txt": "za", "../evil.txt": "evil"} {
+		file, err := zipw.Create(name)
+		if err != nil {
+			panic(err)
+		}
+		file.Write([]byte(data))
+	}
+	zipw.Close()
+
+	write(root, map[string][]byte{
+		"a.txt.gz":      gz.Bytes(),
+		"b.txt.zst":     zst.Bytes(),
+		"c.tar":         tarb.Bytes(),
+		"d/e.tar.gz":    targz.Bytes(),
+		"f.zip":         zipb.Bytes(),
+		"plain.txt":     []byte("plain"),
+		"skip.bin":      []byte("skip"),
+		"large.txt.zst": zst.Bytes(),
+	})
+
+	opts := Options{
+		Unpack:  true,
+		Exts:    []string{".txt"},
+		Exclude: []string{"large.*"},
+	}
+
+	expected := map[string]string{
+		"a.txt.gz":           "gz",
+		"b.txt.zst":          "zst",
+		"c.tar/t/a.txt":      "ta",
+		"d/e.tar.gz/t/a.txt": "ta",
+		"f.zip/z/a.txt":      "za",
+		"f.zip/evil.txt":     "evil",
+		"plain.txt":          "plain",
+	}
+
+	output := collect(root, opts)
+
+	if !reflect.DeepEqual(output, expected) {
+		t.Errorf("expected %v, got %v", expected, output)
+	}
+
+	files := FilesWith(root, opts)
+
+	if len(files) != len(expected) {
+		t.Errorf("expected %d files, got %v", len(expected), files)
+	}
+
+	for _, path := range files {
+		data, ok := ReadFile(path, opts)
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			panic(err)
+		}
+
+		if !ok || string(data) != expected[filepath.ToSlash(rel)] {
+			t.Errorf("ReadFile(%s)=%q, %v", rel, data, ok)
+		}
+	}
+
+	_, ok := ReadFile(filepath.Join(root, "b.txt.zst"), Options{Unpack: true, MaxSize: 2})
+	if ok {
+		t.Errorf("expected decompressed size limit")
+	}
+}
+
+func Test_Reader(t *testing.T) {
+	root := t.TempDir()
+
+	var tarb bytes.Buffer
+	tarw := tar.NewWriter(&tarb)
+	for index := range 10 {
+		data := fmt.Sprintf("t%d", index)
+		tarw.WriteHeader(&tar.Header{Name: fmt.Sprintf("t/%d.txt", index), Mode: 0600, Size: int64(len(data))})
+		tarw.Write([]byte(data))
+	}
+	tarw.Close()
+
+	var targz bytes.Buffer
+	targzw := gzip.NewWriter(&targz)
+	targzw.Write(tarb.Bytes())
+	targzw.Close()
+
+	var zipb bytes.Buffer
+	zipw := zip.NewWriter(&zipb)
+	for index := range 10 {
+		file, err := zipw.Create(fmt.Sprintf("z/%d.txt", index))
+		if err != nil {
+			panic(err)
+		}
+		file.Write(fmt.Appendf(nil, "z%d", index))
+	}
+	zipw.Close()
+
+	write(root, map[string][]byte{
+		"a.tar.gz":  targz.Bytes(),
+		"b.zip":     zipb.Bytes(),
+		"plain.txt": []byte("plain"),
+	})
+
+	opened := make(map[string]int)
+	defer func(open func(string) (*os.File, error)) {
+		openArchive = open
+	}(openArchive)
+	openArchive = func(name string) (*os.File, error) {
+		opened[filepath.Base(name)]++
+		return os.Open(name)
+	}
+
+	opts := Options{Unpack: true, Exclude: []string{"9.txt"}}
+	files := FilesWith(root, opts)
+
+	if len(files) != 19 {
+		t.Errorf("expected 19 files, got %d", len(files))
+	}
+
+	expected := make(map[string][]byte)
+	for _, path := range files {
+		expected[path], _ = ReadFile(path, opts)
+	}
+
+	// limit в байтах, каждый файл архива занимает 2 байта
+	tests := []struct {
+		limit  int64
+		opened int
+	}{
+		{limit: DefaultLimit, opened: 1},
+		{limit: 4, opened: 3},
+		{limit: 0, opened: 9},
+	}
+
+	for i, test := range tests {
+		clear(opened)
+		reader := NewReader(root, opts, test.limit)
+
+		for _, path := range files {
+			data, ok := reader.ReadFile(path)
+
+			if !ok || !bytes.Equal(data, expected[path]) {
+				t.Errorf("%d %s: expected %q, got %q, %v", i, path, expected[path], data, ok)
+			}
+
+			if reader.size > test.limit {
+				t.Errorf("%d %s: expected at most %d bytes, got %d", i, path, test.limit, reader.size)
+			}
+		}
+
+		want := map[string]int{"a.tar.gz": test.opened, "b.zip": test.opened}
+		if !reflect.DeepEqual(opened, want) {
+			t.Errorf("%d: expected opens %v, got %v", i, want, opened)
+		}
+
+		// прочитанные и исключенные opts файлы не хранятся
+		if reader.size != 0 || len(reader.files) != 0 {
+			t.Errorf("%d: expected empty reader, got %d files", i, len(reader.files))
+		}
+	}
+}
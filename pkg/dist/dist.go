@@ -0,0 +1,330 @@
+/*
+Package dist связывает процессы распределенного обучения по TCP.
+
+Процесс 0 принимает соединения остальных процессов группы и служит
+сервером параметров: при AllReduce он получает векторы всех процессов,
+складывает их по порядку номеров и рассылает сумму обратно, поэтому
+результат одинаков во всех процессах и не зависит от порядка прихода.
+
+Сообщение - число элементов uint64 и сами элементы float64 (little endian).
+При подключении процесс передает свой номер и размер группы uint32.
+Ошибки соединения вызывают панику, как и остальные ошибки ввода-вывода.
+*/
+package dist
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultTimeout - Config.Timeout по умолчанию.
+	DefaultTimeout = time.Minute
+
+	// Переменные окружения FromEnv.
+	EnvRank  = "LLM_RANK"
+	EnvWorld = "LLM_WORLD"
+	EnvAddr  = "LLM_ADDR"
+
+	// retry - пауза между попытками подключения к процессу 0.
+	retry = 50 * time.Millisecond
+)
+
+// Config задает место процесса в группе.
+type Config struct {
+	// Rank - номер процесса от 0 до World-1.
+	Rank,
+	World int
+	// Addr - адрес процесса 0, например "127.0.0.1:7000".
+	Addr string
+	// Timeout ограничивает сбор группы в Join, 0 означает DefaultTimeout.
+	Timeout time.Duration
+}
+
+// FromEnv читает Config из переменных окружения LLM_RANK, LLM_WORLD и LLM_ADDR.
+func FromEnv() Config {
+	get := func(name string) string {
+		val, ok := os.LookupEnv(name)
+		if !ok {
+			panic(fmt.Sprintf("переменная окружения %s не задана", name))
+		}
+		return val
+	}
+
+	atoi := func(name string) int {
+		val, err := strconv.Atoi(get(name))
+		if err != nil {
+			panic(fmt.Sprintf("неверное значение %s: %v", name, err))
+		}
+		return val
+	}
+
+	return Config{
+		Rank:  atoi(EnvRank),
+		World: atoi(EnvWorld),
+		Addr:  get(EnvAddr),
+	}
+}
+
+// Group - соединения процесса с остальными процессами группы.
+type Group struct {
+	cfg Config
+	/*
+		conns[r] у процесса 0 - соединение с процессом r,
+		у остальных conns[0] - соединение с процессом 0.
+	*/
+	conns []*conn
+	// bufs - векторы процессов для AllReduce у процесса 0.
+	bufs [][]float64
+}
+
+type conn struct {
+	net.Conn
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+func newConn(c net.Conn) *conn {
+	return &conn{Conn: c, r: bufio.NewReader(c), w: bufio.NewWriter(c)}
+}
+
+/*
+Join подключает процесс к группе и ждет, пока соберутся все World
+процессов. Процесс 0 слушает cfg.Addr, остальные подключаются к нему,
+повторяя попытки до истечения Timeout.
+*/
+func Join(cfg Config) *Group {
+	if cfg.World < 1 || cfg.Rank < 0 || cfg.Rank >= cfg.World {
+		panic(fmt.Sprintf("неверный номер процесса %d в группе из %d", cfg.Rank, cfg.World))
+	}
+
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultTimeout
+	}
+
+	group := &Group{cfg: cfg, conns: make([]*conn, cfg.World)}
+
+	if cfg.World == 1 {
+		return group
+	}
+
+	if cfg.Rank == 0 {
+		group.accept()
+	} else {
+		group.dial()
+	}
+
+	return group
+}
+
+func (group *Group) accept() {
+	ln, err := net.Listen("tcp", group.cfg.Addr)
+	if err != nil {
+		panic(err)
+	}
+	defer ln.Close()
+
+	deadline := time.Now().Add(group.cfg.Timeout)
+	ln.(*net.TCPListener).SetDeadline(deadline)
+
+	fail := func(msg string) {
+		group.Close()
+		panic(msg)
+	}
+
+	for joined := 1; joined < group.cfg.World; joined++ {
+		c, err := ln.Accept()
+		if err != nil {
+			fail(fmt.Sprintf("собралось %d процессов из %d: %v", joined, group.cfg.World, err))
+		}
+
+		c.SetDeadline(deadline)
+		conn := newConn(c)
+
+		var hello [2]uint32
+		err = binary.Read(conn.r, binary.LittleEndian, &hello)
+		if err != nil {
+			c.Close()
+			fail(err.Error())
+		}
+
+		rank, world := int(hello[0]), int(hello[1])
+
+		var msg string
+		switch {
+		case world != group.cfg.World:
+			msg = fmt.Sprintf("процесс %d ожидает группу из %d, а не %d", rank, world, group.cfg.World)
+		case rank <= 0 || rank >= world:
+			msg = fmt.Sprintf("неверный номер процесса %d", rank)
+		case group.conns[rank] != nil:
+			msg = fmt.Sprintf("процесс %d подключился дважды", rank)
+		}
+
+		if msg != "" {
+			c.Close()
+			fail(msg)
+		}
+
+		c.SetDeadline(time.Time{})
+		group.conns[rank] = conn
+	}
+
+	group.bufs = make([][]float64, group.cfg.World)
+}
+
+func (group *Group) dial() {
+	deadline := time.Now().Add(group.cfg.Timeout)
+
+	var (
+		c   net.Conn
+		err error
+	)
+
+	for {
+		c, err = net.DialTimeout("tcp", group.cfg.Addr, time.Until(deadline))
+		if err == nil {
+			break
+		}
+
+		if time.Now().Add(retry).After(deadline) {
+			panic(fmt.Sprintf("процесс 0 недоступен по адресу %s: %v", group.cfg.Addr, err))
+		}
+		time.Sleep(retry)
+	}
+
+	conn := newConn(c)
+	hello := [2]uint32{uint32(group.cfg.Rank), uint32(group.cfg.World)}
+
+	err = binary.Write(conn.w, binary.LittleEndian, hello)
+	if err == nil {
+		err = conn.w.Flush()
+	}
+	if err != nil {
+		panic(err)
+	}
+
+	group.conns[0] = conn
+}
+
+func (group *Group) Rank() int {
+	return group.cfg.Rank
+}
+
+func (group *Group) World() int {
+	return group.cfg.World
+}
+
+/*
+AllReduce заменяет vec суммой векторов vec всех процессов группы.
+Все процессы должны вызывать AllReduce и Broadcast в одном порядке
+с векторами одной длины.
+*/
+func (group *Group) AllReduce(vec []float64) {
+	if group.cfg.World == 1 {
+		return
+	}
+
+	if group.cfg.Rank != 0 {
+		group.conns[0].send(vec)
+		group.conns[0].recv(vec)
+		return
+	}
+
+	group.each(func(rank int, conn *conn) {
+		if len(group.bufs[rank]) != len(vec) {
+			group.bufs[rank] = make([]float64, len(vec))
+		}
+		conn.recv(group.bufs[rank])
+	})
+
+	for _, buf := range group.bufs[1:] {
+		for index, val := range buf {
+			vec[index] += val
+		}
+	}
+
+	group.each(func(_ int, conn *conn) {
+		conn.send(vec)
+	})
+}
+
+// Broadcast заменяет vec вектором vec процесса 0.
+func (group *Group) Broadcast(vec []float64) {
+	if group.cfg.World == 1 {
+		return
+	}
+
+	if group.cfg.Rank != 0 {
+		group.conns[0].recv(vec)
+		return
+	}
+
+	group.each(func(_ int, conn *conn) {
+		conn.send(vec)
+	})
+}
+
+// each вызывает f для соединений процесса 0 со всеми процессами одновременно.
+func (group *Group) each(f func(rank int, conn *conn)) {
+	var wg sync.WaitGroup
+
+	for rank, conn := range group.conns {
+		if conn == nil {
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f(rank, conn)
+		}()
+	}
+
+	wg.Wait()
+}
+
+// Close закрывает соединения группы.
+func (group *Group) Close() {
+	for _, conn := range group.conns {
+		if conn != nil {
+			conn.Close()
+		}
+	}
+}
+
+func (conn *conn) send(vec []float64) {
+	err := binary.Write(conn.w, binary.LittleEndian, uint64(len(vec)))
+	if err == nil {
+		err = binary.Write(conn.w, binary.LittleEndian, vec)
+	}
+	if err == nil {
+		err = conn.w.Flush()
+	}
+	if err != nil {
+		panic(err)
+	}
+}
+
+func (conn *conn) recv(vec []float64) {
+	var n uint64
+
+	err := binary.Read(conn.r, binary.LittleEndian, &n)
+	if err != nil {
+		panic(err)
+	}
+
+	if n != uint64(len(vec)) {
+		panic(fmt.Sprintf("получен вектор длины %d вместо %d", n, len(vec)))
+	}
+
+	err = binary.Read(conn.r, binary.LittleEndian, vec)
+	if err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,136 @@
+package dist
+
+import (
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func freeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	return ln.Addr().String()
+}
+
+// join собирает группу из world процессов-горутин.
+func join(t *testing.T, world int) []*Group {
+	addr := freeAddr(t)
+	groups := make([]*Group, world)
+
+	var wg sync.WaitGroup
+	for rank := range world {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			groups[rank] = Join(Config{Rank: rank, World: world, Addr: addr, Timeout: 5 * time.Second})
+		}()
+	}
+	wg.Wait()
+
+	t.Cleanup(func() {
+		for _, group := range groups {
+			group.Close()
+		}
+	})
+
+	return groups
+}
+
+func Test_AllReduce(t *testing.T) {
+	for _, world := range []int{1, 2, 4} {
+		groups := join(t, world)
+
+		vecs := make([][]float64, world)
+		expected := make([]float64, 3)
+
+		for rank := range vecs {
+			vecs[rank] = []float64{float64(rank), 1, float64(rank * rank)}
+
+			for index, val := range vecs[rank] {
+				expected[index] += val
+			}
+		}
+
+		var wg sync.WaitGroup
+		for rank, group := range groups {
+			if group.Rank() != rank || group.World() != world {
+				t.Errorf("%d: unexpected rank %d of %d", world, group.Rank(), group.World())
+			}
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				// несколько вызовов подряд на одних соединениях
+				group.AllReduce(vecs[rank])
+				group.Broadcast(vecs[rank])
+			}()
+		}
+		wg.Wait()
+
+		for rank, vec := range vecs {
+			if !slices.Equal(vec, expected) {
+				t.Errorf("%d %d: expected %v, got %v", world, rank, expected, vec)
+			}
+		}
+
+		wg = sync.WaitGroup{}
+		for rank, group := range groups {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				vecs[rank] = []float64{float64(rank) + .5}
+				group.Broadcast(vecs[rank])
+			}()
+		}
+		wg.Wait()
+
+		for rank, vec := range vecs {
+			if vec[0] != .5 {
+				t.Errorf("%d %d: expected broadcast .5, got %v", world, rank, vec[0])
+			}
+		}
+	}
+}
+
+func Test_Join_Errors(t *testing.T) {
+	tests := []Config{
+		{Rank: 0, World: 0},
+		{Rank: 2, World: 2},
+		{Rank: -1, World: 2},
+		// процесс 0 не запущен
+		{Rank: 1, World: 2, Addr: "127.0.0.1:1", Timeout: 100 * time.Millisecond},
+	}
+
+	for i, cfg := range tests {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%d: expected panic", i)
+				}
+			}()
+
+			Join(cfg)
+		}()
+	}
+}
+
+func Test_FromEnv(t *testing.T) {
+	t.Setenv(EnvRank, "1")
+	t.Setenv(EnvWorld, "3")
+	t.Setenv(EnvAddr, "127.0.0.1:7000")
+
+	cfg := FromEnv()
+	expected := Config{Rank: 1, World: 3, Addr: "127.0.0.1:7000"}
+
+	if cfg != expected {
+		t.Errorf("expected %+v, got %+v", expected, cfg)
+	}
+}
@@ -0,0 +1,200 @@
+/*
+Package gradcheck сравнивает градиенты обратного прохода модулей
+с конечными разностями.
+
+Ошибкой модуля считается L = Σ output ⊙ G для фиксированной случайной
+матрицы G, поэтому градиент выхода равен G. Модули обновляют параметры
+в Backward сами, поэтому аналитический градиент параметра получается
+как разность значений до и после Backward со скоростью обучения 1,
+после чего параметры восстанавливаются.
+*/
+package gradcheck
+
+import (
+	"fmt"
+	"gonum.org/v1/gonum/mat"
+	"llm/pkg/lib"
+	"math"
+	"math/rand/v2"
+	"slices"
+)
+
+const (
+	// Eps - шаг конечных разностей.
+	Eps = 1e-6
+	// Tolerance - допустимая относительная ошибка по умолчанию.
+	Tolerance = 1e-4
+
+	// floor ограничивает знаменатель относительной ошибки для почти нулевых градиентов.
+	floor = 1e-5
+	/*
+		tiny и noise - граница почти нулевых градиентов и допустимая
+		абсолютная ошибка их конечных разностей: если оба градиента
+		меньше tiny по модулю и расходятся не больше чем на noise,
+		расхождение считается шумом разностей и ошибка равна 0.
+	*/
+	tiny  = 1e-5
+	noise = 1e-8
+)
+
+// Module - модуль с обратным проходом, возвращающим градиент по входу.
+type Module interface {
+	Forward(input *mat.Dense) *mat.Dense
+	Backward(output *mat.Dense, lr float64) *mat.Dense
+}
+
+/*
+Result - наихудший элемент градиента одной матрицы.
+Err = |Analytical-Numerical| / max(|Analytical|+|Numerical|, 1e-5),
+кроме почти нулевых градиентов, расходящихся не больше чем на 1e-8.
+*/
+type Result struct {
+	Name string
+	Row,
+	Col int
+	Analytical,
+	Numerical,
+	Err float64
+}
+
+func (res Result) String() string {
+	return fmt.Sprintf("%s[%d,%d]: аналитический %.6g, численный %.6g, ошибка %.2g",
+		res.Name, res.Row, res.Col, res.Analytical, res.Numerical, res.Err)
+}
+
+// Check проверяет модуль на входе input. Вход проверяется под именем "input".
+func Check(module Module, input *mat.Dense, params map[string]*mat.Dense) []Result {
+	return CheckFunc(
+		func() *mat.Dense { return module.Forward(input) },
+		module.Backward,
+		input, params)
+}
+
+/*
+CheckFunc проверяет модуль, заданный функциями прямого и обратного прохода.
+forward вычисляет выход по текущим input и params, backward применяет
+градиент выхода и возвращает градиент по input. Если input nil,
+проверяются только params. Результаты упорядочены по имени.
+*/
+func CheckFunc(
+	forward func() *mat.Dense,
+	backward func(output *mat.Dense, lr float64) *mat.Dense,
+	input *mat.Dense,
+	params map[string]*mat.Dense,
+) []Result {
+	output := forward()
+
+	rng := rand.New(rand.NewPCG(1, 2))
+	weights := mat.NewDense(lib.Rown(output), lib.Coln(output), nil)
+	weights.Apply(func(_, _ int, _ float64) float64 {
+		return rng.Float64()*2 - 1
+	}, weights)
+
+	loss := func() float64 {
+		var prod mat.Dense
+		prod.MulElem(forward(), weights)
+		return mat.Sum(&prod)
+	}
+
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	numerical := make(map[string]*mat.Dense, len(params)+1)
+	before := make(map[string]*mat.Dense, len(params))
+
+	for _, name := range names {
+		numerical[name] = differences(params[name], loss)
+		before[name] = mat.DenseCopyOf(params[name])
+	}
+
+	if input != nil {
+		numerical["input"] = differences(input, loss)
+	}
+
+	forward()
+	dinput := backward(mat.DenseCopyOf(weights), 1)
+
+	var results []Result
+
+	if input != nil {
+		results = append(results, compare("input", dinput, numerical["input"]))
+	}
+
+	for _, name := range names {
+		var grad mat.Dense
+		grad.Sub(before[name], params[name])
+		params[name].Copy(before[name])
+
+		results = append(results, compare(name, &grad, numerical[name]))
+	}
+
+	slices.SortFunc(results, func(a, b Result) int {
+		switch {
+		case a.Name < b.Name:
+			return -1
+		case a.Name > b.Name:
+			return 1
+		}
+		return 0
+	})
+
+	return results
+}
+
+// Failed возвращает результаты с ошибкой больше tol.
+func Failed(results []Result, tol float64) []Result {
+	var failed []Result
+
+	for _, res := range results {
+		if res.Err > tol {
+			failed = append(failed, res)
+		}
+	}
+
+	return failed
+}
+
+func differences(m *mat.Dense, loss func() float64) *mat.Dense {
+	r, c := m.Dims()
+	num := mat.NewDense(r, c, nil)
+
+	for row := range r {
+		for col := range c {
+			val := m.At(row, col)
+
+			m.Set(row, col, val+Eps)
+			plus := loss()
+			m.Set(row, col, val-Eps)
+			minus := loss()
+			m.Set(row, col, val)
+
+			num.Set(row, col, (plus-minus)/(2*Eps))
+		}
+	}
+
+	return num
+}
+
+func compare(name string, analytical, numerical *mat.Dense) Result {
+	res := Result{Name: name, Err: -1}
+
+	for row := range lib.Rown(numerical) {
+		for col := range lib.Coln(numerical) {
+			a, n := analytical.At(row, col), numerical.At(row, col)
+			err := math.Abs(a-n) / max(math.Abs(a)+math.Abs(n), floor)
+			if max(math.Abs(a), math.Abs(n)) < tiny && math.Abs(a-n) <= noise {
+				err = 0
+			}
+
+			if err > res.Err {
+				res.Row, res.Col = row, col
+				res.Analytical, res.Numerical, res.Err = a, n, err
+			}
+		}
+	}
+
+	return res
+}
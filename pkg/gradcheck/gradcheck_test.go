@@ -0,0 +1,107 @@
+package gradcheck
+
+import (
+	"gonum.org/v1/gonum/mat"
+	"llm/pkg/lib"
+	"testing"
+)
+
+type linear struct {
+	weights,
+	input *mat.Dense
+	// broken портит градиент по весам.
+	broken bool
+}
+
+func (lin *linear) Forward(input *mat.Dense) *mat.Dense {
+	var output mat.Dense
+	output.Mul(input, lin.weights)
+	lin.input = input
+	return &output
+}
+
+func (lin *linear) Backward(output *mat.Dense, lr float64) *mat.Dense {
+	var input, weights mat.Dense
+	input.Mul(output, lin.weights.T())
+	weights.Mul(lin.input.T(), output)
+
+	if lin.broken {
+		weights.Scale(2, &weights)
+	}
+
+	lib.Step(lin.weights, &weights, lr)
+	return &input
+}
+
+func Test_Check(t *testing.T) {
+	tests := []struct {
+		broken bool
+		failed []string
+	}{
+		{},
+		{broken: true, failed: []string{"weights"}},
+	}
+
+	for i, test := range tests {
+		lin := &linear{
+			weights: mat.NewDense(3, 2, []float64{
+				.1, -.2,
+				.3, .4,
+				-.5, .6,
+			}),
+			broken: test.broken,
+		}
+		weights := mat.DenseCopyOf(lin.weights)
+
+		input := mat.NewDense(2, 3, []float64{
+			1, 2, 3,
+			-1, .5, 0,
+		})
+
+		results := Check(lin, input, map[string]*mat.Dense{"weights": lin.weights})
+
+		if len(results) != 2 || results[0].Name != "input" || results[1].Name != "weights" {
+			t.Fatalf("%d: unexpected results %v", i, results)
+		}
+
+		failed := Failed(results, Tolerance)
+		if len(failed) != len(test.failed) {
+			t.Errorf("%d: expected %v to fail, got %v", i, test.failed, failed)
+		}
+
+		for index, res := range failed {
+			if res.Name != test.failed[index] {
+				t.Errorf("%d: expected %s to fail, got %s", i, test.failed[index], res.Name)
+			}
+		}
+
+		if !mat.Equal(weights, lin.weights) {
+			t.Errorf("%d: weights not restored", i)
+		}
+	}
+}
+
+func Test_Compare(t *testing.T) {
+	tests := []struct {
+		analytical,
+		numerical float64
+		failed bool
+	}{
+		{analytical: 1, numerical: 1.00001},
+		{analytical: 1, numerical: 1.001, failed: true},
+		// шум конечных разностей на почти нулевом градиенте
+		{analytical: -1.23129e-06, numerical: -1.23013e-06},
+		{analytical: 1e-6, numerical: 5e-6, failed: true},
+		{analytical: 0, numerical: 5e-6, failed: true},
+	}
+
+	for i, test := range tests {
+		res := compare("m",
+			mat.NewDense(1, 1, []float64{test.analytical}),
+			mat.NewDense(1, 1, []float64{test.numerical}))
+
+		if failed := res.Err > Tolerance; failed != test.failed {
+			t.Errorf("%d: expected failed %v, got %v", i, test.failed, res)
+		}
+	}
+}
@@ -1,11 +1,14 @@
 package lib
 
 import (
+	"gonum.org/v1/gonum/blas/blas64"
 	"gonum.org/v1/gonum/floats"
 	"gonum.org/v1/gonum/mat"
-	"gonum.org/v1/gonum/stat/distuv"
+	"llm/pkg/backend"
 	"math"
-	"math/rand"
+	"math/rand/v2"
+	"runtime"
+	"sync"
 )
 
 const (
@@ -24,73 +27,309 @@ func Coln(m *mat.Dense) int {
 }
 
 func Relu(trg, src *mat.Dense) {
-	trg.Apply(func(_, _ int, val float64) float64 {
-		if val >= 0 {
-			return val
-		}
-		return val * Alpha
-	}, src)
+	apply(trg, src, relu)
 }
 
 func ReluDeriv(trg, src *mat.Dense) {
-	trg.Apply(func(_, _ int, val float64) float64 {
-		if val >= 0 {
-			return 1
-		}
-		return Alpha
-	}, src)
+	apply(trg, src, reluDeriv)
+}
+
+// PlainRelu - Relu без наклона для отрицательных значений.
+func PlainRelu(trg, src *mat.Dense) {
+	apply(trg, src, plainRelu)
+}
+
+func PlainReluDeriv(trg, src *mat.Dense) {
+	apply(trg, src, plainReluDeriv)
+}
+
+// Gelu - x·Φ(x), где Φ - функция нормального распределения.
+func Gelu(trg, src *mat.Dense) {
+	apply(trg, src, gelu)
+}
+
+func GeluDeriv(trg, src *mat.Dense) {
+	apply(trg, src, geluDeriv)
+}
+
+// Silu - x·σ(x), где σ - сигмоида.
+func Silu(trg, src *mat.Dense) {
+	apply(trg, src, silu)
+}
+
+func SiluDeriv(trg, src *mat.Dense) {
+	apply(trg, src, siluDeriv)
+}
+
+/*
+apply записывает в trg значения f элементов src текущей реализацией
+backend. В отличие от Apply не выделяет память, если trg не пуста.
+*/
+func apply(trg, src *mat.Dense, f func(float64) float64) {
+	backend.Current().Apply(trg, src, f)
+}
+
+func relu(val float64) float64 {
+	if val >= 0 {
+		return val
+	}
+	return val * Alpha
+}
+
+func reluDeriv(val float64) float64 {
+	if val >= 0 {
+		return 1
+	}
+	return Alpha
+}
+
+func plainRelu(val float64) float64 {
+	return max(val, 0)
+}
+
+func plainReluDeriv(val float64) float64 {
+	if val >= 0 {
+		return 1
+	}
+	return 0
+}
+
+func gelu(val float64) float64 {
+	return val * normCDF(val)
+}
+
+func geluDeriv(val float64) float64 {
+	return normCDF(val) + val*math.Exp(-val*val/2)/math.Sqrt(2*math.Pi)
+}
+
+func normCDF(val float64) float64 {
+	return (1 + math.Erf(val/math.Sqrt2)) / 2
+}
+
+func silu(val float64) float64 {
+	return val * sigmoid(val)
+}
+
+func siluDeriv(val float64) float64 {
+	sig := sigmoid(val)
+	return sig * (1 + val*(1-sig))
+}
+
+func sigmoid(val float64) float64 {
+	return 1 / (1 + math.Exp(-val))
+}
+
+// Act - функция активации. Нулевое значение - Relu с наклоном Alpha.
+type Act int
+
+const (
+	ActLeakyRelu Act = iota
+	ActRelu
+	ActGelu
+	ActSilu
+)
+
+func (act Act) Apply(trg, src *mat.Dense) {
+	switch act {
+	case ActLeakyRelu:
+		Relu(trg, src)
+	case ActRelu:
+		PlainRelu(trg, src)
+	case ActGelu:
+		Gelu(trg, src)
+	case ActSilu:
+		Silu(trg, src)
+	default:
+		panic("неизвестная функция активации")
+	}
+}
+
+func (act Act) Deriv(trg, src *mat.Dense) {
+	switch act {
+	case ActLeakyRelu:
+		ReluDeriv(trg, src)
+	case ActRelu:
+		PlainReluDeriv(trg, src)
+	case ActGelu:
+		GeluDeriv(trg, src)
+	case ActSilu:
+		SiluDeriv(trg, src)
+	default:
+		panic("неизвестная функция активации")
+	}
 }
 
 func Mask(trg, src *mat.Dense) {
-	trg.Apply(func(i, j int, val float64) float64 {
-		if j > i {
-			return math.Inf(-1)
+	DocMask(trg, src, nil)
+}
+
+/*
+DocMask помимо причинной маски запрещает внимание между позициями
+разных документов. docs содержит номер документа для каждой позиции,
+nil означает, что все позиции принадлежат одному документу.
+*/
+func DocMask(trg, src *mat.Dense, docs []int) {
+	rown, coln := src.Dims()
+	if trg.IsEmpty() {
+		trg.ReuseAs(rown, coln)
+	}
+
+	for i := range rown {
+		trgRow, srcRow := trg.RawRowView(i), src.RawRowView(i)
+
+		for j, val := range srcRow {
+			if j > i || (docs != nil && docs[i] != docs[j]) {
+				val = math.Inf(-1)
+			}
+			trgRow[j] = val
 		}
-		return val
-	}, src)
+	}
 }
 
-func Softmax(trg, src *mat.Dense) {
-	sums := make([]float64, Rown(src))
-	var maxs []float64
+/*
+CausalMask запрещает строке i внимание к позициям после offset+i.
+Используется, когда строки src продолжают offset уже обработанных позиций.
+*/
+func CausalMask(trg, src *mat.Dense, offset int) {
+	rown, coln := src.Dims()
+	if trg.IsEmpty() {
+		trg.ReuseAs(rown, coln)
+	}
 
-	trg.Apply(func(i, _ int, val float64) float64 {
-		if len(maxs) <= i {
-			maxs = append(maxs, floats.Max(src.RawRowView(i)))
+	for i := range rown {
+		trgRow, srcRow := trg.RawRowView(i), src.RawRowView(i)
+
+		for j, val := range srcRow {
+			if j > offset+i {
+				val = math.Inf(-1)
+			}
+			trgRow[j] = val
 		}
+	}
+}
 
-		exp := math.Exp(val - maxs[i])
+func Softmax(trg, src *mat.Dense) {
+	backend.Current().Softmax(trg, src)
+}
 
-		sums[i] += exp
+// Mul записывает в trg произведение a·b текущей реализацией backend.
+func Mul(trg, a, b *mat.Dense) {
+	backend.Current().Mul(trg, a, b, false, false)
+}
 
-		return exp
-	}, src)
+/*
+MulT записывает в trg произведение a·bᵀ. В отличие от Mul(trg, a, b.T())
+не выделяет память под транспонированное представление.
+*/
+func MulT(trg, a, b *mat.Dense) {
+	backend.Current().Mul(trg, a, b, false, true)
+}
 
-	trg.Apply(func(i, _ int, val float64) float64 {
-		return val / sums[i]
-	}, trg)
+// TMul записывает в trg произведение aᵀ·b, см. MulT.
+func TMul(trg, a, b *mat.Dense) {
+	backend.Current().Mul(trg, a, b, true, false)
+}
+
+func Add(trg, a, b *mat.Dense) {
+	backend.Current().Add(trg, a, b)
+}
+
+func MulElem(trg, a, b *mat.Dense) {
+	backend.Current().MulElem(trg, a, b)
+}
+
+/*
+Scale записывает в trg произведение f·a. В отличие от trg.Scale(f, trg)
+не выделяет промежуточную матрицу, если trg совпадает с a.
+*/
+func Scale(trg *mat.Dense, f float64, a *mat.Dense) {
+	backend.Current().Scale(trg, f, a)
 }
 
 func Step(trg, grad *mat.Dense, lr float64) {
-	var scale mat.Dense
-	scale.Scale(lr, grad)
-	trg.Sub(trg, &scale)
+	if lr == 0 {
+		return
+	}
+
+	backend.Current().AddScaled(trg, -lr, grad)
 }
 
-func RowSums(src *mat.Dense) []float64 {
-	sums := make([]float64, Rown(src))
+/*
+Param - настройки обновления матрицы. Mult умножает скорость обучения,
+Decay - коэффициент затухания весов, Frozen запрещает обновление.
+Если задан Grad, матрица не обновляется, а к Grad прибавляется grad·lr,
+остальные настройки при этом не учитываются.
+*/
+type Param struct {
+	Mult,
+	Decay float64
+	Frozen bool
+	Grad   *mat.Dense
+}
 
-	for row := range Rown(src) {
-		sums[row] = floats.Sum(src.RawRowView(row))
+/*
+Params - настройки обновления по матрицам. Матрицы без настроек
+обновляются обычным Step, поэтому nil Params тоже допустим.
+*/
+type Params map[*mat.Dense]Param
+
+func (params Params) Step(trg, grad *mat.Dense, lr float64) {
+	param, ok := params[trg]
+	if !ok {
+		Step(trg, grad, lr)
+		return
+	}
+
+	if param.Grad != nil {
+		Step(param.Grad, grad, -lr)
+		return
+	}
+
+	if param.Frozen {
+		return
 	}
 
+	lr *= param.Mult
+
+	if param.Decay != 0 && lr != 0 {
+		Scale(trg, 1-lr*param.Decay, trg)
+	}
+
+	Step(trg, grad, lr)
+}
+
+func RowSums(src *mat.Dense) []float64 {
+	sums := make([]float64, Rown(src))
+	backend.Current().RowSums(sums, src)
+	return sums
+}
+
+func ColSums(src *mat.Dense) []float64 {
+	sums := make([]float64, Coln(src))
+	backend.Current().ColSums(sums, src)
 	return sums
 }
 
+// AddRow прибавляет vec к каждой строке trg.
+func AddRow(trg *mat.Dense, vec []float64) {
+	for row := range Rown(trg) {
+		floats.Add(trg.RawRowView(row), vec)
+	}
+}
+
 func SubVec(trg, src *mat.Dense, vec []float64) {
-	trg.Apply(func(i, _ int, val float64) float64 {
-		return val - vec[i]
-	}, src)
+	rown, coln := src.Dims()
+	if trg.IsEmpty() {
+		trg.ReuseAs(rown, coln)
+	}
+
+	for row := range rown {
+		trgRow := trg.RawRowView(row)
+
+		for col, val := range src.RawRowView(row) {
+			trgRow[col] = val - vec[row]
+		}
+	}
 }
 
 func Concat(trg, src *mat.Dense) {
@@ -113,6 +352,179 @@ func Concat(trg, src *mat.Dense) {
 	*trg = *newtrg
 }
 
+/*
+Arena выдает матрицы, память которых используется повторно: после Reset
+матрицы выдаются заново в том же порядке, и если их размеры не больше
+прежних, память не выделяется. Поэтому повторяющийся шаг обучения
+после первого раза почти не выделяет память. Матрица действительна
+до следующего Reset. Нулевое значение готово к использованию,
+nil Arena выделяет каждую матрицу заново.
+*/
+type Arena struct {
+	mats,
+	views []*mat.Dense
+	next,
+	nextView int
+}
+
+// Get возвращает нулевую матрицу r×c.
+func (arena *Arena) Get(r, c int) *mat.Dense {
+	if arena == nil {
+		return mat.NewDense(r, c, nil)
+	}
+
+	if arena.next == len(arena.mats) {
+		arena.mats = append(arena.mats, new(mat.Dense))
+	}
+
+	m := arena.mats[arena.next]
+	arena.next++
+
+	if rown, coln := m.Dims(); rown == r && coln == c {
+		m.Zero()
+		return m
+	}
+
+	// память прошлой матрицы другой формы используется, если ее хватает
+	if data := m.RawMatrix().Data; cap(data) >= r*c {
+		m.SetRawMatrix(blas64.General{Rows: r, Cols: c, Stride: c, Data: data[:r*c]})
+		m.Zero()
+		return m
+	}
+
+	m.Reset()
+	m.ReuseAs(r, c)
+
+	return m
+}
+
+/*
+Rows аналогичен функции Rows, но заголовок части берется из arena,
+поэтому повторные вызовы не выделяют память.
+*/
+func (arena *Arena) Rows(m *mat.Dense, start, end int) *mat.Dense {
+	if arena == nil || (start == 0 && end == Rown(m)) {
+		return Rows(m, start, end)
+	}
+
+	if arena.nextView == len(arena.views) {
+		arena.views = append(arena.views, new(mat.Dense))
+	}
+
+	view := arena.views[arena.nextView]
+	arena.nextView++
+
+	raw := m.RawMatrix()
+	raw.Data = raw.Data[start*raw.Stride : (end-1)*raw.Stride+raw.Cols]
+	raw.Rows = end - start
+	view.SetRawMatrix(raw)
+
+	return view
+}
+
+// Cols аналогичен Arena.Rows для столбцов [start, end) m.
+func (arena *Arena) Cols(m *mat.Dense, start, end int) *mat.Dense {
+	if arena == nil || (start == 0 && end == Coln(m)) {
+		return m.Slice(0, Rown(m), start, end).(*mat.Dense)
+	}
+
+	if arena.nextView == len(arena.views) {
+		arena.views = append(arena.views, new(mat.Dense))
+	}
+
+	view := arena.views[arena.nextView]
+	arena.nextView++
+
+	raw := m.RawMatrix()
+	raw.Data = raw.Data[start : (raw.Rows-1)*raw.Stride+end]
+	raw.Cols = end - start
+	view.SetRawMatrix(raw)
+
+	return view
+}
+
+/*
+Parallel вызывает fn(0), ..., fn(n-1) в отдельных горутинах и ждет
+их завершения. При GOMAXPROCS = 1 вызовы выполняются по порядку
+в текущей горутине, не создавая новых.
+*/
+func Parallel(n int, fn func(int)) {
+	if n == 1 || runtime.GOMAXPROCS(0) == 1 {
+		for index := range n {
+			fn(index)
+		}
+		return
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for index := range n {
+		go func() {
+			defer wg.Done()
+			fn(index)
+		}()
+	}
+	wg.Wait()
+}
+
+// Reset возвращает все выданные матрицы для повторного использования.
+func (arena *Arena) Reset() {
+	if arena != nil {
+		arena.next, arena.nextView = 0, 0
+	}
+}
+
+// Rows возвращает строки [start, end) m без копирования.
+func Rows(m *mat.Dense, start, end int) *mat.Dense {
+	if start == 0 && end == Rown(m) {
+		return m
+	}
+	return m.Slice(start, end, 0, Coln(m)).(*mat.Dense)
+}
+
+/*
+Spans возвращает границы [начало, конец) частей длины lens, идущих подряд.
+nil lens означает одну часть из rown строк.
+*/
+func Spans(lens []int, rown int) [][2]int {
+	return AppendSpans(nil, lens, rown)
+}
+
+// AppendSpans аналогичен Spans, но дописывает границы к dst.
+func AppendSpans(dst [][2]int, lens []int, rown int) [][2]int {
+	if lens == nil {
+		return append(dst, [2]int{0, rown})
+	}
+
+	var start int
+	for _, n := range lens {
+		dst = append(dst, [2]int{start, start + n})
+		start += n
+	}
+
+	if start != rown {
+		panic("сумма длин частей не равна числу строк")
+	}
+
+	return dst
+}
+
+/*
+GatherAdd прибавляет к строке i trg строку rows[i] src.
+ScatterAdd прибавляет строку i src к строке rows[i] trg.
+*/
+func GatherAdd(trg, src *mat.Dense, rows []int) {
+	for index, row := range rows {
+		floats.Add(trg.RawRowView(index), src.RawRowView(row))
+	}
+}
+
+func ScatterAdd(trg, src *mat.Dense, rows []int) {
+	for index, row := range rows {
+		floats.Add(trg.RawRowView(row), src.RawRowView(index))
+	}
+}
+
 func Split(src *mat.Dense, n int) []*mat.Dense {
 	if src.IsEmpty() {
 		return nil
@@ -135,54 +547,124 @@ func Split(src *mat.Dense, n int) []*mat.Dense {
 	return mats
 }
 
-func DropoutMask(r, c int, p float64) *mat.Dense {
-	if p < 0 {
-		p = 0
+/*
+RNG - источник случайных чисел, состояние которого сохраняется в gob
+вместе с моделью, поэтому обучение можно воспроизвести и продолжить.
+Методы допускают nil получателя, тогда используется глобальный источник,
+и могут вызываться одновременно из нескольких горутин.
+*/
+type RNG struct {
+	mut  sync.Mutex
+	pcg  *rand.PCG
+	rand *rand.Rand
+}
+
+func NewRNG(seed uint64) *RNG {
+	pcg := rand.NewPCG(seed, 0)
+	return &RNG{pcg: pcg, rand: rand.New(pcg)}
+}
+
+func (rng *RNG) Float64() float64 {
+	if rng == nil {
+		return rand.Float64()
 	}
 
-	if p > 1 {
-		p = 1
+	rng.mut.Lock()
+	defer rng.mut.Unlock()
+
+	return rng.rand.Float64()
+}
+
+func (rng *RNG) NormFloat64() float64 {
+	if rng == nil {
+		return rand.NormFloat64()
 	}
 
-	mask := mat.NewDense(r, c, nil)
+	rng.mut.Lock()
+	defer rng.mut.Unlock()
 
-	mask.Apply(func(_, _ int, _ float64) float64 {
-		if rand.Float64() < p {
-			return 0
-		}
-		return 1. / (1. - p)
-	}, mask)
+	return rng.rand.NormFloat64()
+}
+
+func (rng *RNG) Uint64() uint64 {
+	if rng == nil {
+		return rand.Uint64()
+	}
+
+	rng.mut.Lock()
+	defer rng.mut.Unlock()
+
+	return rng.rand.Uint64()
+}
+
+func (rng *RNG) MarshalBinary() ([]byte, error) {
+	rng.mut.Lock()
+	defer rng.mut.Unlock()
+
+	return rng.pcg.MarshalBinary()
+}
+
+func (rng *RNG) UnmarshalBinary(data []byte) error {
+	rng.pcg = new(rand.PCG)
+	rng.rand = rand.New(rng.pcg)
+	return rng.pcg.UnmarshalBinary(data)
+}
+
+/*
+DropoutMask возвращает маску, обнуляющую элементы с вероятностью p.
+При p 0 rng не используется.
+*/
+func DropoutMask(rng *RNG, r, c int, p float64) *mat.Dense {
+	mask := mat.NewDense(r, c, nil)
+	SetDropoutMask(rng, mask, p)
 
 	return mask
 }
 
+// SetDropoutMask заполняет mask так же, как DropoutMask.
+func SetDropoutMask(rng *RNG, mask *mat.Dense, p float64) {
+	p = min(max(p, 0), 1)
+
+	for row := range Rown(mask) {
+		vals := mask.RawRowView(row)
+
+		for col := range vals {
+			switch {
+			case p == 0:
+				vals[col] = 1
+			case rng.Float64() < p:
+				vals[col] = 0
+			default:
+				vals[col] = 1. / (1. - p)
+			}
+		}
+	}
+}
+
 func ParamN(src *mat.Dense) int {
 	rown, coln := src.Dims()
 	return rown * coln
 }
 
-func Xavier(r, c int) *mat.Dense {
+func Xavier(rng *RNG, r, c int) *mat.Dense {
 	data := make([]float64, r*c)
 
 	limit := math.Sqrt(6) /
 		math.Sqrt(float64(r)+float64(c))
 
-	dist := distuv.Uniform{Min: -limit, Max: limit}
 	for index := range data {
-		data[index] = dist.Rand()
+		data[index] = (2*rng.Float64() - 1) * limit
 	}
 
 	return mat.NewDense(r, c, data)
 }
 
-func He(r, c int) *mat.Dense {
+func He(rng *RNG, r, c int) *mat.Dense {
 	data := make([]float64, r*c)
 
-	dist := distuv.Normal{
-		Sigma: math.Sqrt(2. / float64(r)),
-	}
+	sigma := math.Sqrt(2. / float64(r))
 	for index := range data {
-		data[index] = dist.Rand()
+		data[index] = rng.NormFloat64() * sigma
 	}
 
 	return mat.NewDense(r, c, data)
@@ -205,6 +687,128 @@ func CrossEntropy(pred, ans *mat.Dense) float64 {
 	return -(sum / float64(Rown(ans)))
 }
 
+/*
+LogSoftmax записывает в trg логарифм softmax строк src.
+Вычисляется через максимум строки, поэтому не теряет точность
+при сильно уверенных предсказаниях.
+*/
+func LogSoftmax(trg, src *mat.Dense) {
+	lses := make([]float64, Rown(src))
+	for row := range Rown(src) {
+		lses[row] = logSumExp(src.RawRowView(row))
+	}
+
+	trg.Apply(func(i, _ int, val float64) float64 {
+		return val - lses[i]
+	}, src)
+}
+
+func logSumExp(vec []float64) float64 {
+	m := floats.Max(vec)
+
+	var sum float64
+	for _, val := range vec {
+		sum += math.Exp(val - m)
+	}
+
+	return m + math.Log(sum)
+}
+
+/*
+SoftmaxCrossEntropy возвращает среднюю по строкам перекрестную энтропию
+softmax логитов logits и распределения ans и заменяет logits градиентом
+ошибки по логитам. Строки ans из нулей не учитываются, их градиент нулевой.
+Для обучения используется SparseCrossEntropy, эта форма нужна для проверки.
+
+smoothing смешивает ans с равномерным распределением: (1-s)·ans + s/n.
+zloss добавляет к ошибке строки zloss·log²Z, где Z - сумма экспонент
+логитов, что удерживает логиты около нуля.
+*/
+func SoftmaxCrossEntropy(logits, ans *mat.Dense, smoothing, zloss float64) float64 {
+	var (
+		sum float64
+		n   int
+	)
+
+	for row := range Rown(logits) {
+		arow := ans.RawRowView(row)
+
+		total := floats.Sum(arow)
+		if total == 0 {
+			clear(logits.RawRowView(row))
+			continue
+		}
+		n++
+
+		sum += crossEntropyRow(logits.RawRowView(row), smoothing, zloss, func(col int) float64 {
+			return arow[col] / total
+		})
+	}
+
+	if n == 0 {
+		return 0
+	}
+
+	return sum / float64(n)
+}
+
+/*
+SparseCrossEntropy аналогичен SoftmaxCrossEntropy, но правильный ответ
+строки row задан индексом targets[row]. Строки с отрицательным индексом
+не учитываются.
+*/
+func SparseCrossEntropy(logits *mat.Dense, targets []int, smoothing, zloss float64) float64 {
+	var (
+		sum float64
+		n   int
+	)
+
+	for row, target := range targets {
+		if target < 0 {
+			clear(logits.RawRowView(row))
+			continue
+		}
+		n++
+
+		sum += crossEntropyRow(logits.RawRowView(row), smoothing, zloss, func(col int) float64 {
+			if col == target {
+				return 1
+			}
+			return 0
+		})
+	}
+
+	if n == 0 {
+		return 0
+	}
+
+	return sum / float64(n)
+}
+
+/*
+crossEntropyRow возвращает ошибку строки логитов lrow относительно
+распределения ans и заменяет lrow градиентом.
+*/
+func crossEntropyRow(lrow []float64, smoothing, zloss float64, ans func(int) float64) float64 {
+	var sum float64
+
+	uniform := smoothing / float64(len(lrow))
+	lse := logSumExp(lrow)
+
+	for col, val := range lrow {
+		target := (1-smoothing)*ans(col) + uniform
+		logp := val - lse
+
+		if target != 0 {
+			sum -= target * logp
+		}
+
+		lrow[col] = math.Exp(logp)*(1+2*zloss*lse) - target
+	}
+
+	return sum + zloss*lse*lse
+}
+
 func HotEnc(inds []int, l int) *mat.Dense {
 	m := mat.NewDense(len(inds), l, nil)
 
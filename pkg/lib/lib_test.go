@@ -4,6 +4,7 @@ import (
 	"gonum.org/v1/gonum/floats"
 	"gonum.org/v1/gonum/mat"
 	"math"
+	"slices"
 	"testing"
 )
 
@@ -99,6 +100,98 @@ func Test_ReluDeriv(t *testing.T) {
 	}
 }
 
+func Test_Act(t *testing.T) {
+	const eps = 1e-6
+
+	tests := []struct {
+		act    Act
+		src    *mat.Dense
+		output *mat.Dense
+	}{
+		{
+			act:    ActLeakyRelu,
+			src:    mat.NewDense(1, 3, []float64{-1, .1, 3.2}),
+			output: mat.NewDense(1, 3, []float64{-1 * Alpha, .1, 3.2}),
+		},
+		{
+			act:    ActRelu,
+			src:    mat.NewDense(1, 3, []float64{-1, .1, 3.2}),
+			output: mat.NewDense(1, 3, []float64{0, .1, 3.2}),
+		},
+		{
+			act:    ActGelu,
+			src:    mat.NewDense(1, 3, []float64{-1, .1, 3.2}),
+			output: mat.NewDense(1, 3, []float64{-.158655, .053983, 3.197801}),
+		},
+		{
+			act:    ActSilu,
+			src:    mat.NewDense(1, 3, []float64{-1, .1, 3.2}),
+			output: mat.NewDense(1, 3, []float64{-.268941, .052498, 3.074670}),
+		},
+	}
+
+	for i, test := range tests {
+		var trg mat.Dense
+		test.act.Apply(&trg, test.src)
+
+		if !mat.EqualApprox(&trg, test.output, 1e-6) {
+			t.Errorf("%d: expected %v, got %v", i, test.output, &trg)
+		}
+
+		var deriv, plus, minus mat.Dense
+		test.act.Deriv(&deriv, test.src)
+
+		shift := func(trg *mat.Dense, delta float64) {
+			var src mat.Dense
+			src.Apply(func(_, _ int, val float64) float64 {
+				return val + delta
+			}, test.src)
+			test.act.Apply(trg, &src)
+		}
+		shift(&plus, eps)
+		shift(&minus, -eps)
+
+		var num mat.Dense
+		num.Sub(&plus, &minus)
+		num.Scale(1/(2*eps), &num)
+
+		if !mat.EqualApprox(&deriv, &num, 1e-6) {
+			t.Errorf("%d: deriv: expected %v, got %v", i, &num, &deriv)
+		}
+	}
+}
+
+func Test_RNG(t *testing.T) {
+	rng := NewRNG(7)
+	rng.Float64()
+
+	data, err := rng.MarshalBinary()
+	if err != nil {
+		panic(err)
+	}
+
+	var restored RNG
+	err = restored.UnmarshalBinary(data)
+	if err != nil {
+		panic(err)
+	}
+
+	for i := range 3 {
+		expected, got := rng.Float64(), restored.Float64()
+		if expected != got {
+			t.Errorf("%d: expected %v, got %v", i, expected, got)
+		}
+	}
+
+	if !mat.Equal(Xavier(NewRNG(3), 2, 3), Xavier(NewRNG(3), 2, 3)) {
+		t.Errorf("same seed gave different matrices")
+	}
+
+	if mat.Equal(He(NewRNG(3), 2, 3), He(NewRNG(4), 2, 3)) {
+		t.Errorf("different seeds gave equal matrices")
+	}
+}
+
 func Test_Mask(t *testing.T) {
 	tests := []struct {
 		src    *mat.Dense
@@ -128,6 +221,47 @@ func Test_Mask(t *testing.T) {
 	}
 }
 
+func Test_DocMask(t *testing.T) {
+	tests := []struct {
+		src    *mat.Dense
+		docs   []int
+		output *mat.Dense
+	}{
+		{
+			src: mat.NewDense(3, 3, []float64{
+				-1, .1, 3.2,
+				-.1, .5, 0,
+				.8, .3, -2,
+			}),
+			docs: []int{0, 0, 1},
+			output: mat.NewDense(3, 3, []float64{
+				-1, math.Inf(-1), math.Inf(-1),
+				-.1, .5, math.Inf(-1),
+				math.Inf(-1), math.Inf(-1), -2,
+			}),
+		},
+		{
+			src: mat.NewDense(2, 2, []float64{
+				-1, .1,
+				-.1, .5,
+			}),
+			output: mat.NewDense(2, 2, []float64{
+				-1, math.Inf(-1),
+				-.1, .5,
+			}),
+		},
+	}
+
+	for i, test := range tests {
+		var trg mat.Dense
+		DocMask(&trg, test.src, test.docs)
+
+		if !mat.Equal(&trg, test.output) {
+			t.Errorf("%d: expected %v, got %v", i, test.output, trg)
+		}
+	}
+}
+
 func Test_Softmax(t *testing.T) {
 	tests := []struct {
 		src    *mat.Dense
@@ -199,6 +333,67 @@ func Test_Step(t *testing.T) {
 	}
 }
 
+func Test_Params_Step(t *testing.T) {
+	frozen := mat.NewDense(1, 2, []float64{1, 2})
+	scaled := mat.NewDense(1, 2, []float64{1, 2})
+	decayed := mat.NewDense(1, 2, []float64{1, 2})
+	plain := mat.NewDense(1, 2, []float64{1, 2})
+	collected := mat.NewDense(1, 2, []float64{1, 2})
+	grad := mat.NewDense(1, 2, []float64{.5, 0})
+
+	params := Params{
+		frozen:    {Mult: 1, Frozen: true},
+		scaled:    {Mult: .5},
+		decayed:   {Mult: 1, Decay: .1},
+		collected: {Mult: 2, Decay: .1, Grad: grad},
+	}
+
+	tests := []struct {
+		trg,
+		output *mat.Dense
+	}{
+		{
+			trg:    frozen,
+			output: mat.NewDense(1, 2, []float64{1, 2}),
+		},
+		{
+			trg:    scaled,
+			output: mat.NewDense(1, 2, []float64{.5, 1.5}),
+		},
+		{
+			trg:    decayed,
+			output: mat.NewDense(1, 2, []float64{1 - .1 - 1, 2 - .2 - 1}),
+		},
+		{
+			trg:    plain,
+			output: mat.NewDense(1, 2, []float64{0, 1}),
+		},
+		{
+			trg:    collected,
+			output: mat.NewDense(1, 2, []float64{1, 2}),
+		},
+	}
+
+	for i, test := range tests {
+		params.Step(test.trg, mat.NewDense(1, 2, []float64{1, 1}), 1)
+
+		if !mat.EqualApprox(test.trg, test.output, 1e-12) {
+			t.Errorf("%d: expected %v, got %v", i, test.output, test.trg)
+		}
+	}
+
+	if !mat.Equal(grad, mat.NewDense(1, 2, []float64{1.5, 1})) {
+		t.Errorf("collected grad: got %v", grad)
+	}
+
+	var none Params
+	none.Step(plain, mat.NewDense(1, 2, []float64{1, 1}), 1)
+
+	if !mat.Equal(plain, mat.NewDense(1, 2, []float64{-1, 0})) {
+		t.Errorf("nil params: got %v", plain)
+	}
+}
+
 func Test_RowSums(t *testing.T) {
 	tests := []struct {
 		src    *mat.Dense
@@ -222,6 +417,57 @@ func Test_RowSums(t *testing.T) {
 	}
 }
 
+func Test_ColSums(t *testing.T) {
+	tests := []struct {
+		src    *mat.Dense
+		output []float64
+	}{
+		{
+			src: mat.NewDense(2, 3, []float64{
+				-1, .1, 3.2,
+				-.1, .5, 0,
+			}),
+			output: []float64{-1.1, .6, 3.2},
+		},
+	}
+
+	for i, test := range tests {
+		output := ColSums(test.src)
+
+		if !floats.EqualApprox(output, test.output, 1e-12) {
+			t.Errorf("%d: expected %v, got %v", i, test.output, output)
+		}
+	}
+}
+
+func Test_AddRow(t *testing.T) {
+	tests := []struct {
+		trg    *mat.Dense
+		vec    []float64
+		output *mat.Dense
+	}{
+		{
+			trg: mat.NewDense(2, 3, []float64{
+				-1, .1, 3.2,
+				-.1, .5, 0,
+			}),
+			vec: []float64{1, 2, 3},
+			output: mat.NewDense(2, 3, []float64{
+				0, 2.1, 6.2,
+				.9, 2.5, 3,
+			}),
+		},
+	}
+
+	for i, test := range tests {
+		AddRow(test.trg, test.vec)
+
+		if !mat.EqualApprox(test.trg, test.output, 1e-12) {
+			t.Errorf("%d: expected %v, got %v", i, test.output, test.trg)
+		}
+	}
+}
+
 func Test_SubVec(t *testing.T) {
 	tests := []struct {
 		src,
@@ -304,6 +550,146 @@ func Test_Concat(t *testing.T) {
 	}
 }
 
+func Test_Spans(t *testing.T) {
+	tests := []struct {
+		lens   []int
+		rown   int
+		output [][2]int
+	}{
+		{lens: nil, rown: 3, output: [][2]int{{0, 3}}},
+		{lens: []int{2, 1, 3}, rown: 6, output: [][2]int{{0, 2}, {2, 3}, {3, 6}}},
+	}
+
+	for i, test := range tests {
+		output := Spans(test.lens, test.rown)
+
+		if !slices.Equal(output, test.output) {
+			t.Errorf("%d: expected %v, got %v", i, test.output, output)
+		}
+	}
+}
+
+func Test_Arena(t *testing.T) {
+	var arena Arena
+
+	tests := [][][2]int{
+		{{2, 3}, {3, 3}},
+		// те же размеры и меньшие матрицы используют прежнюю память
+		{{2, 3}, {3, 3}},
+		{{3, 2}, {1, 1}},
+		// новая матрица сверх прежнего числа
+		{{2, 3}, {3, 3}, {4, 4}},
+	}
+
+	var prev []*mat.Dense
+	for i, dims := range tests {
+		arena.Reset()
+
+		var mats []*mat.Dense
+		for j, dim := range dims {
+			m := arena.Get(dim[0], dim[1])
+			mats = append(mats, m)
+
+			if r, c := m.Dims(); r != dim[0] || c != dim[1] || mat.Sum(m) != 0 {
+				t.Errorf("%d %d: expected zero %v, got %dx%d sum %v", i, j, dim, r, c, mat.Sum(m))
+			}
+
+			if j < len(prev) && m != prev[j] {
+				t.Errorf("%d %d: matrix not reused", i, j)
+			}
+
+			m.Set(0, 0, 1)
+		}
+		prev = mats
+	}
+
+	allocs := testing.AllocsPerRun(10, func() {
+		arena.Reset()
+		arena.Get(2, 3)
+		arena.Get(3, 2)
+	})
+	if allocs != 0 {
+		t.Errorf("expected no allocations, got %v", allocs)
+	}
+
+	src := mat.NewDense(3, 2, []float64{
+		1, 2,
+		3, 4,
+		5, 6,
+	})
+
+	for _, arena := range []*Arena{&arena, nil} {
+		for j, span := range [][2]int{{0, 3}, {1, 3}, {2, 3}} {
+			expected := src.Slice(span[0], span[1], 0, 2)
+			if view := arena.Rows(src, span[0], span[1]); !mat.Equal(view, expected) {
+				t.Errorf("%d: expected %v, got %v", j, mat.Formatted(expected), mat.Formatted(view))
+			}
+		}
+	}
+
+	var nilArena *Arena
+	nilArena.Reset()
+	if m := nilArena.Get(2, 2); m == nilArena.Get(2, 2) {
+		t.Errorf("nil arena reused matrix")
+	}
+}
+
+func Test_GatherAdd(t *testing.T) {
+	src := mat.NewDense(3, 2, []float64{
+		1, 2,
+		3, 4,
+		5, 6,
+	})
+
+	tests := []struct {
+		rows []int
+		gather,
+		scatter *mat.Dense
+	}{
+		{
+			rows: []int{2, 0},
+			gather: mat.NewDense(2, 2, []float64{
+				5, 6,
+				1, 2,
+			}),
+			scatter: mat.NewDense(3, 2, []float64{
+				3, 4,
+				0, 0,
+				1, 2,
+			}),
+		},
+		{
+			rows: []int{1, 1, 0},
+			gather: mat.NewDense(3, 2, []float64{
+				3, 4,
+				3, 4,
+				1, 2,
+			}),
+			scatter: mat.NewDense(3, 2, []float64{
+				5, 6,
+				4, 6,
+				0, 0,
+			}),
+		},
+	}
+
+	for i, test := range tests {
+		gather := mat.NewDense(len(test.rows), 2, nil)
+		GatherAdd(gather, src, test.rows)
+
+		if !mat.Equal(gather, test.gather) {
+			t.Errorf("%d: expected %v, got %v", i, test.gather, gather)
+		}
+
+		scatter := mat.NewDense(3, 2, nil)
+		ScatterAdd(scatter, src.Slice(0, len(test.rows), 0, 2).(*mat.Dense), test.rows)
+
+		if !mat.Equal(scatter, test.scatter) {
+			t.Errorf("%d: expected %v, got %v", i, test.scatter, scatter)
+		}
+	}
+}
+
 func Test_Split(t *testing.T) {
 	tests := []struct {
 		src    *mat.Dense
@@ -372,7 +758,7 @@ func Test_DropoutMask(t *testing.T) {
 	}
 
 	for i, test := range tests {
-		mask := DropoutMask(test.r, test.c, test.p)
+		mask := DropoutMask(NewRNG(1), test.r, test.c, test.p)
 
 	loop:
 		for row := range test.r {
@@ -436,6 +822,190 @@ func Test_CrossEntropy(t *testing.T) {
 	}
 }
 
+func Test_LogSoftmax(t *testing.T) {
+	tests := []struct {
+		src,
+		output *mat.Dense
+	}{
+		{
+			src: mat.NewDense(2, 3, []float64{
+				1, 2, 3,
+				1000, 0, -1000,
+			}),
+			output: mat.NewDense(2, 3, []float64{
+				-2.4076, -1.4076, -.4076,
+				0, -1000, -2000,
+			}),
+		},
+	}
+
+	for i, test := range tests {
+		var trg mat.Dense
+		trg.CloneFrom(test.src)
+		LogSoftmax(&trg, test.src)
+
+		if !mat.EqualApprox(&trg, test.output, 1e-4) {
+			t.Errorf("%d: expected %v, got %v", i, test.output, &trg)
+		}
+	}
+}
+
+func Test_SoftmaxCrossEntropy(t *testing.T) {
+	tests := []struct {
+		logits,
+		ans *mat.Dense
+		smoothing,
+		zloss float64
+	}{
+		{
+			logits: mat.NewDense(2, 3, []float64{
+				.5, -1, 2,
+				.1, .3, -.2,
+			}),
+			ans: mat.NewDense(2, 3, []float64{
+				1, 0, 0,
+				0, 1, 0,
+			}),
+		},
+		{
+			logits: mat.NewDense(3, 3, []float64{
+				.5, -1, 2,
+				.1, .3, -.2,
+				4, 1, 0,
+			}),
+			ans: mat.NewDense(3, 3, []float64{
+				1, 0, 0,
+				0, 0, 0,
+				0, 0, 1,
+			}),
+			smoothing: .1,
+			zloss:     .01,
+		},
+	}
+
+	// naive считает ту же ошибку напрямую через Softmax и CrossEntropy.
+	naive := func(logits, ans *mat.Dense, smoothing, zloss float64) float64 {
+		var (
+			sum float64
+			n   int
+		)
+
+		for row := range Rown(logits) {
+			arow := ans.RawRowView(row)
+			if floats.Sum(arow) == 0 {
+				continue
+			}
+			n++
+
+			lrow := mat.NewDense(1, Coln(logits), logits.RawRowView(row))
+
+			var pred mat.Dense
+			pred.CloneFrom(lrow)
+			Softmax(&pred, lrow)
+
+			target := mat.NewDense(1, Coln(logits), nil)
+			for col := range Coln(logits) {
+				target.Set(0, col, (1-smoothing)*arow[col]+smoothing/float64(Coln(logits)))
+			}
+
+			var z float64
+			for _, val := range lrow.RawRowView(0) {
+				z += math.Exp(val)
+			}
+
+			sum += CrossEntropy(&pred, target) + zloss*math.Log(z)*math.Log(z)
+		}
+
+		return sum / float64(n)
+	}
+
+	const eps = 1e-6
+
+	for i, test := range tests {
+		grad := mat.DenseCopyOf(test.logits)
+		out := SoftmaxCrossEntropy(grad, test.ans, test.smoothing, test.zloss)
+
+		expected := naive(test.logits, test.ans, test.smoothing, test.zloss)
+		if math.Abs(expected-out) > 1e-6 {
+			t.Errorf("%d: expected %v, got %v", i, expected, out)
+		}
+
+		var n float64
+		for row := range Rown(test.ans) {
+			if floats.Sum(test.ans.RawRowView(row)) != 0 {
+				n++
+			}
+		}
+
+		for row := range Rown(test.logits) {
+			for col := range Coln(test.logits) {
+				val := test.logits.At(row, col)
+
+				test.logits.Set(row, col, val+eps)
+				plus := naive(test.logits, test.ans, test.smoothing, test.zloss)
+				test.logits.Set(row, col, val-eps)
+				minus := naive(test.logits, test.ans, test.smoothing, test.zloss)
+				test.logits.Set(row, col, val)
+
+				// градиент не делится на число строк, как и раньше в Train.
+				num := (plus - minus) / (2 * eps) * n
+				if math.Abs(num-grad.At(row, col)) > 1e-5 {
+					t.Errorf("%d %d %d: expected %v, got %v", i, row, col, num, grad.At(row, col))
+				}
+			}
+		}
+	}
+
+	logits := mat.NewDense(1, 2, []float64{1000, -1000})
+	out := SoftmaxCrossEntropy(logits, mat.NewDense(1, 2, []float64{0, 1}), 0, 0)
+	if math.Abs(out-2000) > 1e-6 {
+		t.Errorf("expected %v, got %v", 2000, out)
+	}
+}
+
+func Test_SparseCrossEntropy(t *testing.T) {
+	tests := []struct {
+		logits  *mat.Dense
+		targets []int
+		smoothing,
+		zloss float64
+	}{
+		{
+			logits: mat.NewDense(3, 4, []float64{
+				.5, -1, 2, 0,
+				.1, .3, -.2, 7,
+				4, 1, 0, -3,
+			}),
+			targets:   []int{2, -1, 0},
+			smoothing: .1,
+			zloss:     .01,
+		},
+	}
+
+	for i, test := range tests {
+		ans := mat.NewDense(len(test.targets), Coln(test.logits), nil)
+		for row, target := range test.targets {
+			if target >= 0 {
+				ans.Set(row, target, 1)
+			}
+		}
+
+		expected := mat.DenseCopyOf(test.logits)
+		eout := SoftmaxCrossEntropy(expected, ans, test.smoothing, test.zloss)
+
+		grad := mat.DenseCopyOf(test.logits)
+		out := SparseCrossEntropy(grad, test.targets, test.smoothing, test.zloss)
+
+		if math.Abs(eout-out) > 1e-12 {
+			t.Errorf("%d: expected %v, got %v", i, eout, out)
+		}
+
+		if !mat.EqualApprox(expected, grad, 1e-12) {
+			t.Errorf("%d: expected %v, got %v", i, expected, grad)
+		}
+	}
+}
+
 func Test_HotEnc(t *testing.T) {
 	tests := []struct {
 		inds []int
@@ -0,0 +1,139 @@
+package llm
+
+import (
+	"gonum.org/v1/gonum/floats"
+	"gonum.org/v1/gonum/mat"
+	"llm/pkg/lib"
+	"llm/pkg/mha"
+)
+
+/*
+Cache - состояние пошаговой генерации одной последовательности:
+ключи и значения внимания и загрузка экспертов каждого слоя.
+*/
+type Cache struct {
+	layers []layerCache
+	n      int
+}
+
+type layerCache struct {
+	mha    mha.Cache
+	counts []int
+}
+
+func (llm *LLM) NewCache() *Cache {
+	cache := &Cache{layers: make([]layerCache, len(llm.Layers))}
+
+	for index, layer := range llm.Layers {
+		if layer.MoE != nil {
+			cache.layers[index].counts = make([]int, len(layer.MoE.Experts))
+		}
+	}
+
+	return cache
+}
+
+// Len возвращает число позиций в кэше.
+func (cache *Cache) Len() int {
+	return cache.n
+}
+
+// Reset очищает кэш, сохраняя выделенную память.
+func (cache *Cache) Reset() {
+	for index := range cache.layers {
+		cache.layers[index].mha.Reset()
+		clear(cache.layers[index].counts)
+	}
+	cache.n = 0
+}
+
+/*
+Step продолжает последовательности caches непустыми tokens[i] и возвращает
+логиты следующего токена после каждой, по строке на последовательность.
+Логиты совпадают с логитами Infer для окна из всех токенов
+последовательности, длина которой поэтому не может превышать CtxSize.
+Все последовательности вычисляются одним проходом с общими умножениями
+матриц. Вызовы с разными кэшами могут выполняться одновременно.
+*/
+func (llm *LLM) Step(caches []*Cache, tokens [][]int) *mat.Dense {
+	var inds, pos []int
+	lens := make([]int, len(caches))
+
+	for index, cache := range caches {
+		lens[index] = len(tokens[index])
+
+		if lens[index] == 0 || cache.n+lens[index] > llm.CtxSize {
+			panic("последовательность выходит за окно модели")
+		}
+
+		for offset, ind := range tokens[index] {
+			inds = append(inds, ind)
+			pos = append(pos, cache.n+offset)
+		}
+	}
+
+	input := llm.embedAt(nil, inds, pos)
+	alphaMHA, alphaMLP := llm.alphas()
+
+	mhaCaches := make([]*mha.Cache, len(caches))
+	counts := make([][]int, len(caches))
+
+	for index, layer := range llm.Layers {
+		for seq, cache := range caches {
+			mhaCaches[seq] = &cache.layers[index].mha
+			counts[seq] = cache.layers[index].counts
+		}
+
+		input = layer.step(mhaCaches, counts, pos, lens, input, alphaMHA, alphaMLP)
+	}
+
+	last := mat.NewDense(len(caches), lib.Coln(input), nil)
+
+	var row int
+	for index, cache := range caches {
+		row += lens[index]
+		cache.n += lens[index]
+		last.SetRow(index, input.RawRowView(row-1))
+	}
+
+	return llm.logits(nil, last)
+}
+
+// embedAt аналогичен embed для индексов на позициях pos.
+func (llm *LLM) embedAt(arena *lib.Arena, indices, pos []int) *mat.Dense {
+	embeds := arena.Get(len(indices), lib.Coln(llm.Embeds))
+	for index, embindex := range indices {
+		row := embeds.RawRowView(index)
+		copy(row, llm.Embeds.RawRowView(embindex))
+		floats.Add(row, llm.Pos.RawRowView(pos[index]))
+	}
+
+	return embeds
+}
+
+// step аналогичен Infer для строк нескольких последовательностей, см. LLM.Step.
+func (layer *Layer) step(
+	caches []*mha.Cache,
+	counts [][]int,
+	pos,
+	lens []int,
+	input *mat.Dense,
+	alphaMHA,
+	alphaMLP float64) *mat.Dense {
+
+	mhaOut := layer.MHA.InferCached(caches, lens, input)
+	lib.Scale(mhaOut, alphaMHA, mhaOut)
+	lib.Add(mhaOut, mhaOut, input)
+
+	var mlpOut *mat.Dense
+	if layer.MoE != nil {
+		mlpOut = layer.MoE.InferAt(mhaOut, pos, lens, counts)
+	} else {
+		mlpOut = layer.MLP.InferAt(mhaOut, pos)
+	}
+
+	lib.Scale(mlpOut, alphaMLP, mlpOut)
+	lib.Add(mlpOut, mlpOut, mhaOut)
+
+	return mlpOut
+}
@@ -0,0 +1,71 @@
+package llm
+
+import (
+	"gonum.org/v1/gonum/mat"
+	"llm/pkg/lib"
+	"testing"
+)
+
+func Test_Step(t *testing.T) {
+	cfgs := []Config{
+		{CtxSize: 6, Vocab: 7, Dim: 4, Layers: 2, Heads: 2},
+		{CtxSize: 6, Vocab: 7, Dim: 4, Layers: 1, Heads: 2, Untied: true, Gated: true, Act: lib.ActSilu},
+		{CtxSize: 6, Vocab: 7, Dim: 4, Layers: 2, Heads: 2, Experts: 3, TopK: 2, Capacity: .5},
+	}
+
+	seqs := [][]int{{1, 2, 3, 4, 5, 6}, {6, 5}, {0, 0, 1, 3, 2}}
+	// chunks[step][seq] - число токенов последовательности на шаге, 0 - пропуск.
+	chunks := [][]int{{3, 1, 2}, {1, 1, 0}, {2, 0, 3}}
+
+	for i, cfg := range cfgs {
+		llm := NewWith(cfg)
+		llm.Attach(llm.NewLoRA(2, 4))
+
+		caches := []*Cache{llm.NewCache(), llm.NewCache(), llm.NewCache()}
+
+		for step, chunk := range chunks {
+			var (
+				batch  []*Cache
+				tokens [][]int
+				owners []int
+			)
+
+			for seq, n := range chunk {
+				if n == 0 {
+					continue
+				}
+
+				start := caches[seq].Len()
+				batch = append(batch, caches[seq])
+				tokens = append(tokens, seqs[seq][start:start+n])
+				owners = append(owners, seq)
+			}
+
+			logits := llm.Step(batch, tokens)
+
+			for row, seq := range owners {
+				n := caches[seq].Len()
+
+				// окно дополняется токенами, не влияющими на позицию n-1
+				window := append(append([]int(nil), seqs[seq][:n]...), make([]int, cfg.CtxSize-n)...)
+				expected := llm.Infer(window).RawRowView(n - 1)
+
+				if !mat.EqualApprox(mat.NewVecDense(len(expected), expected), logits.RowView(row), 1e-10) {
+					t.Errorf("%d %d: sequence %d differs from Infer", i, step, seq)
+				}
+			}
+		}
+
+		caches[0].Reset()
+		if caches[0].Len() != 0 {
+			t.Errorf("%d: expected empty cache", i)
+		}
+
+		logits := llm.Step(caches[:1], [][]int{seqs[2]})
+		expected := llm.Step([]*Cache{llm.NewCache()}, [][]int{seqs[2]})
+
+		if !mat.EqualApprox(logits, expected, 1e-12) {
+			t.Errorf("%d: reset cache differs from new", i)
+		}
+	}
+}
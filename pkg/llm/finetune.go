@@ -0,0 +1,53 @@
+package llm
+
+import (
+	"llm/pkg/bpe"
+	"path/filepath"
+)
+
+type FineTuneConfig struct {
+	TrainConfig
+	// Base - контрольная точка базовой модели, она не перезаписывается.
+	Base string
+	FreezeEmbeds,
+	FreezePos bool
+	// FreezeLayers - число замораживаемых первых слоев.
+	FreezeLayers int
+}
+
+/*
+FineTune дообучает базовую модель на source и сохраняет результат
+в cfg.SaveIn. Для пар запрос/ответ source должен возвращать маску,
+например JSONLSource с полями Prompt и Response, тогда ошибка
+считается только на ответе. Заморозка задается правилами модели
+и сохраняется вместе с ней, см. Freeze.
+*/
+func FineTune(source Source, bpe *bpe.BPE, cfg FineTuneConfig) *LLM {
+	base, err := filepath.Abs(cfg.Base)
+	if err != nil {
+		panic(err)
+	}
+
+	trg, err := filepath.Abs(cfg.SaveIn)
+	if err != nil {
+		panic(err)
+	}
+
+	if base == trg {
+		panic("дообученная модель перезапишет базовую")
+	}
+
+	if cfg.FreezeLayers < 0 {
+		panic("отрицательное число замораживаемых слоев")
+	}
+
+	llm := Load(cfg.Base)
+	if cfg.FreezeLayers > len(llm.Layers) {
+		panic("замораживаемых слоев больше, чем слоев модели")
+	}
+
+	llm.Freeze(cfg.FreezeEmbeds, cfg.FreezePos, cfg.FreezeLayers)
+	Train(llm, source, bpe, cfg.TrainConfig)
+
+	return llm
+}
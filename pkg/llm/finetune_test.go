@@ -0,0 +1,81 @@
+package llm
+
+import (
+	"gonum.org/v1/gonum/mat"
+	"llm/pkg/dirreader"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_FineTune(t *testing.T) {
+	root := t.TempDir()
+
+	err := os.WriteFile(filepath.Join(root, "a.jsonl"), []byte(
+		`{"prompt": "привет", "response": "мир"}`+"\n"+
+			`{"prompt": "как дела", "response": "привет мир"}`+"\n",
+	), os.ModePerm)
+	if err != nil {
+		panic(err)
+	}
+
+	base := filepath.Join(root, "base.gob")
+	trg := filepath.Join(root, "sft.gob")
+
+	New(4, vocab.Len(), 4, 2, 2).Save(base)
+
+	source := JSONLSource(root, vocab,
+		Fields{Prompt: "prompt", Response: "response"},
+		dirreader.Options{Exts: []string{".jsonl"}})
+
+	tuned := FineTune(source, vocab, FineTuneConfig{
+		TrainConfig: TrainConfig{
+			LR:      .1,
+			SaveIn:  trg,
+			Workers: 1,
+			Epochs:  2,
+		},
+		Base:         base,
+		FreezeEmbeds: true,
+		FreezePos:    true,
+		FreezeLayers: 1,
+	})
+
+	orig := Load(base)
+	saved := Load(trg)
+
+	frozen := []struct {
+		name string
+		a, b *mat.Dense
+	}{
+		{"Embeds", orig.Embeds, tuned.Embeds},
+		{"Pos", orig.Pos, tuned.Pos},
+		{"Layers.0.MHA.WOutput", orig.Layers[0].MHA.WOutput, tuned.Layers[0].MHA.WOutput},
+		{"Layers.0.MLP.Weights", orig.Layers[0].MLP.Layers[0].Weights, tuned.Layers[0].MLP.Layers[0].Weights},
+	}
+
+	for _, param := range frozen {
+		if !mat.Equal(param.a, param.b) {
+			t.Errorf("frozen %s changed", param.name)
+		}
+	}
+
+	if mat.Equal(orig.Layers[1].MHA.WOutput, tuned.Layers[1].MHA.WOutput) {
+		t.Errorf("trainable Layers.1.MHA.WOutput did not change")
+	}
+
+	if !mat.Equal(saved.Layers[1].MHA.WOutput, tuned.Layers[1].MHA.WOutput) {
+		t.Errorf("fine-tuned model is not saved")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected panic when overwriting base model")
+		}
+	}()
+
+	FineTune(source, vocab, FineTuneConfig{
+		TrainConfig: TrainConfig{SaveIn: base},
+		Base:        base,
+	})
+}
@@ -0,0 +1,164 @@
+package llm
+
+import (
+	"gonum.org/v1/gonum/floats"
+	"iter"
+	"llm/pkg/bpe"
+	"math"
+	"math/rand/v2"
+	"slices"
+)
+
+// GenConfig задает выбор следующего токена при генерации.
+type GenConfig struct {
+	// MaxTokens ограничивает число новых токенов.
+	MaxTokens int
+	// Temperature делит логиты перед softmax, 0 выбирает наиболее вероятный токен.
+	Temperature float64
+	// TopK оставляет k наиболее вероятных токенов, 0 оставляет все.
+	TopK int
+	/*
+		TopP оставляет наименьший набор наиболее вероятных токенов
+		с суммарной вероятностью не меньше TopP, 0 оставляет все.
+	*/
+	TopP float64
+	Seed uint64
+}
+
+/*
+Generate продолжает prompt и выдает новые токены до eot или MaxTokens.
+Пустой prompt начинается с eot, как документ в склеенных окнах.
+Окно - последние CtxSize токенов, пока последовательность помещается
+в окно, следующие токены вычисляются по кэшу за один шаг.
+Модель только читается, поэтому генерации могут идти одновременно.
+*/
+func (llm *LLM) Generate(bpe *bpe.BPE, prompt []int, cfg GenConfig) iter.Seq[int] {
+	check(bpe)
+	eotind := bpe.GetInd(eot)
+
+	return func(yield func(int) bool) {
+		if cfg.MaxTokens <= 0 {
+			return
+		}
+
+		seq := llm.newSequence(prompt, cfg, eotind)
+
+		for {
+			logits := llm.Step([]*Cache{seq.cache}, [][]int{seq.pending(llm.CtxSize)})
+
+			next, ok := seq.next(logits.RawRowView(0), eotind)
+			if !ok || !yield(next) || seq.done() {
+				return
+			}
+		}
+	}
+}
+
+// sequence - генерируемая последовательность вместе с ее кэшем.
+type sequence struct {
+	inds []int
+	// start - начало окна: в кэше inds[start:start+cache.Len()].
+	start int
+	cache *Cache
+	cfg   GenConfig
+	rng   *rand.Rand
+	n     int
+}
+
+func (llm *LLM) newSequence(prompt []int, cfg GenConfig, eotind int) sequence {
+	inds := slices.Clone(prompt)
+	if len(inds) == 0 {
+		inds = append(inds, eotind)
+	}
+
+	return sequence{
+		inds:  inds,
+		cache: llm.NewCache(),
+		cfg:   cfg,
+		rng:   rand.New(rand.NewPCG(cfg.Seed, 0)),
+	}
+}
+
+/*
+pending возвращает токены, которые нужно добавить в кэш, чтобы получить
+логиты следующего. Если последовательность вышла за окно, кэш сбрасывается
+и окно сдвигается к последним ctxsize токенам.
+*/
+func (seq *sequence) pending(ctxsize int) []int {
+	if len(seq.inds)-seq.start > ctxsize {
+		seq.cache.Reset()
+		seq.start = len(seq.inds) - ctxsize
+	}
+
+	return seq.inds[seq.start+seq.cache.Len():]
+}
+
+// next выбирает следующий токен по логитам, false означает eot.
+func (seq *sequence) next(logits []float64, eotind int) (int, bool) {
+	next := sample(logits, seq.cfg, seq.rng)
+	if next == eotind {
+		return next, false
+	}
+
+	seq.inds = append(seq.inds, next)
+	seq.n++
+
+	return next, true
+}
+
+// done сообщает, что выбрано MaxTokens токенов.
+func (seq *sequence) done() bool {
+	return seq.n >= seq.cfg.MaxTokens
+}
+
+func sample(logits []float64, cfg GenConfig, rng *rand.Rand) int {
+	if cfg.Temperature <= 0 {
+		return floats.MaxIdx(logits)
+	}
+
+	order := make([]int, len(logits))
+	for index := range order {
+		order[index] = index
+	}
+	slices.SortStableFunc(order, func(a, b int) int {
+		switch {
+		case logits[a] > logits[b]:
+			return -1
+		case logits[a] < logits[b]:
+			return 1
+		}
+		return 0
+	})
+
+	if cfg.TopK > 0 {
+		order = order[:min(cfg.TopK, len(order))]
+	}
+
+	probs := make([]float64, len(order))
+	for index, ind := range order {
+		probs[index] = math.Exp((logits[ind] - logits[order[0]]) / cfg.Temperature)
+	}
+	floats.Scale(1/floats.Sum(probs), probs)
+
+	if cfg.TopP > 0 && cfg.TopP < 1 {
+		var sum float64
+		for index, prob := range probs {
+			sum += prob
+			if sum >= cfg.TopP {
+				probs = probs[:index+1]
+				break
+			}
+		}
+		floats.Scale(1/floats.Sum(probs), probs)
+	}
+
+	draw := rng.Float64()
+	for index, prob := range probs {
+		draw -= prob
+		if draw < 0 {
+			return order[index]
+		}
+	}
+
+	return order[len(probs)-1]
+}
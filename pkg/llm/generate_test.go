@@ -0,0 +1,90 @@
+package llm
+
+import (
+	"gonum.org/v1/gonum/floats"
+	"math/rand/v2"
+	"slices"
+	"testing"
+)
+
+func Test_sample(t *testing.T) {
+	logits := []float64{1, 3, 2, -1}
+
+	tests := []struct {
+		cfg     GenConfig
+		allowed []int
+	}{
+		{cfg: GenConfig{}, allowed: []int{1}},
+		{cfg: GenConfig{Temperature: 1, TopK: 1}, allowed: []int{1}},
+		{cfg: GenConfig{Temperature: 1, TopK: 2}, allowed: []int{1, 2}},
+		{cfg: GenConfig{Temperature: 1, TopP: .5}, allowed: []int{1}},
+		{cfg: GenConfig{Temperature: 1, TopP: .85}, allowed: []int{1, 2}},
+		{cfg: GenConfig{Temperature: 1}, allowed: []int{0, 1, 2, 3}},
+	}
+
+	for i, test := range tests {
+		rng := rand.New(rand.NewPCG(1, 0))
+		seen := make(map[int]bool)
+
+		for range 1000 {
+			seen[sample(logits, test.cfg, rng)] = true
+		}
+
+		if len(seen) != len(test.allowed) {
+			t.Errorf("%d: expected %v, got %v", i, test.allowed, seen)
+		}
+
+		for _, ind := range test.allowed {
+			if !seen[ind] {
+				t.Errorf("%d: %d never sampled", i, ind)
+			}
+		}
+	}
+}
+
+func Test_Generate(t *testing.T) {
+	llm := NewWith(Config{CtxSize: 4, Vocab: vocab.Len(), Dim: 4, Layers: 1, Heads: 2, Seed: 1})
+	padind, eotind := vocab.GetInd(pad), vocab.GetInd(eot)
+
+	prompt := []int{6, 7}
+
+	// жадная генерация повторяет argmax Infer по дополненному окну
+	inds := slices.Clone(prompt)
+	var expected []int
+	for range 6 {
+		window := slices.Clone(inds[max(0, len(inds)-4):])
+		last := len(window) - 1
+		for len(window) < 4 {
+			window = append(window, padind)
+		}
+
+		next := floats.MaxIdx(llm.Infer(window).RawRowView(last))
+		if next == eotind {
+			break
+		}
+
+		expected = append(expected, next)
+		inds = append(inds, next)
+	}
+
+	got := slices.Collect(llm.Generate(vocab, prompt, GenConfig{MaxTokens: 6}))
+	if !slices.Equal(expected, got) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+
+	cfg := GenConfig{MaxTokens: 8, Temperature: 1, Seed: 5}
+	first := slices.Collect(llm.Generate(vocab, nil, cfg))
+	second := slices.Collect(llm.Generate(vocab, nil, cfg))
+
+	if !slices.Equal(first, second) {
+		t.Errorf("same seed gave %v and %v", first, second)
+	}
+
+	if len(first) > cfg.MaxTokens || slices.Contains(first, eotind) {
+		t.Errorf("unexpected generation %v", first)
+	}
+
+	for range llm.Generate(vocab, prompt, cfg) {
+		break
+	}
+}
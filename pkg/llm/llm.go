@@ -2,134 +2,601 @@ package llm
 
 import (
 	"encoding/gob"
+	"fmt"
+	"gonum.org/v1/gonum/floats"
 	"gonum.org/v1/gonum/mat"
 	"llm/pkg/lib"
+	"llm/pkg/lora"
 	"llm/pkg/mha"
 	"llm/pkg/mlp"
+	"llm/pkg/moe"
 	"math"
 	"os"
+	"sync"
 )
 
 type Layer struct {
 	MHA *mha.MHA
 	MLP *mlp.MLP
+	// MoE заменяет MLP смесью экспертов, если задан.
+	MoE *moe.MoE
+	/*
+		Checkpoint сохраняет для Backward только вход слоя и маски dropout,
+		а остальные активации вычисляются в BackwardWith заново. Это экономит
+		память ценой повторного прямого прохода слоя, градиенты не меняются.
+	*/
+	Checkpoint bool
+	state      LayerState
+}
+
+// LayerState - активации одного вызова Layer.ForwardWith, нужные Backward.
+type LayerState struct {
+	mha mha.State
+	mlp mlp.State
+	moe moe.State
 	mhaMask,
 	mlpMask *mat.Dense
+	// checkpoint заменяет остальные активации, если слой использует Checkpoint.
+	checkpoint *checkpoint
+	// arena - память матриц вызова, используемая повторно.
+	arena lib.Arena
+}
+
+// checkpoint - аргументы ForwardWith для повторного вычисления активаций.
+type checkpoint struct {
+	input *mat.Dense
+	lens,
+	pos,
+	docs []int
+	aux    float64
+	counts moe.Counts
+}
+
+// aux возвращает ошибку балансировки MoE вызова ForwardWith.
+func (state *LayerState) aux() float64 {
+	if state.checkpoint != nil {
+		return state.checkpoint.aux
+	}
+	return state.moe.Aux()
+}
+
+// counts возвращает назначения экспертам MoE вызова ForwardWith.
+func (state *LayerState) counts() moe.Counts {
+	if state.checkpoint != nil {
+		return state.checkpoint.counts
+	}
+	return state.moe.Counts()
+}
+
+// setCounts заменяет назначения для BackwardWith, см. moe.State.SetCounts.
+func (state *LayerState) setCounts(counts moe.Counts) {
+	if state.checkpoint != nil {
+		state.checkpoint.counts = counts
+		return
+	}
+	state.moe.SetCounts(counts)
+}
+
+type block interface {
+	Infer(input *mat.Dense) *mat.Dense
+	SetParams(params lib.Params)
+	ParamN() int
+}
+
+func (layer *Layer) block() block {
+	if layer.MoE != nil {
+		return layer.MoE
+	}
+	return layer.MLP
 }
 
+/*
+Forward сохраняет активации в слое для Backward. Выход - новая матрица,
+в отличие от ForwardWith она не переиспользуется следующими вызовами.
+*/
 func (layer *Layer) Forward(
 	input *mat.Dense,
 	alphaMHA,
 	alphaMLP,
-	dropoutP float64) *mat.Dense {
+	dropoutP float64,
+	rng *lib.RNG) *mat.Dense {
 
-	mhaOut := layer.MHA.Forward(input)
+	return mat.DenseCopyOf(layer.ForwardWith(&layer.state, input, nil, nil, nil, alphaMHA, alphaMLP, dropoutP, rng))
+}
 
-	mhaMask := lib.DropoutMask(lib.Rown(mhaOut), lib.Coln(mhaOut), dropoutP)
-	mhaOut.MulElem(mhaOut, mhaMask)
-	mhaOut.Scale(alphaMHA, mhaOut)
-	mhaOut.Add(mhaOut, input)
+/*
+ForwardWith аналогичен Forward, но сохраняет активации в state
+и ограничивает внимание документами docs. Если lens задан, строки input
+по порядку делятся на независимые последовательности длины lens[i],
+стоящие на позициях pos. Вызовы с разными state могут выполняться
+одновременно. Память матриц state используется повторно, поэтому выход
+и результат BackwardWith действительны до следующего вызова с тем же
+state. Активации слоя с Checkpoint каждый раз выделяются заново и после
+прохода освобождаются.
+*/
+func (layer *Layer) ForwardWith(
+	state *LayerState,
+	input *mat.Dense,
+	lens,
+	pos,
+	docs []int,
+	alphaMHA,
+	alphaMLP,
+	dropoutP float64,
+	rng *lib.RNG) *mat.Dense {
 
-	mlpOut := layer.MLP.Forward(mhaOut)
-	mlpMask := lib.DropoutMask(lib.Rown(mlpOut), lib.Coln(mlpOut), dropoutP)
-	mlpOut.MulElem(mlpOut, mlpMask)
-	mlpOut.Scale(alphaMLP, mlpOut)
-	mlpOut.Add(mlpOut, mhaOut)
+	if !layer.Checkpoint {
+		state.mhaMask, state.mlpMask, state.checkpoint = nil, nil, nil
+		state.arena.Reset()
 
-	layer.mhaMask = mhaMask
-	layer.mlpMask = mlpMask
+		return layer.forward(state, input, lens, pos, docs, alphaMHA, alphaMLP, dropoutP, rng)
+	}
+
+	full := new(LayerState)
+	output := layer.forward(full, input, lens, pos, docs, alphaMHA, alphaMLP, dropoutP, rng)
+
+	*state = LayerState{
+		mhaMask: full.mhaMask,
+		mlpMask: full.mlpMask,
+		checkpoint: &checkpoint{
+			input:  input,
+			lens:   lens,
+			pos:    pos,
+			docs:   docs,
+			aux:    full.moe.Aux(),
+			counts: full.moe.Counts(),
+		},
+	}
+
+	return output
+}
+
+/*
+forward - прямой проход ForwardWith. Маски dropout, уже заданные в state,
+используются повторно, поэтому проход можно повторить с теми же масками.
+*/
+func (layer *Layer) forward(
+	state *LayerState,
+	input *mat.Dense,
+	lens,
+	pos,
+	docs []int,
+	alphaMHA,
+	alphaMLP,
+	dropoutP float64,
+	rng *lib.RNG) *mat.Dense {
+
+	mhaOut := layer.MHA.ForwardWith(&state.mha, input, lens, docs)
+
+	state.mhaMask = remask(rng, &state.arena, mhaOut, state.mhaMask, dropoutP)
+	lib.Scale(mhaOut, alphaMHA, mhaOut)
+	lib.Add(mhaOut, mhaOut, input)
+
+	var mlpOut *mat.Dense
+	if layer.MoE != nil {
+		mlpOut = layer.MoE.ForwardWith(&state.moe, mhaOut, pos, lens)
+	} else {
+		mlpOut = layer.MLP.ForwardWith(&state.mlp, mhaOut, pos)
+	}
+
+	state.mlpMask = remask(rng, &state.arena, mlpOut, state.mlpMask, dropoutP)
+	lib.Scale(mlpOut, alphaMLP, mlpOut)
+	lib.Add(mlpOut, mlpOut, mhaOut)
 
 	return mlpOut
 }
 
+// recompute вычисляет заново активации, не сохраненные из-за Checkpoint.
+func (layer *Layer) recompute(state *LayerState, alphaMHA, alphaMLP float64) *LayerState {
+	cp := state.checkpoint
+	full := &LayerState{mhaMask: state.mhaMask, mlpMask: state.mlpMask}
+
+	layer.forward(full, cp.input, cp.lens, cp.pos, cp.docs, alphaMHA, alphaMLP, 0, nil)
+	full.moe.SetCounts(cp.counts)
+
+	return full
+}
+
+/*
+Infer вычисляет выход слоя без dropout, ничего не сохраняя для Backward.
+Может вызываться одновременно из нескольких горутин.
+*/
+func (layer *Layer) Infer(input *mat.Dense, alphaMHA, alphaMLP float64) *mat.Dense {
+	mhaOut := layer.MHA.Infer(input)
+	lib.Scale(mhaOut, alphaMHA, mhaOut)
+	lib.Add(mhaOut, mhaOut, input)
+
+	mlpOut := layer.block().Infer(mhaOut)
+	lib.Scale(mlpOut, alphaMLP, mlpOut)
+	lib.Add(mlpOut, mlpOut, mhaOut)
+
+	return mlpOut
+}
+
+/*
+dropout применяет к m маску dropout из arena и возвращает ее.
+При p 0 маска не создается и возвращается nil.
+*/
+func dropout(rng *lib.RNG, arena *lib.Arena, m *mat.Dense, p float64) *mat.Dense {
+	if p <= 0 {
+		return nil
+	}
+
+	mask := arena.Get(m.Dims())
+	lib.SetDropoutMask(rng, mask, p)
+	lib.MulElem(m, m, mask)
+	return mask
+}
+
+// remask аналогичен dropout, но применяет mask, если она задана.
+func remask(rng *lib.RNG, arena *lib.Arena, m, mask *mat.Dense, p float64) *mat.Dense {
+	if mask == nil {
+		return dropout(rng, arena, m, p)
+	}
+
+	lib.MulElem(m, m, mask)
+	return mask
+}
+
 func (layer *Layer) Backward(
 	output *mat.Dense,
 	alphaMHA,
 	alphaMLP,
 	lr float64) *mat.Dense {
 
-	var mlpOut mat.Dense
-	mlpOut.Scale(alphaMLP, output)
-	mlpOut.MulElem(&mlpOut, layer.mlpMask)
-	mhaOut := layer.MLP.Backward(&mlpOut, lr)
+	return mat.DenseCopyOf(layer.BackwardWith(&layer.state, output, alphaMHA, alphaMLP, lr))
+}
+
+// BackwardWith аналогичен Backward для активаций state.
+func (layer *Layer) BackwardWith(
+	state *LayerState,
+	output *mat.Dense,
+	alphaMHA,
+	alphaMLP,
+	lr float64) *mat.Dense {
+
+	if state.checkpoint != nil {
+		state = layer.recompute(state, alphaMHA, alphaMLP)
+	}
+
+	mlpOut := state.arena.Get(output.Dims())
+	lib.Scale(mlpOut, alphaMLP, output)
+	if state.mlpMask != nil {
+		lib.MulElem(mlpOut, mlpOut, state.mlpMask)
+	}
+
+	var mhaOut *mat.Dense
+	if layer.MoE != nil {
+		mhaOut = layer.MoE.BackwardWith(&state.moe, mlpOut, lr)
+	} else {
+		mhaOut = layer.MLP.BackwardWith(&state.mlp, mlpOut, lr)
+	}
+
+	lib.Add(mhaOut, mhaOut, output)
 
-	mhaOut.Add(mhaOut, output)
+	input := state.arena.Get(mhaOut.Dims())
+	input.Copy(mhaOut)
 
-	var input mat.Dense
-	input.CloneFrom(mhaOut)
+	lib.Scale(mhaOut, alphaMHA, mhaOut)
+	if state.mhaMask != nil {
+		lib.MulElem(mhaOut, mhaOut, state.mhaMask)
+	}
 
-	mhaOut.Scale(alphaMHA, mhaOut)
-	mhaOut.MulElem(mhaOut, layer.mhaMask)
+	lib.Add(input, input, layer.MHA.BackwardWith(&state.mha, mhaOut, lr))
 
-	input.Add(&input, layer.MHA.Backward(mhaOut, lr))
+	return input
+}
 
-	return &input
+func (layer *Layer) SetParams(params lib.Params) {
+	layer.MHA.SetParams(params)
+	layer.block().SetParams(params)
 }
 
 func (layer *Layer) ParamN() int {
 	return layer.MHA.ParamN() +
-		layer.MLP.ParamN()
+		layer.block().ParamN()
+}
+
+// ActiveParamN в отличие от ParamN учитывает только выбранных экспертов MoE.
+func (layer *Layer) ActiveParamN() int {
+	if layer.MoE != nil {
+		return layer.MHA.ParamN() + layer.MoE.ActiveParamN()
+	}
+	return layer.ParamN()
 }
 
-func NewLayer(h, irow, icol int, wcol int) *Layer {
+func NewLayer(rng *lib.RNG, h, irow, icol int, wcol int) *Layer {
 	return &Layer{
-		MHA: mha.New(h, icol, wcol),
-		MLP: mlp.New(irow, icol, icol*4, icol),
+		MHA: mha.New(rng, h, icol, wcol),
+		MLP: mlp.New(rng, irow, icol, icol*4, icol),
 	}
 }
 
 type LLM struct {
-	Embeds  *mat.Dense
+	Embeds *mat.Dense
+	/*
+		Unembed и UnembedBias - отдельная выходная проекция.
+		Если Unembed nil, выходом служит Embeds.
+	*/
+	Unembed,
+	UnembedBias *mat.Dense
 	Pos     *mat.Dense
 	Layers  []*Layer
 	CtxSize int
-	last    *mat.Dense
-	indices []int
+	// Rules и Decay задают обновление параметров, см. SetRules.
+	Rules []Rule
+	Decay float64
+	/*
+		RNG - источник случайности инициализации и dropout.
+		Сохраняется вместе с моделью.
+	*/
+	RNG *lib.RNG
+	// state - активации последнего вызова Forward для Backward.
+	state    *State
+	mut      sync.Mutex
+	adapters *lora.Set
+	params   lib.Params
 }
 
+/*
+State - активации одного вызова LLM.ForwardWith, нужные Backward.
+Нулевое значение готово к использованию.
+*/
+type State struct {
+	layers []LayerState
+	last   *mat.Dense
+	indices,
+	// pos - позиции строк ForwardBatchWith, nil означает 0..CtxSize-1.
+	pos []int
+	// packed - память склеенных последовательностей ForwardBatchWith.
+	packed struct {
+		indices,
+		pos,
+		lens,
+		docs []int
+	}
+	arena lib.Arena
+}
+
+// Aux возвращает сумму вспомогательных ошибок слоев MoE вызова ForwardWith.
+func (state *State) Aux() float64 {
+	var sum float64
+
+	for index := range state.layers {
+		sum += state.layers[index].aux()
+	}
+
+	return sum
+}
+
+/*
+Forward возвращает логиты следующего токена для каждой позиции indices.
+Вероятности получаются lib.Softmax, ошибка - lib.SoftmaxCrossEntropy.
+Backward использует активации последнего завершившегося вызова Forward.
+*/
 func (llm *LLM) Forward(indices []int, dropoutP float64) *mat.Dense {
-	embeds := mat.NewDense(len(indices), lib.Coln(llm.Embeds), nil)
-	for index, embindex := range indices {
-		embeds.SetRow(index, llm.Embeds.RawRowView(embindex))
+	return llm.ForwardDocs(indices, nil, dropoutP)
+}
+
+/*
+ForwardDocs аналогичен Forward, но ограничивает внимание каждой позиции
+ее документом. docs содержит номер документа для каждого индекса.
+*/
+func (llm *LLM) ForwardDocs(indices, docs []int, dropoutP float64) *mat.Dense {
+	state := new(State)
+	output := llm.ForwardWith(state, indices, docs, dropoutP)
+	llm.remember(state)
+
+	return output
+}
+
+/*
+ForwardBatch возвращает логиты нескольких последовательностей длины
+не больше CtxSize, склеенные по строкам в порядке batch. Строки
+последовательности совпадают с первыми строками Forward окна, которое
+начинается с нее. Все последовательности вычисляются одним проходом
+с общими умножениями матриц, внимание не выходит за последовательность.
+docs[i] - документы i-й последовательности, как в ForwardDocs,
+nil docs или docs[i] снимают ограничение, иначе длина docs[i]
+совпадает с длиной последовательности. Backward использует
+активации последнего завершившегося вызова Forward или ForwardBatch.
+*/
+func (llm *LLM) ForwardBatch(batch, docs [][]int, dropoutP float64) *mat.Dense {
+	state := new(State)
+	output := llm.ForwardBatchWith(state, batch, docs, dropoutP)
+	llm.remember(state)
+
+	return output
+}
+
+func (llm *LLM) remember(state *State) {
+	llm.mut.Lock()
+	defer llm.mut.Unlock()
+
+	llm.state = state
+}
+
+/*
+ForwardWith аналогичен ForwardDocs, но сохраняет активации в state,
+а не в модели. Вызовы с разными state могут выполняться одновременно
+из нескольких горутин, пока модель не обучается. Память матриц state
+используется повторно, поэтому повторные шаги обучения с одним state
+почти не выделяют память, а логиты действительны до следующего вызова
+с тем же state.
+*/
+func (llm *LLM) ForwardWith(state *State, indices, docs []int, dropoutP float64) *mat.Dense {
+	state.arena.Reset()
+	state.indices, state.pos = indices, nil
+	return llm.forward(state, llm.embed(&state.arena, indices), nil, docs, dropoutP)
+}
+
+/*
+ForwardBatchWith аналогичен ForwardBatch, но сохраняет активации в state.
+Логиты действительны до следующего вызова с тем же state, см. ForwardWith.
+*/
+func (llm *LLM) ForwardBatchWith(state *State, batch, docs [][]int, dropoutP float64) *mat.Dense {
+	state.arena.Reset()
+
+	packed := &state.packed
+	indices, pos, seqdocs := packed.indices[:0], packed.pos[:0], packed.docs[:0]
+	lens := packed.lens[:0]
+
+	if docs != nil && len(docs) != len(batch) {
+		panic("число разметок документов не совпадает с числом последовательностей")
 	}
 
-	var input mat.Dense
-	input.Add(embeds, llm.Pos)
+	for index, seq := range batch {
+		lens = append(lens, len(seq))
 
-	alphaMHA := math.Pow(2*float64(len(llm.Layers)), -.25)
-	alphaMLP := math.Pow(8*float64(len(llm.Layers)), -.25)
+		if len(seq) == 0 || len(seq) > llm.CtxSize {
+			panic("последовательность пуста или выходит за окно модели")
+		}
+
+		indices = append(indices, seq...)
+		for offset := range seq {
+			pos = append(pos, offset)
+		}
+
+		if docs == nil {
+			continue
+		}
+
+		if docs[index] == nil {
+			for range seq {
+				seqdocs = append(seqdocs, 0)
+			}
+		} else {
+			if len(docs[index]) != len(seq) {
+				panic(fmt.Sprintf("разметка документов последовательности %d длины %d, а не %d",
+					index, len(docs[index]), len(seq)))
+			}
+			seqdocs = append(seqdocs, docs[index]...)
+		}
+	}
+
+	packed.indices, packed.pos, packed.lens, packed.docs = indices, pos, lens, seqdocs
+	if docs == nil {
+		seqdocs = nil
+	}
+
+	state.indices, state.pos = indices, pos
+	return llm.forward(state, llm.embedAt(&state.arena, indices, pos), lens, seqdocs, dropoutP)
+}
+
+func (llm *LLM) forward(state *State, input *mat.Dense, lens, docs []int, dropoutP float64) *mat.Dense {
+	alphaMHA, alphaMLP := llm.alphas()
+
+	if len(state.layers) != len(llm.Layers) {
+		state.layers = make([]LayerState, len(llm.Layers))
+	}
+
+	for index, layer := range llm.Layers {
+		input = layer.ForwardWith(&state.layers[index], input, lens, state.pos, docs,
+			alphaMHA, alphaMLP, dropoutP, llm.RNG)
+	}
+
+	state.last = input
+
+	return llm.logits(&state.arena, input)
+}
+
+/*
+Infer возвращает логиты, как Forward без dropout, но ничего не сохраняет
+для Backward и не меняет модель, поэтому может вызываться одновременно
+из нескольких горутин. Модель при этом нельзя обучать или менять.
+*/
+func (llm *LLM) Infer(indices []int) *mat.Dense {
+	input := llm.embed(nil, indices)
+	alphaMHA, alphaMLP := llm.alphas()
 
 	for _, layer := range llm.Layers {
-		input = *layer.Forward(&input, alphaMHA, alphaMLP, dropoutP)
+		input = layer.Infer(input, alphaMHA, alphaMLP)
+	}
+
+	return llm.logits(nil, input)
+}
+
+/*
+InferBatch возвращает логиты, как ForwardBatch без dropout, но не меняет
+модель, поэтому может вызываться одновременно из нескольких горутин.
+*/
+func (llm *LLM) InferBatch(batch [][]int) *mat.Dense {
+	return llm.ForwardBatchWith(new(State), batch, nil, 0)
+}
+
+func (llm *LLM) embed(arena *lib.Arena, indices []int) *mat.Dense {
+	embeds := arena.Get(len(indices), lib.Coln(llm.Embeds))
+	for index, embindex := range indices {
+		embeds.SetRow(index, llm.Embeds.RawRowView(embindex))
 	}
 
-	var output mat.Dense
-	output.Mul(&input, llm.Embeds.T())
-	lib.Softmax(&output, &output)
+	lib.Add(embeds, embeds, llm.Pos)
+	return embeds
+}
 
-	llm.last = &input
-	llm.indices = indices
+func (llm *LLM) alphas() (alphaMHA, alphaMLP float64) {
+	return math.Pow(2*float64(len(llm.Layers)), -.25),
+		math.Pow(8*float64(len(llm.Layers)), -.25)
+}
 
-	return &output
+func (llm *LLM) logits(arena *lib.Arena, input *mat.Dense) *mat.Dense {
+	output := arena.Get(lib.Rown(input), lib.Rown(llm.head()))
+	lib.MulT(output, input, llm.head())
+	if llm.Unembed != nil {
+		lib.AddRow(output, llm.UnembedBias.RawRowView(0))
+	}
+	return output
+}
+
+func (llm *LLM) head() *mat.Dense {
+	if llm.Unembed != nil {
+		return llm.Unembed
+	}
+	return llm.Embeds
 }
 
 func (llm *LLM) Backward(output *mat.Dense, lr float64) {
-	var layer mat.Dense
-	layer.Mul(output, llm.Embeds)
+	llm.mut.Lock()
+	state := llm.state
+	llm.mut.Unlock()
+
+	llm.BackwardWith(state, output, lr)
+}
+
+/*
+BackwardWith аналогичен Backward для активаций state. Обновляет веса,
+поэтому не может выполняться одновременно с другими вызовами модели.
+*/
+func (llm *LLM) BackwardWith(state *State, output *mat.Dense, lr float64) {
+	arena := &state.arena
+
+	layer := arena.Get(lib.Rown(output), lib.Coln(llm.Embeds))
+	lib.Mul(layer, output, llm.head())
 
 	alphaMHA := math.Pow(2*float64(len(llm.Layers)), -.25)
 	alphaMLP := math.Pow(8*float64(len(llm.Layers)), -.25)
 
 	for index := len(llm.Layers) - 1; index >= 0; index-- {
-		layer = *llm.Layers[index].
-			Backward(&layer, alphaMHA, alphaMLP, lr)
+		layer = llm.Layers[index].
+			BackwardWith(&state.layers[index], layer, alphaMHA, alphaMLP, lr)
 	}
 
-	var embeds mat.Dense
-	embeds.Mul(llm.last.T(), output)
-	embedsT := mat.DenseCopyOf(embeds.T())
+	embedsT := arena.Get(lib.Rown(llm.Embeds), lib.Coln(llm.Embeds))
+	lib.TMul(embedsT, output, state.last)
+
+	if llm.Unembed != nil {
+		bias := arena.Get(1, lib.Coln(output))
+		for row := range lib.Rown(output) {
+			floats.Add(bias.RawRowView(0), output.RawRowView(row))
+		}
 
-	for index, embindex := range llm.indices {
+		llm.params.Step(llm.UnembedBias, bias, lr)
+		llm.params.Step(llm.Unembed, embedsT, lr)
+
+		embedsT = arena.Get(lib.Rown(llm.Embeds), lib.Coln(llm.Embeds))
+	}
+
+	for index, embindex := range state.indices {
 		emb := embedsT.RawRowView(embindex)
 		lay := layer.RawRowView(index)
 
@@ -138,14 +605,39 @@ func (llm *LLM) Backward(output *mat.Dense, lr float64) {
 		}
 	}
 
-	lib.Step(llm.Pos, &layer, lr)
-	lib.Step(llm.Embeds, embedsT, lr)
+	pos := layer
+	if state.pos != nil {
+		pos = arena.Get(lib.Rown(llm.Pos), lib.Coln(llm.Pos))
+		lib.ScatterAdd(pos, layer, state.pos)
+	}
+
+	llm.params.Step(llm.Pos, pos, lr)
+	llm.params.Step(llm.Embeds, embedsT, lr)
+}
+
+/*
+Untie заменяет общую с Embeds выходную проекцию отдельной матрицей
+Unembed, равной Embeds, и нулевым смещением. Выход модели не меняется.
+*/
+func (llm *LLM) Untie() {
+	if llm.Unembed != nil {
+		return
+	}
+
+	llm.Unembed = mat.DenseCopyOf(llm.Embeds)
+	llm.UnembedBias = mat.NewDense(1, lib.Rown(llm.Embeds), nil)
+	llm.applyRules()
 }
 
 func (llm *LLM) ParamN() int {
 	sum := lib.ParamN(llm.Embeds) +
 		lib.ParamN(llm.Pos)
 
+	if llm.Unembed != nil {
+		sum += lib.ParamN(llm.Unembed) +
+			lib.ParamN(llm.UnembedBias)
+	}
+
 	for _, layer := range llm.Layers {
 		sum += layer.ParamN()
 	}
@@ -153,19 +645,125 @@ func (llm *LLM) ParamN() int {
 	return sum
 }
 
+/*
+ActiveParamN возвращает число параметров, участвующих в вычислении
+одного токена: у слоев MoE учитываются только TopK экспертов.
+*/
+func (llm *LLM) ActiveParamN() int {
+	sum := llm.ParamN()
+
+	for _, layer := range llm.Layers {
+		sum += layer.ActiveParamN() - layer.ParamN()
+	}
+
+	return sum
+}
+
+// Aux возвращает сумму вспомогательных ошибок слоев MoE последнего вызова Forward.
+func (llm *LLM) Aux() float64 {
+	llm.mut.Lock()
+	defer llm.mut.Unlock()
+
+	if llm.state == nil {
+		return 0
+	}
+
+	return llm.state.Aux()
+}
+
+type Config struct {
+	CtxSize,
+	Vocab,
+	Dim,
+	Layers,
+	Heads int
+	// Untied создает отдельную выходную проекцию вместо Embeds.
+	Untied bool
+	// Hidden - ширина скрытого слоя MLP, 0 означает 4·Dim.
+	Hidden int
+	Act    lib.Act
+	// Gated создает MLP с затвором, см. mlp.MLP.
+	Gated bool
+	/*
+		Experts - число экспертов MoE вместо MLP, 0 отключает MoE.
+		TopK, Capacity и Balance - см. moe.MoE.
+	*/
+	Experts,
+	TopK int
+	Capacity,
+	Balance float64
+	// Seed задает начальное состояние LLM.RNG.
+	Seed uint64
+}
+
+func (cfg Config) layer(rng *lib.RNG) *Layer {
+	hidden := cfg.Hidden
+	if hidden == 0 {
+		hidden = 4 * cfg.Dim
+	}
+
+	newMLP := func() *mlp.MLP {
+		res := mlp.New(rng, cfg.CtxSize, cfg.Dim, hidden, cfg.Dim)
+		if cfg.Gated {
+			res = mlp.NewGated(rng, cfg.CtxSize, cfg.Dim, hidden, cfg.Act)
+		}
+		res.Act = cfg.Act
+		return res
+	}
+
+	layer := &Layer{MHA: mha.New(rng, cfg.Heads, cfg.Dim, cfg.Dim/cfg.Heads)}
+
+	if cfg.Experts == 0 {
+		layer.MLP = newMLP()
+		return layer
+	}
+
+	layer.MoE = moe.New(rng, cfg.CtxSize, cfg.Dim, hidden, cfg.Experts, cfg.TopK)
+	layer.MoE.Capacity, layer.MoE.Balance = cfg.Capacity, cfg.Balance
+
+	for index := range layer.MoE.Experts {
+		layer.MoE.Experts[index] = newMLP()
+	}
+
+	return layer
+}
+
 func New(ctxsize, embrown, embcoln, l, h int) *LLM {
-	layers := make([]*Layer, l)
+	return NewWith(Config{
+		CtxSize: ctxsize,
+		Vocab:   embrown,
+		Dim:     embcoln,
+		Layers:  l,
+		Heads:   h,
+	})
+}
 
-	for index := range l {
-		layers[index] = NewLayer(h, ctxsize, embcoln, embcoln/h)
+/*
+NewWith создает модель по cfg. Модели с одинаковыми cfg совпадают,
+включая последующий dropout.
+*/
+func NewWith(cfg Config) *LLM {
+	rng := lib.NewRNG(cfg.Seed)
+	layers := make([]*Layer, cfg.Layers)
+
+	for index := range cfg.Layers {
+		layers[index] = cfg.layer(rng)
 	}
 
-	return &LLM{
-		Embeds:  lib.Xavier(embrown, embcoln),
-		Pos:     lib.Xavier(ctxsize, embcoln),
+	llm := &LLM{
+		Embeds:  lib.Xavier(rng, cfg.Vocab, cfg.Dim),
+		Pos:     lib.Xavier(rng, cfg.CtxSize, cfg.Dim),
 		Layers:  layers,
-		CtxSize: ctxsize,
+		CtxSize: cfg.CtxSize,
+		RNG:     rng,
 	}
+
+	if cfg.Untied {
+		llm.Unembed = lib.Xavier(rng, cfg.Vocab, cfg.Dim)
+		llm.UnembedBias = mat.NewDense(1, cfg.Vocab, nil)
+	}
+
+	return llm
 }
 
 func Load(src string) *LLM {
@@ -184,6 +782,13 @@ func Load(src string) *LLM {
 		panic(err)
 	}
 
+	// в старых чекпоинтах RNG нет
+	if llm.RNG == nil {
+		llm.RNG = lib.NewRNG(0)
+	}
+
+	llm.applyRules()
+
 	return &llm
 }
 
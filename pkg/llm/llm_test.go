@@ -3,9 +3,13 @@ package llm
 import (
 	"gonum.org/v1/gonum/floats"
 	"gonum.org/v1/gonum/mat"
+	"llm/pkg/backend"
+	"llm/pkg/gradcheck"
 	"llm/pkg/lib"
 	"llm/pkg/mha"
 	"llm/pkg/mlp"
+	"reflect"
+	"sync"
 	"testing"
 )
 
@@ -80,7 +84,7 @@ func Test_Layer_Forward(t *testing.T) {
 	}
 
 	for i, test := range tests {
-		output := test.layer.Forward(test.input, test.alphaMHA, test.alphaMLP, 0)
+		output := test.layer.Forward(test.input, test.alphaMHA, test.alphaMLP, 0, nil)
 
 		for row := range lib.Rown(test.output) {
 			grow := output.RawRowView(row)
@@ -122,7 +126,7 @@ func Test_Layer_Backward(t *testing.T) {
 	}
 
 	for i, test := range tests {
-		test.layer.Forward(test.input, test.alphaMHA, test.alphaMLP, 0)
+		test.layer.Forward(test.input, test.alphaMHA, test.alphaMLP, 0, nil)
 		output := test.layer.Backward(test.output, test.alphaMHA, test.alphaMLP, 1)
 
 		for row := range lib.Rown(test.grad) {
@@ -165,6 +169,7 @@ func Test_Forward(t *testing.T) {
 
 	for i, test := range tests {
 		output := test.llm.Forward(test.input, 0)
+		lib.Softmax(output, output)
 
 		for row := range lib.Rown(test.output) {
 			grow := output.RawRowView(row)
@@ -176,3 +181,646 @@ func Test_Forward(t *testing.T) {
 		}
 	}
 }
+
+func Test_Untie(t *testing.T) {
+	llm := New(4, 6, 4, 1, 2)
+	input := []int{0, 1, 2, 3}
+
+	before := mat.DenseCopyOf(llm.Forward(input, 0))
+	n := llm.ParamN()
+
+	llm.Untie()
+
+	if !mat.EqualApprox(before, llm.Forward(input, 0), 1e-12) {
+		t.Errorf("output changed after untie")
+	}
+
+	if llm.ParamN() != n+6*4+6 {
+		t.Errorf("expected %d params, got %d", n+6*4+6, llm.ParamN())
+	}
+
+	embeds := mat.DenseCopyOf(llm.Embeds)
+	unembed := mat.DenseCopyOf(llm.Unembed)
+
+	output := llm.Forward(input, 0)
+	llm.Backward(output, .1)
+
+	if mat.Equal(unembed, llm.Unembed) {
+		t.Errorf("unembed not updated")
+	}
+
+	for _, row := range []int{4, 5} {
+		if !floats.Equal(embeds.RawRowView(row), llm.Embeds.RawRowView(row)) {
+			t.Errorf("%d: unused embedding updated", row)
+		}
+	}
+}
+
+func Test_Backward_Untied(t *testing.T) {
+	llm := NewWith(Config{CtxSize: 3, Vocab: 5, Dim: 4, Layers: 1, Heads: 2, Untied: true})
+	input := []int{0, 3, 1}
+	target := []int{1, 2, 4}
+
+	// loss - суммарная перекрестная энтропия.
+	loss := func() float64 {
+		output := llm.Forward(input, 0)
+		lib.LogSoftmax(output, output)
+
+		var sum float64
+		for row, ind := range target {
+			sum -= output.At(row, ind)
+		}
+		return sum
+	}
+
+	const eps = 1e-6
+
+	for _, w := range []*mat.Dense{llm.Unembed, llm.UnembedBias} {
+		expected := mat.NewDense(lib.Rown(w), lib.Coln(w), nil)
+
+		for row := range lib.Rown(w) {
+			for col := range lib.Coln(w) {
+				val := w.At(row, col)
+
+				w.Set(row, col, val+eps)
+				plus := loss()
+				w.Set(row, col, val-eps)
+				minus := loss()
+				w.Set(row, col, val)
+
+				expected.Set(row, col, (plus-minus)/(2*eps))
+			}
+		}
+
+		before := mat.DenseCopyOf(w)
+
+		output := llm.Forward(input, 0)
+		lib.SparseCrossEntropy(output, target, 0, 0)
+
+		// шаг с lr 1 равен градиенту, после проверки параметры восстанавливаются.
+		copies := make(map[string]*mat.Dense)
+		for name, p := range llm.Params() {
+			copies[name] = mat.DenseCopyOf(p)
+		}
+
+		llm.Backward(output, 1)
+
+		var grad mat.Dense
+		grad.Sub(before, w)
+
+		if !mat.EqualApprox(&grad, expected, 1e-4) {
+			t.Errorf("expected %v, got %v", mat.Formatted(expected), mat.Formatted(&grad))
+		}
+
+		for name, p := range llm.Params() {
+			p.Copy(copies[name])
+		}
+	}
+}
+
+func Test_NewWith(t *testing.T) {
+	tests := []struct {
+		cfg Config
+	}{
+		{
+			cfg: Config{CtxSize: 2, Vocab: 5, Dim: 4, Layers: 1, Heads: 2},
+		},
+		{
+			cfg: Config{CtxSize: 2, Vocab: 5, Dim: 4, Layers: 1, Heads: 2, Hidden: 6, Act: lib.ActGelu},
+		},
+		{
+			cfg: Config{CtxSize: 2, Vocab: 5, Dim: 4, Layers: 1, Heads: 2, Hidden: 6, Act: lib.ActSilu, Gated: true},
+		},
+	}
+
+	for i, test := range tests {
+		llm := NewWith(test.cfg)
+
+		hidden := test.cfg.Hidden
+		if hidden == 0 {
+			hidden = 4 * test.cfg.Dim
+		}
+
+		mlp := llm.Layers[0].MLP
+		if lib.Coln(mlp.Layers[0].Weights) != hidden || mlp.Act != test.cfg.Act {
+			t.Errorf("%d: expected hidden %d, got %d", i, hidden, lib.Coln(mlp.Layers[0].Weights))
+		}
+
+		if (mlp.Gate != nil) != test.cfg.Gated {
+			t.Errorf("%d: expected gated %v", i, test.cfg.Gated)
+		}
+
+		_, ok := llm.Params()["Layers.0.MLP.Gate.Weights"]
+		if ok != test.cfg.Gated {
+			t.Errorf("%d: expected gate param %v", i, test.cfg.Gated)
+		}
+
+		output := llm.Forward([]int{1, 2}, 0)
+		llm.Backward(output, .1)
+
+		if floats.HasNaN(llm.Embeds.RawMatrix().Data) {
+			t.Errorf("%d: NaN after backward", i)
+		}
+	}
+}
+
+func Test_NewWith_MoE(t *testing.T) {
+	llm := NewWith(Config{
+		CtxSize: 2, Vocab: 5, Dim: 4, Layers: 2, Heads: 2, Hidden: 6,
+		Experts: 4, TopK: 2, Balance: .01,
+	})
+
+	dense := NewWith(Config{CtxSize: 2, Vocab: 5, Dim: 4, Layers: 2, Heads: 2, Hidden: 6})
+	expert := dense.Layers[0].MLP.ParamN()
+	router := 4 * 4
+
+	if llm.ParamN() != dense.ParamN()+2*(router+3*expert) {
+		t.Errorf("expected %d params, got %d", dense.ParamN()+2*(router+3*expert), llm.ParamN())
+	}
+
+	if llm.ActiveParamN() != dense.ParamN()+2*(router+expert) {
+		t.Errorf("expected %d active params, got %d", dense.ParamN()+2*(router+expert), llm.ActiveParamN())
+	}
+
+	params := llm.Params()
+	for _, name := range []string{"Layers.1.MoE.Router", "Layers.1.MoE.Experts.3.Layers.1.Bias"} {
+		if _, ok := params[name]; !ok {
+			t.Errorf("param %s not found", name)
+		}
+	}
+
+	output := llm.Forward([]int{1, 2}, 0)
+	if llm.Aux() <= 0 {
+		t.Errorf("expected positive aux loss, got %v", llm.Aux())
+	}
+	llm.Backward(output, .1)
+}
+
+func Test_Gradcheck(t *testing.T) {
+	cfgs := []Config{
+		{CtxSize: 3, Vocab: 5, Dim: 4, Layers: 2, Heads: 2, Hidden: 6},
+		{CtxSize: 3, Vocab: 5, Dim: 4, Layers: 1, Heads: 2, Hidden: 6, Untied: true, Gated: true, Act: lib.ActGelu},
+		{CtxSize: 3, Vocab: 5, Dim: 4, Layers: 1, Heads: 2, Hidden: 6, Experts: 3, TopK: 2},
+	}
+
+	for i, cfg := range cfgs {
+		llm := NewWith(cfg)
+		input := []int{0, 3, 1}
+
+		results := gradcheck.CheckFunc(
+			func() *mat.Dense { return llm.Forward(input, 0) },
+			func(output *mat.Dense, lr float64) *mat.Dense {
+				llm.Backward(output, lr)
+				return nil
+			},
+			nil, llm.Params())
+
+		for _, res := range gradcheck.Failed(results, gradcheck.Tolerance) {
+			t.Errorf("%d: %v", i, res)
+		}
+	}
+
+	layer := NewWith(cfgs[0]).Layers[0]
+	input := lib.Xavier(lib.NewRNG(1), 3, 4)
+
+	params := make(map[string]*mat.Dense)
+	for _, param := range (&LLM{Layers: []*Layer{layer}}).named() {
+		if param.w != nil {
+			params[param.name] = param.w
+		}
+	}
+
+	results := gradcheck.CheckFunc(
+		func() *mat.Dense { return layer.Forward(input, .46, .31, 0, nil) },
+		func(output *mat.Dense, lr float64) *mat.Dense {
+			return layer.Backward(output, .46, .31, lr)
+		},
+		input, params)
+
+	for _, res := range gradcheck.Failed(results, gradcheck.Tolerance) {
+		t.Errorf("layer: %v", res)
+	}
+}
+
+func Test_Infer(t *testing.T) {
+	cfgs := []Config{
+		{CtxSize: 3, Vocab: 5, Dim: 4, Layers: 2, Heads: 2},
+		{CtxSize: 3, Vocab: 5, Dim: 4, Layers: 1, Heads: 2, Untied: true, Gated: true, Act: lib.ActSilu},
+		{CtxSize: 3, Vocab: 5, Dim: 4, Layers: 1, Heads: 2, Experts: 3, TopK: 2, Capacity: 1},
+	}
+
+	inputs := [][]int{{0, 3, 1}, {4, 4, 2}, {1, 2, 3}}
+
+	for i, cfg := range cfgs {
+		llm := NewWith(cfg)
+		llm.Attach(llm.NewLoRA(2, 4))
+
+		expected := make([]*mat.Dense, len(inputs))
+		for index, input := range inputs {
+			expected[index] = mat.DenseCopyOf(llm.Forward(input, 0))
+		}
+
+		// Infer между Forward и Backward не должен влиять на обучение.
+		twin := NewWith(cfg)
+		twin.Attach(twin.NewLoRA(2, 4))
+
+		output := llm.Forward(inputs[0], 0)
+		llm.Infer(inputs[1])
+		llm.Backward(output, .1)
+		twin.Backward(twin.Forward(inputs[0], 0), .1)
+
+		for name, w := range twin.Params() {
+			if !mat.Equal(w, llm.Params()[name]) {
+				t.Errorf("%d: %s differs after Infer", i, name)
+			}
+		}
+
+		for index, input := range inputs {
+			expected[index] = mat.DenseCopyOf(llm.Forward(input, 0))
+		}
+
+		var wg sync.WaitGroup
+		for range 8 {
+			for index, input := range inputs {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+
+					if !mat.EqualApprox(expected[index], llm.Infer(input), 1e-12) {
+						t.Errorf("%d %d: Infer differs from Forward", i, index)
+					}
+				}()
+			}
+		}
+		wg.Wait()
+	}
+}
+
+func Test_ForwardWith(t *testing.T) {
+	cfgs := []Config{
+		{CtxSize: 3, Vocab: 5, Dim: 4, Layers: 2, Heads: 2},
+		{CtxSize: 3, Vocab: 5, Dim: 4, Layers: 1, Heads: 2, Untied: true, Gated: true, Act: lib.ActSilu},
+		{CtxSize: 3, Vocab: 5, Dim: 4, Layers: 1, Heads: 2, Experts: 3, TopK: 2, Capacity: 1, Balance: .01},
+	}
+
+	inputs := [][]int{{0, 3, 1}, {4, 4, 2}, {1, 2, 3}}
+	docs := []int{0, 0, 1}
+
+	for i, cfg := range cfgs {
+		llm := NewWith(cfg)
+		llm.Attach(llm.NewLoRA(2, 4))
+
+		expected := make([]*mat.Dense, len(inputs))
+		for index, input := range inputs {
+			expected[index] = mat.DenseCopyOf(llm.ForwardDocs(input, docs, 0))
+		}
+
+		states := make([][]State, 8)
+
+		var wg sync.WaitGroup
+		for run := range states {
+			states[run] = make([]State, len(inputs))
+
+			for index, input := range inputs {
+				wg.Add(2)
+				go func() {
+					defer wg.Done()
+
+					output := llm.ForwardWith(&states[run][index], input, docs, 0)
+					if !mat.Equal(expected[index], output) {
+						t.Errorf("%d %d: ForwardWith differs from ForwardDocs", i, index)
+					}
+				}()
+
+				// dropout делит RNG модели между вызовами
+				go func() {
+					defer wg.Done()
+					llm.Forward(input, .1)
+				}()
+			}
+		}
+		wg.Wait()
+
+		// Backward по сохраненному состоянию совпадает с обычным обучением.
+		twin := NewWith(cfg)
+		twin.Attach(twin.NewLoRA(2, 4))
+		twin.Backward(twin.ForwardDocs(inputs[1], docs, 0), .1)
+
+		llm.BackwardWith(&states[3][1], mat.DenseCopyOf(expected[1]), .1)
+
+		for name, w := range twin.Params() {
+			if !mat.EqualApprox(w, llm.Params()[name], 1e-12) {
+				t.Errorf("%d: %s differs after BackwardWith", i, name)
+			}
+		}
+
+		if cfg.Experts != 0 && states[3][1].Aux() == 0 {
+			t.Errorf("%d: expected nonzero aux", i)
+		}
+	}
+}
+
+/*
+batchConfigs - плотная, gated и MoE модели для тестов пакетов,
+batchSeqs - пакет последовательностей разной длины, batchSeqDocs - их документы.
+*/
+var (
+	batchConfigs = []Config{
+		{CtxSize: 4, Vocab: 7, Dim: 4, Layers: 2, Heads: 2, Seed: 1},
+		{CtxSize: 4, Vocab: 7, Dim: 4, Layers: 1, Heads: 2, Seed: 2, Untied: true, Gated: true, Act: lib.ActSilu},
+		{CtxSize: 4, Vocab: 7, Dim: 4, Layers: 2, Heads: 2, Seed: 3, Experts: 3, TopK: 2, Capacity: 1, Balance: .01},
+	}
+	batchSeqs    = [][]int{{1, 2, 3, 4}, {6, 5}, {0, 0, 1}}
+	batchSeqDocs = [][]int{{0, 0, 1, 1}, nil, {3, 4, 4}}
+)
+
+func Test_ForwardBatch(t *testing.T) {
+	cfgs := []Config{
+		{CtxSize: 4, Vocab: 7, Dim: 4, Layers: 2, Heads: 2},
+		{CtxSize: 4, Vocab: 7, Dim: 4, Layers: 1, Heads: 2, Untied: true, Gated: true, Act: lib.ActSilu},
+		{CtxSize: 4, Vocab: 7, Dim: 4, Layers: 2, Heads: 2, Experts: 3, TopK: 2, Capacity: .5},
+	}
+
+	batch, docs := batchSeqs, batchSeqDocs
+
+	// window дополняет последовательность до окна токенами, не влияющими на ее строки.
+	window := func(seq []int, size int) []int {
+		return append(append([]int(nil), seq...), make([]int, size-len(seq))...)
+	}
+
+	for i, cfg := range cfgs {
+		llm := NewWith(cfg)
+
+		if !mat.Equal(llm.ForwardBatch(batch, nil, 0), llm.InferBatch(batch)) {
+			t.Errorf("%d: InferBatch differs from ForwardBatch", i)
+		}
+
+		output := llm.ForwardBatch(batch, docs, 0)
+
+		grad := lib.Xavier(lib.NewRNG(7), lib.Rown(output), lib.Coln(output))
+		params := llm.Params()
+
+		// градиент пакета равен сумме градиентов последовательностей
+		expected := make(map[string]*mat.Dense)
+		for name, w := range params {
+			expected[name] = mat.NewDense(lib.Rown(w), lib.Coln(w), nil)
+		}
+
+		var start int
+		for index, seq := range batch {
+			var seqdocs []int
+			if docs[index] != nil {
+				seqdocs = window(docs[index], cfg.CtxSize)
+			}
+
+			logits := llm.ForwardDocs(window(seq, cfg.CtxSize), seqdocs, 0)
+			rows := logits.Slice(0, len(seq), 0, cfg.Vocab)
+
+			if !mat.EqualApprox(output.Slice(start, start+len(seq), 0, cfg.Vocab), rows, 1e-12) {
+				t.Errorf("%d %d: ForwardBatch differs from ForwardDocs", i, index)
+			}
+
+			seqgrad := mat.NewDense(cfg.CtxSize, cfg.Vocab, nil)
+			seqgrad.Slice(0, len(seq), 0, cfg.Vocab).(*mat.Dense).
+				Copy(grad.Slice(start, start+len(seq), 0, cfg.Vocab))
+
+			before := clone(params)
+			llm.Backward(seqgrad, 1)
+
+			for name, w := range params {
+				var diff mat.Dense
+				diff.Sub(before[name], w)
+				expected[name].Add(expected[name], &diff)
+				w.Copy(before[name])
+			}
+
+			start += len(seq)
+		}
+
+		before := clone(params)
+		llm.ForwardBatch(batch, docs, 0)
+		llm.Backward(grad, 1)
+
+		for name, w := range params {
+			var diff mat.Dense
+			diff.Sub(before[name], w)
+
+			if !mat.EqualApprox(expected[name], &diff, 1e-10) {
+				t.Errorf("%d: %s gradient differs", i, name)
+			}
+		}
+	}
+}
+
+func clone(params map[string]*mat.Dense) map[string]*mat.Dense {
+	res := make(map[string]*mat.Dense, len(params))
+	for name, w := range params {
+		res[name] = mat.DenseCopyOf(w)
+	}
+	return res
+}
+
+func Test_Checkpoint(t *testing.T) {
+	batch, docs := batchSeqs, batchSeqDocs
+
+	// checkpoints - слои с Checkpoint.
+	checkpoints := [][]int{{0}, {1}, {0, 1}}
+
+	for i, cfg := range batchConfigs {
+		cfg.Layers = 2 // checkpoints ссылаются на оба слоя
+
+		for j, layers := range checkpoints {
+			expected, llm := NewWith(cfg), NewWith(cfg)
+			for _, index := range layers {
+				llm.Layers[index].Checkpoint = true
+			}
+
+			for step := range 3 {
+				var state State
+
+				want := expected.ForwardBatch(batch, docs, .2)
+				got := llm.ForwardBatchWith(&state, batch, docs, .2)
+
+				if !mat.Equal(want, got) {
+					t.Errorf("%d %d %d: logits differ", i, j, step)
+				}
+
+				if expected.Aux() != state.Aux() {
+					t.Errorf("%d %d %d: expected aux %v, got %v", i, j, step, expected.Aux(), state.Aux())
+				}
+
+				for _, index := range layers {
+					layer := state.layers[index]
+					kept := !reflect.ValueOf(layer.mha).IsZero() ||
+						!reflect.ValueOf(layer.mlp).IsZero() ||
+						!reflect.ValueOf(layer.moe).IsZero()
+
+					if kept || layer.checkpoint == nil {
+						t.Errorf("%d %d %d: layer %d keeps activations", i, j, step, index)
+					}
+				}
+
+				grad := lib.Xavier(lib.NewRNG(uint64(step)), lib.Rown(want), lib.Coln(want))
+				expected.Backward(mat.DenseCopyOf(grad), .1)
+				llm.BackwardWith(&state, grad, .1)
+
+				for name, w := range expected.Params() {
+					if !mat.Equal(w, llm.Params()[name]) {
+						t.Errorf("%d %d %d: %s differs", i, j, step, name)
+					}
+				}
+			}
+		}
+	}
+}
+
+func Test_ForwardBatch_Docs(t *testing.T) {
+	llm := NewWith(Config{CtxSize: 4, Vocab: 7, Dim: 4, Layers: 1, Heads: 2})
+	batch := [][]int{{1, 2, 3}, {6, 5}}
+
+	tests := [][][]int{
+		{{0, 0, 1}, {2}},
+		{{0, 0}, {1, 1}},
+		{{0, 0, 1}},
+	}
+
+	for i, docs := range tests {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%d: expected panic on mismatched docs", i)
+				}
+			}()
+
+			llm.ForwardBatch(batch, docs, 0)
+		}()
+	}
+}
+
+func Test_State_Reuse(t *testing.T) {
+	// пакеты разного размера, чтобы память переиспользовалась под другие матрицы
+	batches := []struct {
+		batch,
+		docs [][]int
+	}{
+		{batch: batchSeqs, docs: batchSeqDocs},
+		{batch: [][]int{{2}, {5, 4, 3}}},
+		{batch: batchSeqs, docs: batchSeqDocs},
+		{batch: [][]int{{1, 2, 3, 4}, {6, 5, 4, 3}, {3, 3}, {1}}},
+	}
+
+	for i, cfg := range batchConfigs {
+		expected, llm := NewWith(cfg), NewWith(cfg)
+
+		var state State
+		for step, test := range batches {
+			want := expected.ForwardBatch(test.batch, test.docs, .1)
+			got := llm.ForwardBatchWith(&state, test.batch, test.docs, .1)
+
+			if !mat.Equal(want, got) {
+				t.Errorf("%d %d: logits differ", i, step)
+			}
+
+			grad := lib.Xavier(lib.NewRNG(uint64(step)), lib.Rown(want), lib.Coln(want))
+			expected.Backward(mat.DenseCopyOf(grad), .1)
+			llm.BackwardWith(&state, grad, .1)
+
+			for name, w := range expected.Params() {
+				if !mat.Equal(w, llm.Params()[name]) {
+					t.Errorf("%d %d: %s differs", i, step, name)
+				}
+			}
+		}
+	}
+}
+
+// Test_Backend - модель на каждой реализации backend совпадает с gonum до ошибок округления.
+func Test_Backend(t *testing.T) {
+	defer backend.Set(backend.Current())
+
+	batch, docs := batchSeqs, batchSeqDocs
+
+	for _, name := range backend.Names() {
+		for i, cfg := range batchConfigs {
+			expected, llm := NewWith(cfg), NewWith(cfg)
+
+			backend.Use("gonum")
+			want := expected.ForwardBatch(batch, docs, .1)
+			grad := lib.Xavier(lib.NewRNG(1), lib.Rown(want), lib.Coln(want))
+			expected.Backward(mat.DenseCopyOf(grad), .1)
+
+			backend.Use(name)
+			got := llm.ForwardBatch(batch, docs, .1)
+			llm.Backward(grad, .1)
+
+			if !mat.EqualApprox(want, got, 1e-12) {
+				t.Errorf("%s %d: logits differ", name, i)
+			}
+
+			for param, w := range expected.Params() {
+				if !mat.EqualApprox(w, llm.Params()[param], 1e-12) {
+					t.Errorf("%s %d: %s differs", name, i, param)
+				}
+			}
+		}
+	}
+}
+
+// Benchmark_TrainStep - шаг обучения пакета окон с одним и тем же State.
+func Benchmark_TrainStep(b *testing.B) {
+	llm := NewWith(benchConfig)
+	rng := lib.NewRNG(2)
+
+	batch := make([][]int, 4)
+	var targets []int
+	for index := range batch {
+		batch[index] = make([]int, benchConfig.CtxSize)
+		for pos := range batch[index] {
+			batch[index][pos] = int(rng.Uint64() % uint64(benchConfig.Vocab))
+			targets = append(targets, int(rng.Uint64()%uint64(benchConfig.Vocab)))
+		}
+	}
+
+	var state State
+
+	b.ReportAllocs()
+	for range b.N {
+		output := llm.ForwardBatchWith(&state, batch, nil, .1)
+		lib.SparseCrossEntropy(output, targets, 0, 0)
+		llm.BackwardWith(&state, output, .01)
+	}
+}
+
+/*
+Test_TrainStep_Allocs - шаг обучения с повторно используемым State
+выделяет память только под замыкания слоев и маршрутизацию MoE,
+число выделений не зависит от числа строк и голов.
+*/
+func Test_TrainStep_Allocs(t *testing.T) {
+	defer backend.Set(backend.Current())
+	backend.Use("gonum")
+
+	// bounds[i] - наибольшее число выделений шага batchConfigs[i]
+	bounds := []float64{6, 3, 30}
+
+	batch, docs := batchSeqs, batchSeqDocs
+
+	for i, cfg := range batchConfigs {
+		llm := NewWith(cfg)
+
+		var state State
+		output := llm.ForwardBatchWith(&state, batch, docs, .1)
+		grad := lib.Xavier(lib.NewRNG(1), lib.Rown(output), lib.Coln(output))
+		step := mat.DenseCopyOf(grad)
+
+		allocs := testing.AllocsPerRun(10, func() {
+			llm.ForwardBatchWith(&state, batch, docs, .1)
+			step.Copy(grad)
+			llm.BackwardWith(&state, step, .01)
+		})
+
+		if allocs > bounds[i] {
+			t.Errorf("%d: expected at most %v allocs, got %v", i, bounds[i], allocs)
+		}
+	}
+}
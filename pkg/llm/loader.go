@@ -0,0 +1,353 @@
+package llm
+
+import (
+	"encoding/gob"
+	"iter"
+	"llm/pkg/bpe"
+	"llm/pkg/dirreader"
+	"log"
+	"math/rand/v2"
+	"os"
+	"runtime"
+)
+
+/*
+Source - набор документов, которые загрузчик перемешивает и режет на окна.
+Doc возвращает индексы документа и маску позиций, на которых считается
+ошибка; nil маска означает все позиции. Doc может вызываться
+одновременно из нескольких горутин.
+*/
+type Source interface {
+	Len() int
+	Doc(index int) ([]int, []bool)
+}
+
+type fileSource struct {
+	files  []string
+	bpe    *bpe.BPE
+	reader *dirreader.Reader
+}
+
+func (src *fileSource) Len() int { return len(src.files) }
+
+func (src *fileSource) Doc(index int) ([]int, []bool) {
+	data, ok := src.reader.ReadFile(src.files[index])
+	if !ok {
+		return nil, nil
+	}
+
+	inds := src.bpe.GetTextInds(string(data))
+	return append(inds, src.bpe.GetInd(eot)), nil
+}
+
+/*
+FileSource токенизирует файлы каталога src, отобранные opts,
+добавляя eot в конец каждого. Отклоненные при чтении файлы пусты.
+Файлы архивов читаются через dirreader.Reader, хранящий
+до dirreader.DefaultLimit байт еще не прочитанных файлов.
+*/
+func FileSource(src string, bpe *bpe.BPE, opts dirreader.Options) Source {
+	return &fileSource{
+		files:  dirreader.FilesWith(src, opts),
+		bpe:    bpe,
+		reader: dirreader.NewReader(src, opts, dirreader.DefaultLimit),
+	}
+}
+
+/*
+Cursor - позиция загрузчика: эпоха и число примеров,
+выданных в ней. По курсору обучение продолжается с того же места.
+*/
+type Cursor struct {
+	Epoch,
+	Step int
+	/*
+		Doc и Offset - документ в порядке эпохи и позиция в нем, с которых
+		окна нарезаются заново, Window - номер первого из этих окон,
+		Next - номер следующего нового окна. Более ранние документы
+		при продолжении не читаются. Masked означает, что у документов
+		до Doc была маска, см. packed.
+	*/
+	Doc,
+	Offset,
+	Window,
+	Next int
+	Masked bool
+	// Buffer - номера окон в буфере перемешивания по порядку.
+	Buffer []int
+	/*
+		RNG - состояние генератора перемешивания. Курсор без него
+		продолжает обучение, заново проходя первые Step примеров эпохи.
+	*/
+	RNG []byte
+}
+
+func LoadCursor(src string) Cursor {
+	var cursor Cursor
+
+	file, err := os.Open(src)
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+
+	err = gob.
+		NewDecoder(file).
+		Decode(&cursor)
+	if err != nil {
+		panic(err)
+	}
+
+	return cursor
+}
+
+func (cursor Cursor) Save(trg string) {
+	file, err := os.Create(trg)
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+
+	err = gob.
+		NewEncoder(file).
+		Encode(cursor)
+	if err != nil {
+		panic(err)
+	}
+}
+
+type Loader struct {
+	source Source
+	winsize,
+	padind int
+	cfg TrainConfig
+}
+
+func NewLoader(source Source, winsize, padind int, cfg TrainConfig) *Loader {
+	return &Loader{
+		source:  source,
+		winsize: winsize,
+		padind:  padind,
+		cfg:     cfg,
+	}
+}
+
+/*
+All выдает примеры всех эпох, начиная с cfg.Cursor, вместе с курсором,
+указывающим на следующий пример. Порядок зависит только от cfg.Seed,
+поэтому при продолжении пропущенные примеры совпадают с уже выданными.
+*/
+func (loader *Loader) All() iter.Seq2[Cursor, example] {
+	return func(yield func(Cursor, example) bool) {
+		epochs := max(1, loader.cfg.Epochs)
+
+		for epoch := loader.cfg.Cursor.Epoch; epoch < epochs; epoch++ {
+			from := Cursor{Epoch: epoch}
+			if epoch == loader.cfg.Cursor.Epoch {
+				from = loader.cfg.Cursor
+			}
+
+			log.Printf("эпоха %d\n", epoch)
+
+			for cursor, exam := range loader.epoch(from) {
+				if !yield(cursor, exam) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// window - окно эпохи с номером id по порядку нарезки и началом at.
+type window struct {
+	exam example
+	id   int
+	at   origin
+}
+
+/*
+epoch выдает примеры эпохи from.Epoch после from: окна документов
+перемешиваются в пределах буфера из cfg.Buffer окон, Buffer меньше 2
+оставляет порядок без изменений. Заново нарезаются только документы
+от from.Doc, а из их окон остаются лишь бывшие в буфере и новые.
+*/
+func (loader *Loader) epoch(from Cursor) iter.Seq2[Cursor, example] {
+	return func(yield func(Cursor, example) bool) {
+		pcg := rand.NewPCG(loader.cfg.Seed, uint64(from.Epoch))
+		rng := rand.New(pcg)
+
+		order := make([]int, loader.source.Len())
+		for index := range order {
+			order[index] = index
+		}
+
+		if loader.cfg.Shuffle {
+			rng.Shuffle(len(order), func(i, j int) {
+				order[i], order[j] = order[j], order[i]
+			})
+		}
+
+		// курсор без состояния генератора продолжается пропуском примеров
+		var skip int
+		if from.RNG == nil {
+			skip, from = from.Step, Cursor{Epoch: from.Epoch}
+		} else if err := pcg.UnmarshalBinary(from.RNG); err != nil {
+			panic(err)
+		}
+
+		size := max(1, loader.cfg.Buffer)
+
+		// slots - места в буфере окон, выданных до from.Next
+		buf := make([]window, len(from.Buffer), size)
+		slots := make(map[int]int, len(from.Buffer))
+		for slot, id := range from.Buffer {
+			slots[id] = slot
+		}
+
+		var (
+			step = from.Step
+			next = from.Window
+			last origin
+		)
+
+		cursor := func() Cursor {
+			start, id := last, next-1
+			res := Cursor{Epoch: from.Epoch, Step: step, Next: next}
+
+			for _, win := range buf {
+				res.Buffer = append(res.Buffer, win.id)
+				if win.id < id {
+					start, id = win.at, win.id
+				}
+			}
+
+			res.Doc, res.Offset, res.Window, res.Masked = start.doc, start.off, id, start.masked
+
+			state, err := pcg.MarshalBinary()
+			if err != nil {
+				panic(err)
+			}
+			res.RNG = state
+
+			return res
+		}
+
+		pop := func() bool {
+			var index int
+			if size > 1 {
+				index = rng.IntN(len(buf))
+			}
+
+			exam := buf[index].exam
+			buf[index] = buf[len(buf)-1]
+			buf = buf[:len(buf)-1]
+
+			step++
+			return step <= skip || yield(cursor(), exam)
+		}
+
+		docs := Prefetch(loader.source, order[from.Doc:], loader.cfg.Workers)
+		start := origin{doc: from.Doc, off: from.Offset, masked: from.Masked}
+
+		for at, exam := range placed(docs, start, loader.winsize, loader.padind, loader.cfg) {
+			win := window{exam: exam, id: next, at: at}
+			next++
+			last = at
+
+			// окна до from.Next уже выданы или лежат в буфере
+			if win.id < from.Next {
+				if slot, ok := slots[win.id]; ok {
+					buf[slot] = win
+				}
+				continue
+			}
+
+			buf = append(buf, win)
+			if len(buf) < size {
+				continue
+			}
+
+			if !pop() {
+				return
+			}
+		}
+
+		for len(buf) != 0 {
+			if !pop() {
+				return
+			}
+		}
+	}
+}
+
+/*
+Prefetch получает документы source на workers горутинах заранее,
+сохраняя порядок order. nil order означает все документы по порядку,
+workers 0 - runtime.NumCPU().
+*/
+func Prefetch(source Source, order []int, workers int) iter.Seq2[[]int, []bool] {
+	return func(yield func([]int, []bool) bool) {
+		if order == nil {
+			order = make([]int, source.Len())
+			for index := range order {
+				order[index] = index
+			}
+		}
+
+		if workers <= 0 {
+			workers = runtime.NumCPU()
+		}
+
+		type doc struct {
+			inds []int
+			mask []bool
+		}
+
+		type job struct {
+			index int
+			res   chan doc
+		}
+
+		jobs := make(chan job)
+		queue := make(chan chan doc, 2*workers)
+		done := make(chan struct{})
+		defer close(done)
+
+		for range workers {
+			go func() {
+				for job := range jobs {
+					inds, mask := source.Doc(job.index)
+					job.res <- doc{inds: inds, mask: mask}
+				}
+			}()
+		}
+
+		go func() {
+			defer close(jobs)
+			defer close(queue)
+
+			for _, index := range order {
+				res := make(chan doc, 1)
+
+				select {
+				case queue <- res:
+				case <-done:
+					return
+				}
+
+				select {
+				case jobs <- job{index: index, res: res}:
+				case <-done:
+					return
+				}
+			}
+		}()
+
+		for res := range queue {
+			doc := <-res
+			if !yield(doc.inds, doc.mask) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package llm
+
+import (
+	"reflect"
+	"slices"
+	"sync/atomic"
+	"testing"
+)
+
+type sliceSource [][]int
+
+func (src sliceSource) Len() int { return len(src) }
+
+func (src sliceSource) Doc(index int) ([]int, []bool) {
+	return slices.Clone(src[index]), nil
+}
+
+var source = func() sliceSource {
+	docs := make(sliceSource, 16)
+
+	for index := range docs {
+		for j := range 5 + index%3 {
+			docs[index] = append(docs[index], index*10+j)
+		}
+	}
+
+	return docs
+}()
+
+func collect(loader *Loader) ([]Cursor, []example) {
+	var (
+		cursors []Cursor
+		exams   []example
+	)
+
+	for cursor, exam := range loader.All() {
+		cursors = append(cursors, cursor)
+		exams = append(exams, exam)
+	}
+
+	return cursors, exams
+}
+
+func Test_Loader_All(t *testing.T) {
+	const padind = 999
+
+	plain := TrainConfig{Workers: 1}
+	_, expected := collect(NewLoader(source, 4, padind, plain))
+
+	tests := []TrainConfig{
+		{Workers: 4},
+		{Workers: 3, Shuffle: true, Buffer: 8, Seed: 1},
+		{Workers: 1, Shuffle: true, Buffer: 8, Seed: 1, Epochs: 2},
+	}
+
+	for i, cfg := range tests {
+		cursors, exams := collect(NewLoader(source, 4, padind, cfg))
+
+		epochs := max(1, cfg.Epochs)
+		if len(exams) != epochs*len(expected) {
+			t.Fatalf("%d: expected %d examples, got %d",
+				i, epochs*len(expected), len(exams))
+		}
+
+		for epoch := range epochs {
+			got := exams[epoch*len(expected) : (epoch+1)*len(expected)]
+
+			if cfg.Shuffle && reflect.DeepEqual(got, expected) {
+				t.Errorf("%d %d: examples are not shuffled", i, epoch)
+			}
+
+			for _, exam := range expected {
+				if !slices.ContainsFunc(got, func(e example) bool {
+					return reflect.DeepEqual(e, exam)
+				}) {
+					t.Errorf("%d %d: missing example %v", i, epoch, exam)
+				}
+			}
+		}
+
+		if cfg.Epochs > 1 && reflect.DeepEqual(exams[:len(expected)], exams[len(expected):]) {
+			t.Errorf("%d: epochs have the same order", i)
+		}
+
+		if !cfg.Shuffle && !reflect.DeepEqual(exams, expected) {
+			t.Errorf("%d: expected %v, got %v", i, expected, exams)
+		}
+
+		last := cursors[len(cursors)-1]
+		if last.Epoch != epochs-1 || last.Step != len(expected) {
+			t.Errorf("%d: unexpected last cursor %v", i, last)
+		}
+	}
+}
+
+// maskSource - документы sliceSource, у каждого четвертого из которых маскировано начало.
+type maskSource struct {
+	sliceSource
+}
+
+func (src maskSource) Doc(index int) ([]int, []bool) {
+	inds, _ := src.sliceSource.Doc(index)
+	if index%4 != 1 {
+		return inds, nil
+	}
+
+	mask := make([]bool, len(inds))
+	for pos := range mask {
+		mask[pos] = pos > 1
+	}
+
+	return inds, mask
+}
+
+// countSource считает чтения документов Source.
+type countSource struct {
+	Source
+	reads atomic.Int64
+}
+
+func (src *countSource) Doc(index int) ([]int, []bool) {
+	src.reads.Add(1)
+	return src.Source.Doc(index)
+}
+
+func Test_Loader_Resume(t *testing.T) {
+	tests := []TrainConfig{
+		{Workers: 2, Shuffle: true, Buffer: 4, Seed: 7, Epochs: 3},
+		{Workers: 2, Shuffle: true, Seed: 7, Epochs: 2, Stride: 1},
+		{Workers: 2, Shuffle: true, Buffer: 3, Seed: 7, Epochs: 2, Pack: true, Reset: true, Stride: 2},
+		{Workers: 1, Buffer: 5, Epochs: 2, Pack: true, Stride: 7},
+	}
+
+	for i, cfg := range tests {
+		var data Source = source
+		if cfg.Pack {
+			data = maskSource{source}
+		}
+
+		cursors, exams := collect(NewLoader(data, 3, 0, cfg))
+
+		for at := range exams {
+			cfg.Cursor = cursors[at]
+
+			src := &countSource{Source: data}
+			_, rest := collect(NewLoader(src, 3, 0, cfg))
+
+			expected := exams[at+1:]
+			if len(rest) != len(expected) || len(rest) != 0 && !reflect.DeepEqual(rest, expected) {
+				t.Errorf("%d %d: resumed examples differ", i, at)
+			}
+
+			// документы до cfg.Cursor.Doc при продолжении не читаются
+			reads := len(source) - cfg.Cursor.Doc + (max(1, cfg.Epochs)-cfg.Cursor.Epoch-1)*len(source)
+			if got := src.reads.Load(); got != int64(reads) {
+				t.Errorf("%d %d: expected %d reads, got %d", i, at, reads, got)
+			}
+
+			// курсор без состояния генератора продолжается пропуском примеров
+			cfg.Cursor = Cursor{Epoch: cursors[at].Epoch, Step: cursors[at].Step}
+
+			_, rest = collect(NewLoader(data, 3, 0, cfg))
+			if len(rest) != len(expected) || len(rest) != 0 && !reflect.DeepEqual(rest, expected) {
+				t.Errorf("%d %d: examples resumed by step differ", i, at)
+			}
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package llm
+
+import (
+	"fmt"
+	"gonum.org/v1/gonum/mat"
+	"llm/pkg/bpe"
+	"llm/pkg/lib"
+	"llm/pkg/lora"
+	"llm/pkg/mlp"
+	"path"
+	"strings"
+)
+
+type named struct {
+	name string
+	w    *mat.Dense
+}
+
+/*
+adaptable возвращает матрицы, к которым подключаются адаптеры:
+WQuery, WKey, WValue голов, WOutput, Weights слоев и затвора MLP и экспертов MoE.
+*/
+func (llm *LLM) adaptable() []named {
+	var params []named
+
+	for _, param := range llm.named() {
+		switch path.Ext(param.name) {
+		case ".WQuery", ".WKey", ".WValue", ".WOutput", ".Weights":
+			params = append(params, param)
+		}
+	}
+
+	return params
+}
+
+/*
+NewLoRA создает адаптеры ранга rank для матриц, имена которых
+оканчиваются на одну из targets, например "WQuery" или "Weights".
+Пустой targets означает все матрицы, см. adaptable.
+*/
+func (llm *LLM) NewLoRA(rank int, alpha float64, targets ...string) *lora.Set {
+	set := &lora.Set{
+		Rank:     rank,
+		Alpha:    alpha,
+		Adapters: make(map[string]*lora.Adapter),
+	}
+
+	for _, param := range llm.adaptable() {
+		ok := len(targets) == 0
+		for _, target := range targets {
+			ok = ok || strings.HasSuffix(param.name, "."+target)
+		}
+
+		if ok {
+			set.Adapters[param.name] = lora.NewAdapter(llm.RNG,
+				lib.Rown(param.w), lib.Coln(param.w), rank, alpha)
+		}
+	}
+
+	return set
+}
+
+/*
+Attach подключает адаптеры set вместо подключенных ранее.
+Адаптеры должны совпадать с матрицами модели по именам и размерам.
+*/
+func (llm *LLM) Attach(set *lora.Set) {
+	params := make(map[string]*mat.Dense)
+	for _, param := range llm.adaptable() {
+		params[param.name] = param.w
+	}
+
+	for name, ad := range set.Adapters {
+		w, ok := params[name]
+		if !ok {
+			panic(fmt.Sprintf("в модели нет матрицы %s", name))
+		}
+
+		if lib.Rown(ad.A) != lib.Rown(w) || lib.Coln(ad.B) != lib.Coln(w) {
+			panic(fmt.Sprintf("адаптер %s не подходит к матрице", name))
+		}
+	}
+
+	llm.adapt(set)
+}
+
+// Detach отключает адаптеры.
+func (llm *LLM) Detach() {
+	llm.adapt(nil)
+}
+
+// Merge прибавляет подключенные адаптеры к весам модели и отключает их.
+func (llm *LLM) Merge() {
+	if llm.adapters == nil {
+		return
+	}
+
+	for _, param := range llm.adaptable() {
+		if ad, ok := llm.adapters.Adapters[param.name]; ok {
+			ad.Merge(param.w)
+		}
+	}
+
+	llm.Detach()
+}
+
+/*
+namedLoRA возвращает матрицы подключенных адаптеров с именами вида
+<матрица>.lora.A и <матрица>.lora.B, например Layers.0.MHA.WOutput.lora.A.
+*/
+func (llm *LLM) namedLoRA() []named {
+	if llm.adapters == nil {
+		return nil
+	}
+
+	var params []named
+
+	for _, param := range llm.adaptable() {
+		if ad, ok := llm.adapters.Adapters[param.name]; ok {
+			params = append(params,
+				named{param.name + ".lora.A", ad.A},
+				named{param.name + ".lora.B", ad.B})
+		}
+	}
+
+	return params
+}
+
+func (llm *LLM) adapt(set *lora.Set) {
+	llm.adapters = set
+	defer llm.applyRules()
+
+	get := func(name string) *lora.Adapter {
+		if set == nil {
+			return nil
+		}
+		return set.Adapters[name]
+	}
+
+	for l, layer := range llm.Layers {
+		prefix := fmt.Sprintf("Layers.%d.", l)
+
+		for h, head := range layer.MHA.Heads {
+			hprefix := fmt.Sprintf("%sMHA.Heads.%d.", prefix, h)
+
+			head.Adapt(
+				get(hprefix+"WQuery"),
+				get(hprefix+"WKey"),
+				get(hprefix+"WValue"))
+		}
+
+		layer.MHA.Adapt(get(prefix + "MHA.WOutput"))
+
+		if layer.MoE == nil {
+			adaptMLP(prefix+"MLP.", layer.MLP, get)
+			continue
+		}
+
+		for e, expert := range layer.MoE.Experts {
+			adaptMLP(fmt.Sprintf("%sMoE.Experts.%d.", prefix, e), expert, get)
+		}
+	}
+}
+
+func adaptMLP(prefix string, mlp *mlp.MLP, get func(string) *lora.Adapter) {
+	for m, mlayer := range mlp.Layers {
+		mlayer.Adapt(get(fmt.Sprintf("%sLayers.%d.Weights", prefix, m)))
+	}
+
+	if mlp.Gate != nil {
+		mlp.Gate.Adapt(get(prefix + "Gate.Weights"))
+	}
+}
+
+/*
+TrainLoRA обучает адаптеры set на source при замороженной модели
+и сохраняет их в cfg.SaveIn. После обучения адаптеры остаются подключенными.
+*/
+func TrainLoRA(
+	llm *LLM,
+	set *lora.Set,
+	source Source,
+	bpe *bpe.BPE,
+	cfg TrainConfig,
+) {
+	llm.Attach(set)
+	set.SetLR(cfg.LR)
+
+	cfg.LR = 0
+	train(llm, source, bpe, cfg, func() { set.Save(cfg.SaveIn) })
+}
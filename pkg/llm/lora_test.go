@@ -0,0 +1,90 @@
+package llm
+
+import (
+	"gonum.org/v1/gonum/mat"
+	"llm/pkg/dirreader"
+	"llm/pkg/lora"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_NewLoRA(t *testing.T) {
+	llm := New(4, 6, 4, 2, 2)
+
+	tests := []struct {
+		targets []string
+		n       int
+	}{
+		{n: 2 * (2*3 + 1 + 2)},
+		{targets: []string{"WQuery", "WValue"}, n: 2 * 2 * 2},
+		{targets: []string{"WOutput"}, n: 2},
+		{targets: []string{"Weights"}, n: 2 * 2},
+	}
+
+	for i, test := range tests {
+		set := llm.NewLoRA(2, 4, test.targets...)
+
+		if len(set.Adapters) != test.n {
+			t.Errorf("%d: expected %d adapters, got %d", i, test.n, len(set.Adapters))
+		}
+	}
+}
+
+func Test_TrainLoRA(t *testing.T) {
+	root := t.TempDir()
+
+	err := os.WriteFile(filepath.Join(root, "a.jsonl"), []byte(
+		`{"text": "привет мир как дела привет мир"}`+"\n"+
+			`{"text": "как дела мир привет"}`+"\n",
+	), os.ModePerm)
+	if err != nil {
+		panic(err)
+	}
+
+	trg := filepath.Join(root, "adapters.gob")
+
+	llm := New(4, vocab.Len(), 4, 2, 2)
+	base := mat.DenseCopyOf(llm.Layers[0].MHA.WOutput)
+	embeds := mat.DenseCopyOf(llm.Embeds)
+	input := []int{0, 1, 2, 3}
+	before := mat.DenseCopyOf(llm.Forward(input, 0))
+
+	set := llm.NewLoRA(2, 2)
+
+	TrainLoRA(llm, set,
+		JSONLSource(root, vocab, Fields{}, dirreader.Options{Exts: []string{".jsonl"}}),
+		vocab, TrainConfig{LR: .01, SaveIn: trg, Workers: 1, Epochs: 3})
+
+	if !mat.Equal(base, llm.Layers[0].MHA.WOutput) || !mat.Equal(embeds, llm.Embeds) {
+		t.Errorf("base model changed")
+	}
+
+	adapted := mat.DenseCopyOf(llm.Forward(input, 0))
+	if mat.EqualApprox(before, adapted, 1e-9) {
+		t.Errorf("adapters did not change the output")
+	}
+
+	llm.Detach()
+	if !mat.EqualApprox(before, llm.Forward(input, 0), 1e-12) {
+		t.Errorf("detached model differs from base")
+	}
+
+	llm.Attach(lora.Load(trg))
+	if !mat.EqualApprox(adapted, llm.Forward(input, 0), 1e-12) {
+		t.Errorf("loaded adapters differ from trained")
+	}
+
+	llm.Merge()
+	if !mat.EqualApprox(adapted, llm.Forward(input, 0), 1e-9) {
+		t.Errorf("merged model differs from adapted")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected panic on mismatched adapters")
+		}
+	}()
+
+	llm.Attach(New(4, vocab.Len(), 8, 2, 2).NewLoRA(2, 4))
+}
@@ -0,0 +1,395 @@
+package llm
+
+import (
+	"gonum.org/v1/gonum/mat"
+	"llm/pkg/dist"
+	"llm/pkg/lib"
+	"llm/pkg/mha"
+	"llm/pkg/mlp"
+	"llm/pkg/moe"
+	"sync"
+)
+
+/*
+Parallel обучает модель с разделением данных: пакет ForwardBatch делится
+поровну между исполнителями, которые одновременно вычисляют логиты
+и градиенты своих частей на общих весах модели. Backward складывает
+градиенты исполнителей и обновляет модель одним шагом по ее правилам,
+поэтому результат совпадает с ForwardBatch и Backward самой модели
+для всего пакета. Градиент ошибки балансировки MoE считается по
+назначениям экспертам всего шага, а Aux - среднее ошибок частей.
+
+У каждого исполнителя свой RNG для dropout, полученный из RNG модели,
+поэтому при dropout маски, а значит и шаг, отличаются от маски модели:
+совпадение с моделью гарантировано только при DropoutP 0.
+Модели с адаптерами не поддерживаются. Методы Parallel нельзя вызывать
+одновременно, а модель нельзя менять между ForwardBatch и Backward.
+*/
+type Parallel struct {
+	llm     *LLM
+	workers []*worker
+	// group - процессы распределенного обучения, см. Join.
+	group *dist.Group
+	// buf - все градиенты или веса одним вектором для group.
+	buf []float64
+}
+
+type worker struct {
+	llm *LLM
+	// grads - градиенты параметров в порядке LLM.named.
+	grads []*mat.Dense
+	state State
+	// rows - число строк части последнего ForwardBatch, 0 - части не было.
+	rows int
+}
+
+// NewParallel создает n исполнителей для обучения llm, n меньше 1 означает 1.
+func (llm *LLM) NewParallel(n int) *Parallel {
+	if llm.adapters != nil {
+		panic("параллельное обучение модели с адаптерами не поддерживается")
+	}
+
+	par := &Parallel{
+		llm:     llm,
+		workers: make([]*worker, max(1, n)),
+	}
+
+	for index := range par.workers {
+		par.workers[index] = llm.newWorker()
+	}
+
+	return par
+}
+
+/*
+newWorker создает исполнителя с общими весами модели, параметры
+которого вместо обновления накапливают градиенты в grads.
+*/
+func (llm *LLM) newWorker() *worker {
+	shared := &LLM{
+		Embeds:      llm.Embeds,
+		Unembed:     llm.Unembed,
+		UnembedBias: llm.UnembedBias,
+		Pos:         llm.Pos,
+		Layers:      make([]*Layer, len(llm.Layers)),
+		CtxSize:     llm.CtxSize,
+		RNG:         lib.NewRNG(llm.RNG.Uint64()),
+	}
+
+	for index, layer := range llm.Layers {
+		shared.Layers[index] = layer.share()
+	}
+
+	named := shared.named()
+	grads := make([]*mat.Dense, len(named))
+	params := make(lib.Params, len(named))
+
+	for index, param := range named {
+		grads[index] = mat.NewDense(lib.Rown(param.w), lib.Coln(param.w), nil)
+		params[param.w] = lib.Param{Grad: grads[index]}
+	}
+
+	shared.params = params
+	for _, layer := range shared.Layers {
+		layer.SetParams(params)
+	}
+
+	return &worker{llm: shared, grads: grads}
+}
+
+// share возвращает слой с общими весами и собственными активациями и настройками обновления.
+func (layer *Layer) share() *Layer {
+	heads := make([]*mha.Head, len(layer.MHA.Heads))
+	for index, head := range layer.MHA.Heads {
+		heads[index] = &mha.Head{
+			WQuery: head.WQuery,
+			WKey:   head.WKey,
+			WValue: head.WValue,
+		}
+	}
+
+	res := &Layer{
+		MHA: &mha.MHA{
+			Heads:   heads,
+			WOutput: layer.MHA.WOutput,
+		},
+		Checkpoint: layer.Checkpoint,
+	}
+
+	if layer.MoE == nil {
+		res.MLP = shareMLP(layer.MLP)
+		return res
+	}
+
+	experts := make([]*mlp.MLP, len(layer.MoE.Experts))
+	for index, expert := range layer.MoE.Experts {
+		experts[index] = shareMLP(expert)
+	}
+
+	res.MoE = &moe.MoE{
+		Experts:  experts,
+		Router:   layer.MoE.Router,
+		TopK:     layer.MoE.TopK,
+		Capacity: layer.MoE.Capacity,
+		Balance:  layer.MoE.Balance,
+	}
+
+	return res
+}
+
+func shareMLP(src *mlp.MLP) *mlp.MLP {
+	share := func(layer *mlp.Layer) *mlp.Layer {
+		if layer == nil {
+			return nil
+		}
+		return &mlp.Layer{Weights: layer.Weights, Bias: layer.Bias}
+	}
+
+	res := &mlp.MLP{
+		Layers: make([]*mlp.Layer, len(src.Layers)),
+		Act:    src.Act,
+		Gate:   share(src.Gate),
+	}
+
+	for index, layer := range src.Layers {
+		res.Layers[index] = share(layer)
+	}
+
+	return res
+}
+
+/*
+Join подключает исполнителей к группе процессов распределенного обучения:
+веса модели заменяются весами процесса 0, RNG исполнителей становятся
+разными в разных процессах, а Backward перед обновлением складывает
+градиенты всех процессов группы. Модели процессов должны совпадать
+по устройству, а ForwardBatch и Backward вызываться всеми процессами
+одинаковое число раз, в том числе с пустым пакетом.
+*/
+func (par *Parallel) Join(group *dist.Group) {
+	par.group = group
+
+	var (
+		weights []*mat.Dense
+		n       int
+	)
+
+	for _, param := range par.llm.named() {
+		weights = append(weights, param.w)
+		n += lib.ParamN(param.w)
+	}
+
+	par.buf = make([]float64, n)
+
+	par.gather(weights)
+	group.Broadcast(par.buf)
+	par.scatter(weights)
+
+	for _, worker := range par.workers {
+		worker.llm.RNG = lib.NewRNG(worker.llm.RNG.Uint64() + uint64(group.Rank()))
+	}
+}
+
+// gather копирует mats по порядку в buf.
+func (par *Parallel) gather(mats []*mat.Dense) {
+	var offset int
+
+	for _, m := range mats {
+		for row := range lib.Rown(m) {
+			offset += copy(par.buf[offset:], m.RawRowView(row))
+		}
+	}
+}
+
+// scatter копирует buf по порядку в mats.
+func (par *Parallel) scatter(mats []*mat.Dense) {
+	var offset int
+
+	for _, m := range mats {
+		for row := range lib.Rown(m) {
+			offset += copy(m.RawRowView(row), par.buf[offset:])
+		}
+	}
+}
+
+/*
+ForwardBatch аналогичен LLM.ForwardBatch. Исполнитель i получает
+последовательности batch от len(batch)·i/n до len(batch)·(i+1)/n.
+*/
+func (par *Parallel) ForwardBatch(batch, docs [][]int, dropoutP float64) *mat.Dense {
+	outputs := make([]*mat.Dense, len(par.workers))
+	n := len(par.workers)
+
+	var wg sync.WaitGroup
+	for index, worker := range par.workers {
+		start, end := len(batch)*index/n, len(batch)*(index+1)/n
+
+		worker.rows = 0
+		if start == end {
+			continue
+		}
+
+		var part [][]int
+		if docs != nil {
+			part = docs[start:end]
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			outputs[index] = worker.llm.ForwardBatchWith(&worker.state, batch[start:end], part, dropoutP)
+		}()
+	}
+	wg.Wait()
+
+	var rown int
+	for index, output := range outputs {
+		if output != nil {
+			par.workers[index].rows = lib.Rown(output)
+			rown += lib.Rown(output)
+		}
+	}
+
+	if rown == 0 {
+		return &mat.Dense{}
+	}
+
+	output := mat.NewDense(rown, lib.Rown(par.llm.head()), nil)
+
+	var row int
+	for _, part := range outputs {
+		if part == nil {
+			continue
+		}
+
+		output.Slice(row, row+lib.Rown(part), 0, lib.Coln(part)).(*mat.Dense).Copy(part)
+		row += lib.Rown(part)
+	}
+
+	return output
+}
+
+/*
+Backward вычисляет градиенты частей последнего ForwardBatch одновременно,
+складывает их, в том числе с градиентами процессов группы, и обновляет модель.
+*/
+func (par *Parallel) Backward(output *mat.Dense, lr float64) {
+	var (
+		wg  sync.WaitGroup
+		row int
+	)
+
+	par.balance()
+
+	for _, worker := range par.workers {
+		if worker.rows == 0 {
+			continue
+		}
+
+		part := mat.DenseCopyOf(output.Slice(row, row+worker.rows, 0, lib.Coln(output)))
+		row += worker.rows
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			worker.llm.BackwardWith(&worker.state, part, 1)
+		}()
+	}
+	wg.Wait()
+
+	grads := par.workers[0].grads
+
+	for index, grad := range grads {
+		for _, worker := range par.workers[1:] {
+			lib.Add(grad, grad, worker.grads[index])
+			worker.grads[index].Zero()
+		}
+	}
+
+	if par.group != nil {
+		par.gather(grads)
+		par.group.AllReduce(par.buf)
+		par.scatter(grads)
+	}
+
+	for index, param := range par.llm.named() {
+		par.llm.params.Step(param.w, grads[index], lr)
+		grads[index].Zero()
+	}
+}
+
+/*
+balance складывает назначения экспертам MoE частей последнего ForwardBatch,
+в том числе частей процессов группы, и передает сумму каждой части, чтобы
+градиент ошибки балансировки совпадал с градиентом одного вызова для всего
+шага.
+*/
+func (par *Parallel) balance() {
+	var sums []float64
+
+	for index, layer := range par.llm.Layers {
+		if layer.MoE == nil {
+			continue
+		}
+
+		// sum - назначения экспертам и число строк последним элементом
+		sum := make([]float64, len(layer.MoE.Experts)+1)
+		for _, worker := range par.workers {
+			if worker.rows == 0 {
+				continue
+			}
+
+			counts := worker.state.layers[index].counts()
+			for expert, n := range counts.Experts {
+				sum[expert] += float64(n)
+			}
+			sum[len(sum)-1] += float64(counts.Rows)
+		}
+		sums = append(sums, sum...)
+	}
+
+	if sums == nil {
+		return
+	}
+
+	if par.group != nil {
+		par.group.AllReduce(sums)
+	}
+
+	for index, layer := range par.llm.Layers {
+		if layer.MoE == nil {
+			continue
+		}
+
+		n := len(layer.MoE.Experts)
+		counts := moe.Counts{Experts: make([]int, n), Rows: int(sums[n])}
+		for expert := range n {
+			counts.Experts[expert] = int(sums[expert])
+		}
+		sums = sums[n+1:]
+
+		for _, worker := range par.workers {
+			if worker.rows != 0 {
+				worker.state.layers[index].setCounts(counts)
+			}
+		}
+	}
+}
+
+// Aux возвращает среднюю по строкам ошибку балансировки частей последнего ForwardBatch.
+func (par *Parallel) Aux() float64 {
+	var sum, rown float64
+
+	for _, worker := range par.workers {
+		if worker.rows != 0 {
+			sum += worker.state.Aux() * float64(worker.rows)
+			rown += float64(worker.rows)
+		}
+	}
+
+	if rown == 0 {
+		return 0
+	}
+
+	return sum / rown
+}
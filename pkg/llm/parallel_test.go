@@ -0,0 +1,233 @@
+package llm
+
+import (
+	"fmt"
+	"gonum.org/v1/gonum/mat"
+	"llm/pkg/dist"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+var parallelDocs = sliceSource{
+	{6, 7, 8, 9, 2},
+	{8, 9, 6, 2},
+	{7, 6, 9, 8, 7, 2},
+	{9, 9, 8, 2},
+	{6, 8, 2},
+}
+
+// Test_Parallel сравнивает шаги без dropout, см. Test_Parallel_Dropout.
+func Test_Parallel(t *testing.T) {
+	// checkpoint - первый слой использует Checkpoint.
+	cases := []struct {
+		cfg        Config
+		checkpoint bool
+	}{
+		{cfg: Config{CtxSize: 4, Vocab: vocab.Len(), Dim: 4, Layers: 2, Heads: 2, Seed: 3}},
+		{cfg: Config{CtxSize: 4, Vocab: vocab.Len(), Dim: 4, Layers: 1, Heads: 2, Seed: 4, Untied: true, Gated: true}},
+		{cfg: Config{CtxSize: 4, Vocab: vocab.Len(), Dim: 4, Layers: 1, Heads: 2, Seed: 5, Experts: 3, TopK: 2, Capacity: 1, Balance: .5}},
+		{cfg: Config{CtxSize: 4, Vocab: vocab.Len(), Dim: 4, Layers: 2, Heads: 2, Seed: 6, Experts: 3, TopK: 1, Balance: 1}, checkpoint: true},
+	}
+
+	// steps - исполнители и окна на исполнителя с одинаковым числом окон шага.
+	steps := []struct{ parallel, batch int }{
+		{parallel: 1, batch: 4},
+		{parallel: 2, batch: 2},
+		{parallel: 4, batch: 1},
+		{parallel: 3, batch: 0},
+	}
+
+	root := t.TempDir()
+
+	for i, c := range cases {
+		var expected map[string]*mat.Dense
+
+		for j, step := range steps {
+			llm := NewWith(c.cfg)
+			llm.Layers[0].Checkpoint = c.checkpoint
+			llm.SetRules(.1, Rule{Pattern: "Pos", Mult: .5})
+
+			Train(llm, parallelDocs, vocab, TrainConfig{
+				LR:       .05,
+				SaveIn:   filepath.Join(root, "llm.gob"),
+				Workers:  1,
+				Epochs:   2,
+				Seed:     7,
+				Shuffle:  true,
+				Batch:    step.batch,
+				Parallel: step.parallel,
+			})
+
+			if j == 0 {
+				expected = llm.Params()
+				continue
+			}
+
+			// шаг из трех окон не совпадает с шагом из четырех
+			if step.batch == 0 {
+				var differs bool
+				for name, w := range llm.Params() {
+					differs = differs || !mat.EqualApprox(w, expected[name], 1e-10)
+				}
+
+				if !differs {
+					t.Errorf("%d %d: expected different params", i, j)
+				}
+				continue
+			}
+
+			for name, w := range llm.Params() {
+				if !mat.EqualApprox(w, expected[name], 1e-10) {
+					t.Errorf("%d %d: %s differs from one worker", i, j, name)
+				}
+			}
+		}
+	}
+}
+
+/*
+Test_Parallel_Dropout проверяет, что с dropout шаг нескольких исполнителей
+не совпадает с шагом одного: у каждого исполнителя свой RNG.
+*/
+func Test_Parallel_Dropout(t *testing.T) {
+	cfg := Config{CtxSize: 4, Vocab: vocab.Len(), Dim: 4, Layers: 1, Heads: 2, Seed: 3}
+	root := t.TempDir()
+
+	params := make([]map[string]*mat.Dense, 2)
+	for index, parallel := range []int{1, 2} {
+		llm := NewWith(cfg)
+
+		Train(llm, parallelDocs, vocab, TrainConfig{
+			LR:       .05,
+			DropoutP: .2,
+			SaveIn:   filepath.Join(root, "llm.gob"),
+			Workers:  1,
+			Epochs:   1,
+			Seed:     7,
+			Batch:    2 / parallel,
+			Parallel: parallel,
+		})
+
+		params[index] = llm.Params()
+	}
+
+	var differs bool
+	for name, w := range params[0] {
+		differs = differs || !mat.EqualApprox(w, params[1][name], 1e-10)
+	}
+
+	if !differs {
+		t.Errorf("expected different params with dropout")
+	}
+}
+
+// distRoot - переменная окружения с каталогом процессов Test_Train_Distributed.
+const distRoot = "LLM_TEST_DIST_ROOT"
+
+var distDocs = sliceSource{
+	{6, 7, 8, 9, 2},
+	{8, 9, 6, 2},
+	{7, 6, 9, 8, 7, 2},
+	{9, 9, 8, 2},
+	{6, 8, 2},
+	{7, 7, 9, 2},
+}
+
+func distConfig(seed uint64) Config {
+	return Config{CtxSize: 4, Vocab: vocab.Len(), Dim: 4, Layers: 2, Heads: 2, Seed: seed, Experts: 3, TopK: 2, Balance: .5}
+}
+
+func distTrainConfig(saveIn string) TrainConfig {
+	return TrainConfig{
+		LR:      .05,
+		SaveIn:  saveIn,
+		Workers: 1,
+		Epochs:  2,
+		Seed:    7,
+		Shuffle: true,
+		Batch:   2,
+	}
+}
+
+/*
+Test_Train_Distributed запускает процессы группы копиями тестовой программы,
+каждый из которых выполняет Test_Train_Distributed_Rank.
+*/
+func Test_Train_Distributed(t *testing.T) {
+	const world = 3
+
+	root := t.TempDir()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	var wg sync.WaitGroup
+	for rank := range world {
+		cmd := exec.Command(os.Args[0], "-test.run=^Test_Train_Distributed_Rank$")
+		cmd.Env = append(os.Environ(),
+			distRoot+"="+root,
+			dist.EnvRank+"="+strconv.Itoa(rank),
+			dist.EnvWorld+"="+strconv.Itoa(world),
+			dist.EnvAddr+"="+addr)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			if out, err := cmd.CombinedOutput(); err != nil {
+				t.Errorf("rank %d: %v\n%s", rank, err, out)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if t.Failed() {
+		return
+	}
+
+	for rank := 1; rank < world; rank++ {
+		if _, err := os.Stat(filepath.Join(root, fmt.Sprintf("%d.gob", rank))); !os.IsNotExist(err) {
+			t.Errorf("rank %d saved the model", rank)
+		}
+	}
+
+	// один процесс с тем же числом исполнителей и весами процесса 0
+	expected := NewWith(distConfig(1))
+	cfg := distTrainConfig(filepath.Join(root, "expected.gob"))
+	cfg.Parallel = world
+	Train(expected, distDocs, vocab, cfg)
+
+	got := Load(filepath.Join(root, "0.gob"))
+
+	for name, w := range expected.Params() {
+		if !mat.EqualApprox(w, got.Params()[name], 1e-10) {
+			t.Errorf("%s differs from one process", name)
+		}
+	}
+}
+
+func Test_Train_Distributed_Rank(t *testing.T) {
+	root := os.Getenv(distRoot)
+	if root == "" {
+		t.Skip("запускается из Test_Train_Distributed")
+	}
+
+	group := dist.Join(dist.FromEnv())
+	defer group.Close()
+
+	// веса процесса 0 заменяют разные начальные веса остальных
+	llm := NewWith(distConfig(uint64(group.Rank() + 1)))
+
+	cfg := distTrainConfig(filepath.Join(root, fmt.Sprintf("%d.gob", group.Rank())))
+	cfg.Group = group
+	Train(llm, distDocs, vocab, cfg)
+}
@@ -0,0 +1,190 @@
+package llm
+
+import (
+	"fmt"
+	"gonum.org/v1/gonum/mat"
+	"llm/pkg/lib"
+	"llm/pkg/mlp"
+	"path"
+)
+
+/*
+Rule настраивает обновление параметров, имена которых подходят
+под Pattern (синтаксис path.Match, например "Layers.*.MHA.*" или "*.Bias").
+Mult умножает скорость обучения, 0 не меняет ее. Frozen запрещает
+обновление, NoDecay отключает затухание весов. Если параметру подходят
+несколько правил, действует последний ненулевой Mult, а Frozen и NoDecay
+применяются, если заданы хотя бы в одном из них. Матрицы подключенных
+адаптеров называются по своей матрице модели, например
+"Layers.0.MHA.WOutput.lora.A", и тоже подчиняются правилам.
+*/
+type Rule struct {
+	Pattern string
+	Mult    float64
+	Frozen,
+	NoDecay bool
+}
+
+/*
+SetRules задает затухание весов decay и правила обновления параметров.
+Правила сохраняются вместе с моделью и соблюдаются всеми Backward.
+*/
+func (llm *LLM) SetRules(decay float64, rules ...Rule) {
+	for _, rule := range rules {
+		_, err := path.Match(rule.Pattern, "")
+		if err != nil {
+			panic(fmt.Sprintf("неверный шаблон %s: %v", rule.Pattern, err))
+		}
+	}
+
+	llm.Decay = decay
+	llm.Rules = rules
+	llm.applyRules()
+}
+
+/*
+Freeze добавляет правила, запрещающие изменять Embeds, Pos
+и первые layers слоев. Градиент через замороженные слои
+по-прежнему распространяется.
+*/
+func (llm *LLM) Freeze(embeds, pos bool, layers int) {
+	rules := llm.Rules
+
+	if embeds {
+		rules = append(rules, Rule{Pattern: "Embeds", Frozen: true})
+	}
+
+	if pos {
+		rules = append(rules, Rule{Pattern: "Pos", Frozen: true})
+	}
+
+	for index := range layers {
+		rules = append(rules, Rule{
+			Pattern: fmt.Sprintf("Layers.%d.*", index),
+			Frozen:  true,
+		})
+	}
+
+	llm.SetRules(llm.Decay, rules...)
+}
+
+// Params возвращает все обучаемые матрицы модели по именам.
+func (llm *LLM) Params() map[string]*mat.Dense {
+	params := make(map[string]*mat.Dense)
+
+	for _, param := range llm.named() {
+		params[param.name] = param.w
+	}
+
+	return params
+}
+
+func (llm *LLM) named() []named {
+	params := []named{
+		{"Embeds", llm.Embeds},
+		{"Pos", llm.Pos},
+	}
+
+	if llm.Unembed != nil {
+		params = append(params,
+			named{"Unembed", llm.Unembed},
+			named{"UnembedBias", llm.UnembedBias})
+	}
+
+	for l, layer := range llm.Layers {
+		prefix := fmt.Sprintf("Layers.%d.", l)
+
+		for h, head := range layer.MHA.Heads {
+			hprefix := fmt.Sprintf("%sMHA.Heads.%d.", prefix, h)
+
+			params = append(params,
+				named{hprefix + "WQuery", head.WQuery},
+				named{hprefix + "WKey", head.WKey},
+				named{hprefix + "WValue", head.WValue})
+		}
+
+		params = append(params, named{prefix + "MHA.WOutput", layer.MHA.WOutput})
+
+		if layer.MoE != nil {
+			params = append(params, named{prefix + "MoE.Router", layer.MoE.Router})
+
+			for e, expert := range layer.MoE.Experts {
+				params = append(params, namedMLP(fmt.Sprintf("%sMoE.Experts.%d.", prefix, e), expert)...)
+			}
+
+			continue
+		}
+
+		params = append(params, namedMLP(prefix+"MLP.", layer.MLP)...)
+	}
+
+	return params
+}
+
+func namedMLP(prefix string, mlp *mlp.MLP) []named {
+	var params []named
+
+	for m, mlayer := range mlp.Layers {
+		mprefix := fmt.Sprintf("%sLayers.%d.", prefix, m)
+
+		params = append(params,
+			named{mprefix + "Weights", mlayer.Weights},
+			named{mprefix + "Bias", mlayer.Bias})
+	}
+
+	if mlp.Gate != nil {
+		params = append(params,
+			named{prefix + "Gate.Weights", mlp.Gate.Weights},
+			named{prefix + "Gate.Bias", mlp.Gate.Bias})
+	}
+
+	return params
+}
+
+// applyRules пересчитывает настройки матриц по Rules и раздает их слоям.
+func (llm *LLM) applyRules() {
+	var params lib.Params
+
+	if len(llm.Rules) != 0 || llm.Decay != 0 {
+		params = make(lib.Params)
+
+		for _, param := range append(llm.named(), llm.namedLoRA()...) {
+			res := lib.Param{Mult: 1, Decay: llm.Decay}
+
+			for _, rule := range llm.Rules {
+				ok, err := path.Match(rule.Pattern, param.name)
+				if err != nil {
+					panic(err)
+				}
+
+				if !ok {
+					continue
+				}
+
+				if rule.Mult != 0 {
+					res.Mult = rule.Mult
+				}
+
+				if rule.Frozen {
+					res.Frozen = true
+				}
+
+				if rule.NoDecay {
+					res.Decay = 0
+				}
+			}
+
+			params[param.w] = res
+		}
+	}
+
+	llm.params = params
+
+	for _, layer := range llm.Layers {
+		layer.SetParams(params)
+	}
+
+	if llm.adapters != nil {
+		llm.adapters.SetParams(params)
+	}
+}
@@ -0,0 +1,167 @@
+package llm
+
+import (
+	"gonum.org/v1/gonum/mat"
+	"llm/pkg/lib"
+	"llm/pkg/lora"
+	"path/filepath"
+	"testing"
+)
+
+func Test_SetRules(t *testing.T) {
+	const lr = .01
+
+	trg := filepath.Join(t.TempDir(), "llm.gob")
+
+	base := New(4, 6, 4, 2, 2)
+	base.Save(trg)
+
+	plain := Load(trg)
+	llm := Load(trg)
+	llm.SetRules(.5,
+		Rule{Pattern: "Embeds", Mult: .1},
+		Rule{Pattern: "Layers.0.*", Frozen: true},
+		Rule{Pattern: "*.Bias", NoDecay: true},
+	)
+
+	llm.Save(trg)
+	llm = Load(trg)
+
+	input := []int{0, 1, 2, 3}
+
+	for _, model := range []*LLM{plain, llm} {
+		output := model.Forward(input, 0)
+		answer := mat.NewDense(4, 6, nil)
+		for row := range 4 {
+			answer.Set(row, row+1, 1)
+		}
+		output.Sub(output, answer)
+		model.Backward(output, lr)
+	}
+
+	orig, params, tuned := base.Params(), plain.Params(), llm.Params()
+
+	for name, w := range orig {
+		var delta, tdelta mat.Dense
+		delta.Sub(w, params[name])
+		tdelta.Sub(w, tuned[name])
+
+		frozen, _ := filepath.Match("Layers.0.*", name)
+
+		switch {
+		case frozen:
+			if !mat.Equal(w, tuned[name]) {
+				t.Errorf("frozen %s changed", name)
+			}
+		case name == "Embeds":
+			delta.Scale(.1, &delta)
+			var decay mat.Dense
+			decay.Scale(lr*.1*.5, w)
+			delta.Add(&delta, &decay)
+
+			if !mat.EqualApprox(&delta, &tdelta, 1e-9) {
+				t.Errorf("Embeds: expected delta %v, got %v", delta, tdelta)
+			}
+		case filepath.Ext(name) == ".Bias" && name[:8] == "Layers.1":
+			if !mat.EqualApprox(&delta, &tdelta, 1e-9) {
+				t.Errorf("%s: expected delta %v, got %v", name, delta, tdelta)
+			}
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected panic on bad pattern")
+		}
+	}()
+
+	llm.SetRules(0, Rule{Pattern: "["})
+}
+
+func Test_SetRules_LoRA(t *testing.T) {
+	const lr = .01
+
+	trg := filepath.Join(t.TempDir(), "lora.gob")
+
+	base := New(4, 6, 4, 2, 2)
+	set := base.NewLoRA(2, 4)
+
+	// ненулевая B, чтобы градиент A не был нулевым
+	rng := lib.NewRNG(3)
+	for _, ad := range set.Adapters {
+		ad.B = lib.Xavier(rng, lib.Rown(ad.B), lib.Coln(ad.B))
+	}
+	set.Save(trg)
+
+	plain, tuned := lora.Load(trg), lora.Load(trg)
+
+	llm := New(4, 6, 4, 2, 2)
+	llm.SetRules(.5,
+		Rule{Pattern: "Layers.0.*", Frozen: true},
+		Rule{Pattern: "*.lora.A", Mult: .1},
+		Rule{Pattern: "*.lora.B", NoDecay: true},
+	)
+
+	input := []int{0, 1, 2, 3}
+
+	for _, model := range []struct {
+		llm *LLM
+		set *lora.Set
+	}{
+		{llm: New(4, 6, 4, 2, 2), set: plain},
+		{llm: llm, set: tuned},
+	} {
+		model.llm.Attach(model.set)
+		model.set.SetLR(lr)
+
+		output := model.llm.Forward(input, 0)
+		answer := mat.NewDense(4, 6, nil)
+		for row := range 4 {
+			answer.Set(row, row+1, 1)
+		}
+		output.Sub(output, answer)
+		model.llm.Backward(output, 0)
+	}
+
+	orig := lora.Load(trg)
+
+	for name, ad := range orig.Adapters {
+		for _, param := range []struct {
+			suffix          string
+			w, plain, tuned *mat.Dense
+		}{
+			{".lora.A", ad.A, plain.Adapters[name].A, tuned.Adapters[name].A},
+			{".lora.B", ad.B, plain.Adapters[name].B, tuned.Adapters[name].B},
+		} {
+			var delta, tdelta mat.Dense
+			delta.Sub(param.w, param.plain)
+			tdelta.Sub(param.w, param.tuned)
+
+			if mat.Norm(&delta, 1) == 0 {
+				t.Errorf("%s%s: expected change without rules", name, param.suffix)
+			}
+
+			frozen, _ := filepath.Match("Layers.0.*", name)
+
+			switch {
+			case frozen:
+				if !mat.Equal(param.w, param.tuned) {
+					t.Errorf("frozen %s%s changed", name, param.suffix)
+				}
+			case param.suffix == ".lora.A":
+				delta.Scale(.1, &delta)
+				var decay mat.Dense
+				decay.Scale(lr*.1*.5, param.w)
+				delta.Add(&delta, &decay)
+
+				if !mat.EqualApprox(&delta, &tdelta, 1e-9) {
+					t.Errorf("%s%s: expected delta %v, got %v", name, param.suffix, delta, tdelta)
+				}
+			default:
+				if !mat.EqualApprox(&delta, &tdelta, 1e-9) {
+					t.Errorf("%s%s: expected delta %v, got %v", name, param.suffix, delta, tdelta)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package llm
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"llm/pkg/bpe"
+	"llm/pkg/dirreader"
+)
+
+const (
+	user      = "</user>"
+	assistant = "</assistant>"
+)
+
+/*
+Fields задает поля записей JSONL и CSV. Если Prompt пусто,
+документом является поле Text, иначе пара Prompt и Response
+оформляется шаблоном диалога, см. Chat.
+*/
+type Fields struct {
+	// Text - поле с текстом, по умолчанию "text".
+	Text,
+	Prompt,
+	Response string
+}
+
+func (fields Fields) text() string {
+	if fields.Text == "" {
+		return "text"
+	}
+	return fields.Text
+}
+
+type record struct {
+	text,
+	prompt,
+	response string
+}
+
+type recordSource struct {
+	records []record
+	bpe     *bpe.BPE
+	chat    bool
+}
+
+func (src *recordSource) Len() int { return len(src.records) }
+
+func (src *recordSource) Doc(index int) ([]int, []bool) {
+	rec := src.records[index]
+
+	if src.chat {
+		return Chat(src.bpe, rec.prompt, rec.response)
+	}
+
+	inds := src.bpe.GetTextInds(rec.text)
+	return append(inds, src.bpe.GetInd(eot)), nil
+}
+
+func newRecordSource(bpe *bpe.BPE, fields Fields) *recordSource {
+	src := &recordSource{
+		bpe:  bpe,
+		chat: fields.Prompt != "",
+	}
+
+	if src.chat && (!bpe.Has(user) || !bpe.Has(assistant)) {
+		panic("токенов ролей нет в словаре")
+	}
+
+	return src
+}
+
+func (src *recordSource) add(name string, n int, get func(string) (string, bool), fields Fields) {
+	field := func(key string) string {
+		val, ok := get(key)
+		if !ok {
+			panic(fmt.Sprintf("%s: в записи %d нет строкового поля %s", name, n, key))
+		}
+		return val
+	}
+
+	if src.chat {
+		src.records = append(src.records, record{
+			prompt:   field(fields.Prompt),
+			response: field(fields.Response),
+		})
+		return
+	}
+
+	src.records = append(src.records, record{text: field(fields.text())})
+}
+
+/*
+JSONLSource читает записи JSON Lines из файлов каталога src, отобранных opts.
+Каждая запись - отдельный документ.
+*/
+func JSONLSource(src string, bpe *bpe.BPE, fields Fields, opts dirreader.Options) Source {
+	source := newRecordSource(bpe, fields)
+
+	for name, data := range dirreader.ReadWith(src, opts) {
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		scanner.Buffer(nil, len(data)+1)
+
+		var n int
+		for scanner.Scan() {
+			n++
+
+			line := bytes.TrimSpace(scanner.Bytes())
+			if len(line) == 0 {
+				continue
+			}
+
+			var obj map[string]any
+			err := json.Unmarshal(line, &obj)
+			if err != nil {
+				panic(fmt.Sprintf("%s: строка %d: %v", name, n, err))
+			}
+
+			source.add(name, n, func(key string) (string, bool) {
+				val, ok := obj[key].(string)
+				return val, ok
+			}, fields)
+		}
+
+		if scanner.Err() != nil {
+			panic(scanner.Err())
+		}
+	}
+
+	return source
+}
+
+/*
+CSVSource читает записи CSV из файлов каталога src, отобранных opts.
+Первая строка каждого файла содержит имена полей.
+*/
+func CSVSource(src string, bpe *bpe.BPE, fields Fields, opts dirreader.Options) Source {
+	source := newRecordSource(bpe, fields)
+
+	for name, data := range dirreader.ReadWith(src, opts) {
+		reader := csv.NewReader(bytes.NewReader(data))
+
+		header, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			continue
+		}
+		if err != nil {
+			panic(fmt.Sprintf("%s: %v", name, err))
+		}
+
+		cols := make(map[string]int, len(header))
+		for col, key := range header {
+			cols[key] = col
+		}
+
+		for n := 1; ; n++ {
+			row, err := reader.Read()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				panic(fmt.Sprintf("%s: %v", name, err))
+			}
+
+			source.add(name, n, func(key string) (string, bool) {
+				col, ok := cols[key]
+				if !ok {
+					return "", false
+				}
+				return row[col], true
+			}, fields)
+		}
+	}
+
+	return source
+}
+
+/*
+Chat оформляет пару запрос/ответ как
+
+	</user> запрос </assistant> ответ </eot>
+
+и возвращает маску, в которой отмечены только токены ответа и eot,
+чтобы ошибка считалась лишь на ответе.
+*/
+func Chat(bpe *bpe.BPE, prompt, response string) ([]int, []bool) {
+	inds := []int{bpe.GetInd(user)}
+	inds = append(inds, bpe.GetTextInds(prompt)...)
+	inds = append(inds, bpe.GetInd(assistant))
+
+	mask := make([]bool, len(inds))
+
+	inds = append(inds, bpe.GetTextInds(response)...)
+	inds = append(inds, bpe.GetInd(eot))
+
+	for len(mask) < len(inds) {
+		mask = append(mask, true)
+	}
+
+	return inds, mask
+}
@@ -0,0 +1,148 @@
+package llm
+
+import (
+	"llm/pkg/bpe"
+	"llm/pkg/dirreader"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+var vocab = func() *bpe.BPE {
+	toks := []string{
+		"eow", "unk", eot, pad, user, assistant,
+		"привет" + "eow",
+		"мир" + "eow",
+		"как" + "eow",
+		"дела" + "eow",
+	}
+
+	val := make(map[string]int)
+	for index, tok := range toks {
+		val[tok] = index
+	}
+
+	return bpe.New(val, "eow", "unk")
+}()
+
+func docs(src Source) ([][]int, [][]bool) {
+	var (
+		inds  [][]int
+		masks [][]bool
+	)
+
+	for index := range src.Len() {
+		doc, mask := src.Doc(index)
+		inds = append(inds, doc)
+		masks = append(masks, mask)
+	}
+
+	return inds, masks
+}
+
+func Test_JSONLSource(t *testing.T) {
+	root := t.TempDir()
+
+	err := os.WriteFile(filepath.Join(root, "a.jsonl"), []byte(
+		`{"text": "Привет мир", "id": 1}`+"\n"+
+			"\n"+
+			`{"body": "как дела", "prompt": "привет", "response": "мир"}`+"\n",
+	), os.ModePerm)
+	if err != nil {
+		panic(err)
+	}
+
+	tests := []struct {
+		fields Fields
+		inds   [][]int
+		masks  [][]bool
+		panics bool
+	}{
+		{
+			panics: true,
+		},
+		{
+			fields: Fields{Prompt: "prompt", Response: "response"},
+			panics: true,
+		},
+		{
+			fields: Fields{Text: "body"},
+			panics: true,
+		},
+	}
+
+	for i, test := range tests {
+		func() {
+			defer func() {
+				if (recover() != nil) != test.panics {
+					t.Errorf("%d: unexpected panic state", i)
+				}
+			}()
+
+			JSONLSource(root, vocab, test.fields, dirreader.Options{})
+		}()
+	}
+
+	err = os.WriteFile(filepath.Join(root, "a.jsonl"), []byte(
+		`{"text": "Привет мир", "prompt": "привет", "response": "как дела"}`+"\n"+
+			`{"text": "дела", "prompt": "как дела", "response": "мир"}`,
+	), os.ModePerm)
+	if err != nil {
+		panic(err)
+	}
+
+	inds, masks := docs(JSONLSource(root, vocab, Fields{}, dirreader.Options{}))
+
+	if !reflect.DeepEqual(inds, [][]int{{6, 7, 2}, {9, 2}}) {
+		t.Errorf("unexpected text docs %v", inds)
+	}
+
+	if !reflect.DeepEqual(masks, [][]bool{nil, nil}) {
+		t.Errorf("unexpected text masks %v", masks)
+	}
+
+	inds, masks = docs(JSONLSource(root, vocab,
+		Fields{Prompt: "prompt", Response: "response"}, dirreader.Options{}))
+
+	if !reflect.DeepEqual(inds, [][]int{{4, 6, 5, 8, 9, 2}, {4, 8, 9, 5, 7, 2}}) {
+		t.Errorf("unexpected chat docs %v", inds)
+	}
+
+	if !reflect.DeepEqual(masks, [][]bool{
+		{false, false, false, true, true, true},
+		{false, false, false, false, true, true},
+	}) {
+		t.Errorf("unexpected chat masks %v", masks)
+	}
+}
+
+func Test_CSVSource(t *testing.T) {
+	root := t.TempDir()
+
+	err := os.WriteFile(filepath.Join(root, "a.csv"), []byte(
+		"q,a\n"+
+			"привет,\"мир,\nкак дела\"\n"+
+			"дела,мир\n",
+	), os.ModePerm)
+	if err != nil {
+		panic(err)
+	}
+
+	inds, _ := docs(CSVSource(root, vocab, Fields{Text: "a"}, dirreader.Options{}))
+
+	if !reflect.DeepEqual(inds, [][]int{{7, 1, 0, 8, 9, 2}, {7, 2}}) {
+		t.Errorf("unexpected text docs %v", inds)
+	}
+
+	inds, masks := docs(CSVSource(root, vocab,
+		Fields{Prompt: "q", Response: "a"}, dirreader.Options{}))
+
+	if !reflect.DeepEqual(inds[1], []int{4, 9, 5, 7, 2}) {
+		t.Errorf("unexpected chat doc %v", inds[1])
+	}
+
+	if !reflect.DeepEqual(masks[1], []bool{false, false, false, true, true}) {
+		t.Errorf("unexpected chat mask %v", masks[1])
+	}
+}
@@ -0,0 +1,256 @@
+package llm
+
+import (
+	"context"
+	"iter"
+	"llm/pkg/bpe"
+	"sync"
+)
+
+// DefaultMaxBatch - SchedulerConfig.MaxBatch по умолчанию.
+const DefaultMaxBatch = 16
+
+type SchedulerConfig struct {
+	// MaxBatch ограничивает число последовательностей в одном шаге, 0 означает DefaultMaxBatch.
+	MaxBatch int
+	/*
+		MaxPrefill ограничивает число токенов запросов, еще не попавших
+		в кэш, в одном шаге, чтобы длинные запросы не задерживали
+		генерацию остальных. 0 означает CtxSize.
+	*/
+	MaxPrefill int
+}
+
+/*
+Scheduler объединяет одновременные генерации в общие шаги LLM.Step.
+Запросы принимаются в порядке поступления, пока в шаге есть место,
+и освобождают его, как только закончены. В каждом шаге все принятые
+последовательности получают по токену, а запросы делят MaxPrefill
+в порядке поступления, при этом длинные запросы обрабатываются частями.
+*/
+type Scheduler struct {
+	llm     *LLM
+	eotind  int
+	cfg     SchedulerConfig
+	mut     sync.Mutex
+	waiting []*request
+	closed  bool
+	wake    chan struct{}
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+type request struct {
+	sequence
+	ctx context.Context
+	out chan int
+}
+
+/*
+NewScheduler запускает планировщик генераций модели. Модель только
+читается, поэтому ее нельзя обучать или менять до вызова Close.
+*/
+func (llm *LLM) NewScheduler(bpe *bpe.BPE, cfg SchedulerConfig) *Scheduler {
+	check(bpe)
+
+	if cfg.MaxBatch <= 0 {
+		cfg.MaxBatch = DefaultMaxBatch
+	}
+
+	if cfg.MaxPrefill <= 0 {
+		cfg.MaxPrefill = llm.CtxSize
+	}
+
+	sched := &Scheduler{
+		llm:     llm,
+		eotind:  bpe.GetInd(eot),
+		cfg:     cfg,
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+
+	go sched.run()
+
+	return sched
+}
+
+/*
+Generate аналогичен LLM.Generate и выдает те же токены, но вычисляет их
+вместе с другими запросами планировщика. Генерация прекращается, если
+ctx завершен, цикл по результату прерван или планировщик закрыт.
+*/
+func (sched *Scheduler) Generate(ctx context.Context, prompt []int, cfg GenConfig) iter.Seq[int] {
+	return func(yield func(int) bool) {
+		if cfg.MaxTokens <= 0 {
+			return
+		}
+
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		req := &request{
+			sequence: sched.llm.newSequence(prompt, cfg, sched.eotind),
+			ctx:      ctx,
+			out:      make(chan int, cfg.MaxTokens),
+		}
+
+		if !sched.submit(req) {
+			return
+		}
+
+		for ind := range req.out {
+			if !yield(ind) {
+				return
+			}
+		}
+	}
+}
+
+// Close останавливает планировщик и завершает все его генерации.
+func (sched *Scheduler) Close() {
+	sched.mut.Lock()
+	if sched.closed {
+		sched.mut.Unlock()
+		return
+	}
+	sched.closed = true
+	sched.mut.Unlock()
+
+	close(sched.done)
+	<-sched.stopped
+}
+
+func (sched *Scheduler) submit(req *request) bool {
+	sched.mut.Lock()
+	defer sched.mut.Unlock()
+
+	if sched.closed {
+		return false
+	}
+
+	sched.waiting = append(sched.waiting, req)
+
+	select {
+	case sched.wake <- struct{}{}:
+	default:
+	}
+
+	return true
+}
+
+func (sched *Scheduler) run() {
+	defer close(sched.stopped)
+
+	var active []*request
+
+	for {
+		active = sched.admit(active)
+
+		select {
+		case <-sched.done:
+			for _, req := range active {
+				close(req.out)
+			}
+			return
+		default:
+		}
+
+		if len(active) == 0 {
+			select {
+			case <-sched.wake:
+			case <-sched.done:
+			}
+			continue
+		}
+
+		active = sched.step(active)
+	}
+}
+
+/*
+admit добавляет к active ожидающие запросы, пока есть место.
+После Close добавляются все, чтобы их можно было завершить.
+*/
+func (sched *Scheduler) admit(active []*request) []*request {
+	sched.mut.Lock()
+	defer sched.mut.Unlock()
+
+	n := min(len(sched.waiting), sched.cfg.MaxBatch-len(active))
+	if sched.closed {
+		n = len(sched.waiting)
+	}
+
+	active = append(active, sched.waiting[:n]...)
+	sched.waiting = sched.waiting[n:]
+
+	return active
+}
+
+// step выполняет один общий шаг и возвращает незаконченные запросы.
+func (sched *Scheduler) step(active []*request) []*request {
+	var (
+		batch  []*request
+		caches []*Cache
+		tokens [][]int
+		rest   []*request
+	)
+
+	budget := sched.cfg.MaxPrefill
+
+	for _, req := range active {
+		if req.ctx.Err() != nil {
+			close(req.out)
+			continue
+		}
+		rest = append(rest, req)
+
+		pending := req.pending(sched.llm.CtxSize)
+		if len(pending) > 1 {
+			if budget == 0 {
+				continue
+			}
+
+			pending = pending[:min(len(pending), budget)]
+			budget -= len(pending)
+		}
+
+		batch = append(batch, req)
+		caches = append(caches, req.cache)
+		tokens = append(tokens, pending)
+	}
+
+	if len(batch) == 0 {
+		return rest
+	}
+
+	logits := sched.llm.Step(caches, tokens)
+
+	finished := make(map[*request]bool)
+
+	for index, req := range batch {
+		// запрос еще не полностью в кэше
+		if req.start+req.cache.Len() < len(req.inds) {
+			continue
+		}
+
+		next, ok := req.next(logits.RawRowView(index), sched.eotind)
+		if ok {
+			req.out <- next
+		}
+
+		if !ok || req.done() {
+			close(req.out)
+			finished[req] = true
+		}
+	}
+
+	active = rest[:0]
+	for _, req := range rest {
+		if !finished[req] {
+			active = append(active, req)
+		}
+	}
+
+	return active
+}
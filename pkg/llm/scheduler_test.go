@@ -0,0 +1,148 @@
+package llm
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"testing"
+)
+
+type genRequest struct {
+	prompt []int
+	cfg    GenConfig
+}
+
+func genRequests(n, maxTokens int) []genRequest {
+	reqs := make([]genRequest, n)
+
+	for index := range reqs {
+		prompt := make([]int, index%7)
+		for pos := range prompt {
+			prompt[pos] = 6 + (index+pos)%4
+		}
+
+		reqs[index] = genRequest{
+			prompt: prompt,
+			cfg: GenConfig{
+				MaxTokens:   maxTokens,
+				Temperature: float64(index%3) / 2,
+				TopK:        index % 4,
+				Seed:        uint64(index),
+			},
+		}
+	}
+
+	return reqs
+}
+
+func Test_Scheduler(t *testing.T) {
+	cfgs := []struct {
+		model Config
+		sched SchedulerConfig
+	}{
+		{
+			model: Config{CtxSize: 4, Vocab: vocab.Len(), Dim: 4, Layers: 2, Heads: 2, Seed: 1},
+			sched: SchedulerConfig{MaxBatch: 3, MaxPrefill: 2},
+		},
+		{
+			model: Config{CtxSize: 8, Vocab: vocab.Len(), Dim: 4, Layers: 1, Heads: 2, Seed: 2,
+				Experts: 3, TopK: 2, Capacity: 1},
+			sched: SchedulerConfig{},
+		},
+	}
+
+	reqs := genRequests(12, 10)
+
+	for i, cfg := range cfgs {
+		llm := NewWith(cfg.model)
+		sched := llm.NewScheduler(vocab, cfg.sched)
+
+		var wg sync.WaitGroup
+		for index, req := range reqs {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				expected := slices.Collect(llm.Generate(vocab, req.prompt, req.cfg))
+				got := slices.Collect(sched.Generate(context.Background(), req.prompt, req.cfg))
+
+				if !slices.Equal(expected, got) {
+					t.Errorf("%d %d: expected %v, got %v", i, index, expected, got)
+				}
+			}()
+		}
+		wg.Wait()
+
+		sched.Close()
+
+		if got := slices.Collect(sched.Generate(context.Background(), []int{6}, reqs[0].cfg)); got != nil {
+			t.Errorf("%d: closed scheduler generated %v", i, got)
+		}
+	}
+}
+
+func Test_Scheduler_Cancel(t *testing.T) {
+	llm := NewWith(Config{CtxSize: 4, Vocab: vocab.Len(), Dim: 4, Layers: 1, Heads: 2})
+	sched := llm.NewScheduler(vocab, SchedulerConfig{MaxBatch: 1})
+	defer sched.Close()
+
+	cfg := GenConfig{MaxTokens: 1000, Temperature: 1}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// отмененный запрос не занимает единственное место в шаге
+	for range sched.Generate(ctx, nil, cfg) {
+		t.Fatalf("canceled request generated tokens")
+	}
+
+	var n int
+	for range sched.Generate(context.Background(), nil, cfg) {
+		n++
+		if n == 3 {
+			break
+		}
+	}
+
+	got := slices.Collect(sched.Generate(context.Background(), []int{6, 7}, GenConfig{MaxTokens: 2}))
+	expected := slices.Collect(llm.Generate(vocab, []int{6, 7}, GenConfig{MaxTokens: 2}))
+
+	if !slices.Equal(expected, got) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
+
+var benchConfig = Config{CtxSize: 64, Vocab: vocab.Len(), Dim: 64, Layers: 2, Heads: 4, Seed: 1}
+
+func Benchmark_Generate_Sequential(b *testing.B) {
+	llm := NewWith(benchConfig)
+	reqs := genRequests(16, 32)
+
+	for range b.N {
+		for _, req := range reqs {
+			for range llm.Generate(vocab, req.prompt, req.cfg) {
+			}
+		}
+	}
+}
+
+func Benchmark_Generate_Scheduler(b *testing.B) {
+	llm := NewWith(benchConfig)
+	sched := llm.NewScheduler(vocab, SchedulerConfig{})
+	defer sched.Close()
+
+	reqs := genRequests(16, 32)
+
+	for range b.N {
+		var wg sync.WaitGroup
+		for _, req := range reqs {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for range sched.Generate(context.Background(), req.prompt, req.cfg) {
+				}
+			}()
+		}
+		wg.Wait()
+	}
+}
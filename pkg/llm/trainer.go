@@ -4,9 +4,10 @@ import (
 	"gonum.org/v1/gonum/mat"
 	"iter"
 	"llm/pkg/bpe"
-	"llm/pkg/dirreader"
+	"llm/pkg/dist"
 	"llm/pkg/lib"
 	"log"
+	"slices"
 )
 
 const (
@@ -14,14 +15,91 @@ const (
 	pad = "</pad>"
 )
 
-func Train(
-	llm *LLM,
-	dataset string,
-	bpe *bpe.BPE,
-	dropoutP,
-	lr float64,
-	saveIn string,
-) {
+type TrainConfig struct {
+	DropoutP,
+	LR float64
+	SaveIn string
+	/*
+		Stride - сдвиг окна между соседними примерами.
+		0 означает половину CtxSize.
+	*/
+	Stride int
+	/*
+		Pack склеивает документы, разделенные eot, в полные окна
+		вместо дополнения последнего окна каждого файла токенами pad.
+	*/
+	Pack bool
+	/*
+		Reset запрещает внимание между документами внутри окна.
+		Имеет смысл только вместе с Pack.
+	*/
+	Reset bool
+	// Epochs - число проходов по данным, 0 означает один проход.
+	Epochs int
+	Seed   uint64
+	// Shuffle перемешивает документы перед каждой эпохой.
+	Shuffle bool
+	// Buffer - размер буфера, в пределах которого перемешиваются окна.
+	Buffer int
+	// Workers - число горутин токенизации, 0 означает runtime.NumCPU().
+	Workers int
+	// Cursor - позиция, с которой продолжается обучение.
+	Cursor Cursor
+	// Smoothing - доля равномерного распределения в целевом, см. lib.SoftmaxCrossEntropy.
+	Smoothing,
+	// ZLoss - вес штрафа log²Z за рост логитов.
+	ZLoss float64
+	/*
+		Batch - число окон в одном шаге обучения на исполнителя, 0 означает 1.
+		Окна шага вычисляются одним ForwardBatch, а градиент усредняется.
+	*/
+	Batch int
+	/*
+		Parallel - число исполнителей, вычисляющих градиенты шага
+		одновременно, см. Parallel. Шаг состоит из Batch·Parallel окон
+		и при DropoutP 0 совпадает с шагом одного исполнителя с тем же
+		числом окон. 0 означает 1.
+	*/
+	Parallel int
+	/*
+		Group - группа процессов распределенного обучения, см. Parallel.Join.
+		Каждый процесс читает те же данные, а шаг из World частей по
+		Batch·Parallel окон делится между процессами по порядку номеров,
+		поэтому результат совпадает с обучением одного процесса
+		с Parallel·World исполнителями. Сохраняет модель только процесс 0.
+	*/
+	Group *dist.Group
+}
+
+// trainable - модель или исполнители, вычисляющие шаг обучения.
+type trainable interface {
+	ForwardBatch(batch, docs [][]int, dropoutP float64) *mat.Dense
+	Backward(output *mat.Dense, lr float64)
+	Aux() float64
+}
+
+/*
+stepper обучает модель с одним State для всех шагов, поэтому память
+активаций выделяется только на первом шаге.
+*/
+type stepper struct {
+	llm   *LLM
+	state State
+}
+
+func (st *stepper) ForwardBatch(batch, docs [][]int, dropoutP float64) *mat.Dense {
+	return st.llm.ForwardBatchWith(&st.state, batch, docs, dropoutP)
+}
+
+func (st *stepper) Backward(output *mat.Dense, lr float64) {
+	st.llm.BackwardWith(&st.state, output, lr)
+}
+
+func (st *stepper) Aux() float64 {
+	return st.state.Aux()
+}
+
+func check(bpe *bpe.BPE) {
 	if !bpe.Has(eot) {
 		panic("токена eot нет в словаре")
 	}
@@ -29,49 +107,272 @@ func Train(
 	if !bpe.Has(pad) {
 		panic("токена pad нет в словаре")
 	}
+}
 
-	for index, exam := range examples(dataset, bpe, llm.CtxSize) {
-		output := llm.Forward(exam.input, dropoutP)
+func Train(
+	llm *LLM,
+	source Source,
+	bpe *bpe.BPE,
+	cfg TrainConfig,
+) {
+	train(llm, source, bpe, cfg, func() { llm.Save(cfg.SaveIn) })
+}
+
+/*
+train - общий цикл обучения. save сохраняет результат в cfg.SaveIn,
+курсор сохраняется рядом с ним.
+*/
+func train(
+	llm *LLM,
+	source Source,
+	bpe *bpe.BPE,
+	cfg TrainConfig,
+	save func(),
+) {
+	check(bpe)
+
+	loader := NewLoader(source, llm.CtxSize, bpe.GetInd(pad), cfg)
+
+	var (
+		index int
+		last  = cfg.Cursor
+		exams []example
+		rank  = 0
+		world = 1
+	)
+
+	if cfg.Group != nil {
+		rank, world = cfg.Group.Rank(), cfg.Group.World()
+	}
+
+	var model trainable = &stepper{llm: llm}
+	if cfg.Parallel > 1 || cfg.Group != nil {
+		par := llm.NewParallel(cfg.Parallel)
+		if cfg.Group != nil {
+			par.Join(cfg.Group)
+		}
+		model = par
+	}
+
+	step := func() {
+		part := exams[len(exams)*rank/world : len(exams)*(rank+1)/world]
+
+		output := model.ForwardBatch(batchInputs(part), batchDocs(part), cfg.DropoutP)
 		log.Printf("ошибка %.2f; пример %d\n",
-			lib.CrossEntropy(output, exam.answer), index)
-		output.Sub(output, exam.answer)
-		llm.Backward(output, lr)
-		if index%1000 == 0 {
+			batchLoss(output, part, len(exams), cfg.Smoothing, cfg.ZLoss)+model.Aux(), index)
+		model.Backward(output, cfg.LR)
+
+		if rank == 0 && index/1000 > (index-len(exams))/1000 {
 			log.Println("сохранение")
-			llm.Save(saveIn)
+			save()
+			last.Save(cfg.SaveIn + ".cursor")
+		}
+
+		exams = exams[:0]
+	}
+
+	for cursor, exam := range loader.All() {
+		index++
+		last = cursor
+
+		exams = append(exams, exam)
+		if len(exams) >= max(1, cfg.Batch)*max(1, cfg.Parallel)*world {
+			step()
 		}
 	}
+
+	if len(exams) > 0 {
+		step()
+	}
+
+	if rank != 0 {
+		return
+	}
+
+	log.Println("сохранение")
+	save()
+	last.Save(cfg.SaveIn + ".cursor")
+}
+
+func batchInputs(exams []example) [][]int {
+	res := make([][]int, len(exams))
+	for index, exam := range exams {
+		res[index] = exam.input
+	}
+	return res
 }
 
+func batchDocs(exams []example) [][]int {
+	res := make([][]int, len(exams))
+	for index, exam := range exams {
+		res[index] = exam.docs
+	}
+	return res
+}
+
+/*
+batchLoss аналогичен loss для логитов ForwardBatch окон exams:
+возвращает среднюю ошибку окон и заменяет output градиентом их суммы,
+деленной на число окон шага n.
+*/
+func batchLoss(output *mat.Dense, exams []example, n int, smoothing, zloss float64) float64 {
+	if len(exams) == 0 {
+		return 0
+	}
+
+	var (
+		sum   float64
+		start int
+	)
+
+	for _, exam := range exams {
+		end := start + len(exam.input)
+		sum += loss(output.Slice(start, end, 0, lib.Coln(output)).(*mat.Dense), exam, smoothing, zloss)
+		start = end
+	}
+
+	lib.Scale(output, 1/float64(n), output)
+
+	return sum / float64(len(exams))
+}
+
+/*
+Evaluate возвращает среднюю ошибку модели на source без обучения.
+Перемешивание, эпохи, курсор, Smoothing и ZLoss из cfg не учитываются.
+*/
+func Evaluate(
+	llm *LLM,
+	source Source,
+	bpe *bpe.BPE,
+	cfg TrainConfig,
+) float64 {
+	check(bpe)
+
+	cfg.Epochs, cfg.Shuffle, cfg.Buffer, cfg.Cursor = 1, false, 0, Cursor{}
+	loader := NewLoader(source, llm.CtxSize, bpe.GetInd(pad), cfg)
+
+	var (
+		sum float64
+		n   int
+	)
+
+	for _, exam := range loader.All() {
+		output := llm.ForwardDocs(exam.input, exam.docs, 0)
+		sum += loss(output, exam, 0, 0)
+		n++
+	}
+
+	if n == 0 {
+		return 0
+	}
+
+	return sum / float64(n)
+}
+
+/*
+loss возвращает среднюю ошибку логитов output на позициях exam.mask
+и заменяет output градиентом ошибки по логитам. На позициях вне маски
+градиент нулевой.
+*/
+func loss(output *mat.Dense, exam example, smoothing, zloss float64) float64 {
+	targets := exam.target
+
+	if exam.mask != nil {
+		targets = slices.Clone(targets)
+
+		for row, ok := range exam.mask {
+			if !ok {
+				targets[row] = -1
+			}
+		}
+	}
+
+	return lib.SparseCrossEntropy(output, targets, smoothing, zloss)
+}
+
+/*
+example - окно обучения. mask отмечает позиции target, на которых
+считается ошибка; nil означает все позиции.
+*/
 type example struct {
-	input  []int
-	answer *mat.Dense
+	input,
+	target,
+	docs []int
+	mask []bool
+}
+
+func windows(docs iter.Seq2[[]int, []bool], winsize, padind int, cfg TrainConfig) iter.Seq[example] {
+	return func(yield func(example) bool) {
+		for _, exam := range placed(docs, origin{}, winsize, padind, cfg) {
+			if !yield(exam) {
+				return
+			}
+		}
+	}
+}
+
+/*
+origin - начало окна: позиция off в документе doc по порядку выдачи.
+masked означает, что у одного из документов до doc была маска.
+*/
+type origin struct {
+	doc,
+	off int
+	masked bool
 }
 
-func examples(src string, bpe *bpe.BPE, winsize int) iter.Seq2[int, example] {
-	return func(yield func(int, example) bool) {
-		var n int
-		padind := bpe.GetInd(pad)
+/*
+placed аналогичен windows, но выдает окна вместе с их началом.
+Документы docs начинаются с документа from.doc, первый из них
+читается с позиции from.off. Если from - начало окна потока
+с первого документа, окна совпадают с окнами этого потока от from.
+*/
+func placed(
+	docs iter.Seq2[[]int, []bool],
+	from origin,
+	winsize,
+	padind int,
+	cfg TrainConfig) iter.Seq2[origin, example] {
+
+	stride := cfg.Stride
+	if stride <= 0 {
+		stride = max(1, winsize/2)
+	}
+
+	if cfg.Pack {
+		return packed(docs, from, winsize, stride, padind, cfg.Reset)
+	}
 
-		for filename, data := range dirreader.Read(src) {
-			inds := bpe.GetTextInds(string(data))
-			inds = append(inds, bpe.GetInd(eot))
+	return func(yield func(origin, example) bool) {
+		doc, off := from.doc, from.off
 
-			for i, l := 0, len(inds); i+1 < l; i += winsize / 2 {
-				n++
+		for inds, mask := range docs {
+			inds = inds[min(off, len(inds)):]
+			if mask != nil {
+				mask = mask[min(off, len(mask)):]
+			}
 
+			for i, l := 0, len(inds); i+1 < l; i += stride {
 				var haspads bool
 				for len(inds) < i+winsize+1 {
 					inds = append(inds, padind)
 					haspads = true
+
+					if mask != nil {
+						mask = append(mask, false)
+					}
+				}
+
+				exam := example{
+					input:  inds[i : i+winsize],
+					target: inds[i+1 : i+winsize+1],
 				}
 
-				input := inds[i : i+winsize]
+				if mask != nil {
+					exam.mask = mask[i+1 : i+winsize+1]
+				}
 
-				if !yield(n, example{
-					input:  input,
-					answer: lib.HotEnc(inds[i+1:i+winsize+1], bpe.Len()),
-				}) {
+				if !yield(origin{doc: doc, off: off + i}, exam) {
 					return
 				}
 
@@ -80,7 +381,112 @@ func examples(src string, bpe *bpe.BPE, winsize int) iter.Seq2[int, example] {
 				}
 			}
 
-			log.Printf("изучил файл %s\n", filename)
+			doc++
+			off = 0
+		}
+	}
+}
+
+/*
+packed склеивает документы в непрерывный поток и режет его на полные окна.
+Дополнение pad используется только для хвоста последнего документа.
+Сдвиг больше накопленного потока пропускает и начало следующих документов.
+Поток начинается с позиции from, см. placed.
+*/
+func packed(
+	docs iter.Seq2[[]int, []bool],
+	from origin,
+	winsize,
+	stride,
+	padind int,
+	reset bool) iter.Seq2[origin, example] {
+
+	return func(yield func(origin, example) bool) {
+		var (
+			buf,
+			ids,
+			offs []int
+			msk []bool
+			seen,
+			// skip - токены сдвига, еще не пропущенные в потоке.
+			skip int
+		)
+
+		// first - первый документ с маской, -1 - маски еще не было.
+		doc, off, first := from.doc, from.off, -1
+		if from.masked {
+			first = from.doc - 1
+		}
+
+		window := func() bool {
+			exam := example{
+				input:  buf[:winsize],
+				target: buf[1 : winsize+1],
+			}
+
+			if reset {
+				exam.docs = ids[:winsize]
+			}
+
+			if first >= 0 {
+				exam.mask = msk[1 : winsize+1]
+			}
+
+			at := origin{doc: ids[0], off: offs[0], masked: first >= 0 && first < ids[0]}
+
+			return yield(at, exam)
+		}
+
+		for inds, mask := range docs {
+			inds = inds[min(off, len(inds)):]
+			if mask != nil {
+				mask = mask[min(off, len(mask)):]
+			}
+
+			buf = append(buf, inds...)
+			for index := range inds {
+				ids = append(ids, doc)
+				offs = append(offs, off+index)
+				msk = append(msk, mask == nil || mask[index])
+			}
+
+			if mask != nil && first < 0 {
+				first = doc
+			}
+			doc++
+			off = 0
+
+			if skip > 0 {
+				n := min(skip, len(buf))
+				skip -= n
+				buf, ids, offs, msk = buf[n:], ids[n:], offs[n:], msk[n:]
+			}
+
+			for len(buf) >= winsize+1 {
+				if !window() {
+					return
+				}
+
+				drop := min(stride, len(buf))
+				seen, skip = winsize+1-drop, stride-drop
+				buf = append([]int(nil), buf[drop:]...)
+				ids = append([]int(nil), ids[drop:]...)
+				offs = append([]int(nil), offs[drop:]...)
+				msk = append([]bool(nil), msk[drop:]...)
+			}
+		}
+
+		if len(buf) <= max(1, seen) {
+			return
+		}
+
+		for len(buf) < winsize+1 {
+			buf = append(buf, padind)
+			ids = append(ids, doc)
+			offs = append(offs, 0)
+			msk = append(msk, first < 0)
 		}
+
+		window()
 	}
 }
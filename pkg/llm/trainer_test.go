@@ -0,0 +1,252 @@
+package llm
+
+import (
+	"gonum.org/v1/gonum/mat"
+	"iter"
+	"math"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+func Test_windows(t *testing.T) {
+	const padind = 9
+
+	tests := []struct {
+		docs    [][]int
+		winsize int
+		cfg     TrainConfig
+		output  []example
+	}{
+		{
+			docs:    [][]int{{1, 2, 3, 4, 5}, {6, 7}},
+			winsize: 4,
+			output: []example{
+				{input: []int{1, 2, 3, 4}, target: []int{2, 3, 4, 5}},
+				{input: []int{3, 4, 5, 9}, target: []int{4, 5, 9, 9}},
+				{input: []int{6, 7, 9, 9}, target: []int{7, 9, 9, 9}},
+			},
+		},
+		{
+			docs:    [][]int{{1, 2, 3, 4, 5}, {6, 7}},
+			winsize: 4,
+			cfg:     TrainConfig{Stride: 1},
+			output: []example{
+				{input: []int{1, 2, 3, 4}, target: []int{2, 3, 4, 5}},
+				{input: []int{2, 3, 4, 5}, target: []int{3, 4, 5, 9}},
+				{input: []int{6, 7, 9, 9}, target: []int{7, 9, 9, 9}},
+			},
+		},
+		{
+			docs:    [][]int{{1, 2, 3}, {4, 5}, {6, 7, 8}},
+			winsize: 3,
+			cfg:     TrainConfig{Pack: true, Stride: 3},
+			output: []example{
+				{input: []int{1, 2, 3}, target: []int{2, 3, 4}},
+				{input: []int{4, 5, 6}, target: []int{5, 6, 7}},
+				{input: []int{7, 8, 9}, target: []int{8, 9, 9}},
+			},
+		},
+		{
+			docs:    [][]int{{1, 2}, {3, 4, 5}, {6}},
+			winsize: 4,
+			cfg:     TrainConfig{Pack: true, Reset: true, Stride: 4},
+			output: []example{
+				{
+					input:  []int{1, 2, 3, 4},
+					target: []int{2, 3, 4, 5},
+					docs:   []int{0, 0, 1, 1},
+				},
+				{
+					input:  []int{5, 6, 9, 9},
+					target: []int{6, 9, 9, 9},
+					docs:   []int{1, 2, 3, 3},
+				},
+			},
+		},
+		{
+			docs:    [][]int{{1, 2, 3, 4}},
+			winsize: 2,
+			cfg:     TrainConfig{Pack: true},
+			output: []example{
+				{input: []int{1, 2}, target: []int{2, 3}},
+				{input: []int{2, 3}, target: []int{3, 4}},
+			},
+		},
+		{
+			docs:    [][]int{{1, 2, 3, 4}, {5, 6, 7, 8}},
+			winsize: 2,
+			cfg:     TrainConfig{Pack: true, Stride: 5},
+			output: []example{
+				{input: []int{1, 2}, target: []int{2, 3}},
+				{input: []int{6, 7}, target: []int{7, 8}},
+			},
+		},
+	}
+
+	for i, test := range tests {
+		var docs iter.Seq2[[]int, []bool] = func(yield func([]int, []bool) bool) {
+			for _, doc := range test.docs {
+				if !yield(slices.Clone(doc), nil) {
+					return
+				}
+			}
+		}
+
+		output := slices.Collect(windows(docs, test.winsize, padind, test.cfg))
+
+		if !reflect.DeepEqual(output, test.output) {
+			t.Errorf("%d: expected %v, got %v", i, test.output, output)
+		}
+	}
+}
+
+func Test_windows_Mask(t *testing.T) {
+	const padind = 9
+
+	docs := [][]int{{1, 2, 3}, {4, 5, 6}}
+	masks := [][]bool{nil, {false, true, true}}
+
+	var seq iter.Seq2[[]int, []bool] = func(yield func([]int, []bool) bool) {
+		for index := range docs {
+			if !yield(slices.Clone(docs[index]), slices.Clone(masks[index])) {
+				return
+			}
+		}
+	}
+
+	tests := []struct {
+		cfg    TrainConfig
+		output []example
+	}{
+		{
+			cfg: TrainConfig{Stride: 2},
+			output: []example{
+				{input: []int{1, 2}, target: []int{2, 3}},
+				{input: []int{4, 5}, target: []int{5, 6}, mask: []bool{true, true}},
+			},
+		},
+		{
+			cfg: TrainConfig{Stride: 1},
+			output: []example{
+				{input: []int{1, 2}, target: []int{2, 3}},
+				{input: []int{2, 3}, target: []int{3, 9}},
+				{input: []int{4, 5}, target: []int{5, 6}, mask: []bool{true, true}},
+				{input: []int{5, 6}, target: []int{6, 9}, mask: []bool{true, false}},
+			},
+		},
+		{
+			cfg: TrainConfig{Pack: true, Stride: 4},
+			output: []example{
+				{
+					input:  []int{1, 2, 3, 4},
+					target: []int{2, 3, 4, 5},
+					mask:   []bool{true, true, false, true},
+				},
+				{
+					input:  []int{5, 6, 9, 9},
+					target: []int{6, 9, 9, 9},
+					mask:   []bool{true, false, false, false},
+				},
+			},
+		},
+	}
+
+	for i, test := range tests {
+		output := slices.Collect(windows(seq, len(test.output[0].input), padind, test.cfg))
+
+		if !reflect.DeepEqual(output, test.output) {
+			t.Errorf("%d: expected %v, got %v", i, test.output, output)
+		}
+	}
+}
+
+func Test_loss(t *testing.T) {
+	tests := []struct {
+		output *mat.Dense
+		exam   example
+		loss   float64
+		grad   *mat.Dense
+	}{
+		{
+			output: mat.NewDense(2, 2, []float64{
+				0, 0,
+				0, math.Log(3),
+			}),
+			exam: example{target: []int{0, 1}},
+			loss: -(math.Log(.5) + math.Log(.75)) / 2,
+			grad: mat.NewDense(2, 2, []float64{
+				-.5, .5,
+				.25, -.25,
+			}),
+		},
+		{
+			output: mat.NewDense(2, 2, []float64{
+				0, 0,
+				0, math.Log(3),
+			}),
+			exam: example{target: []int{0, 1}, mask: []bool{false, true}},
+			loss: -math.Log(.75),
+			grad: mat.NewDense(2, 2, []float64{
+				0, 0,
+				.25, -.25,
+			}),
+		},
+	}
+
+	for i, test := range tests {
+		loss := loss(test.output, test.exam, 0, 0)
+
+		if math.Abs(loss-test.loss) > 1e-9 {
+			t.Errorf("%d: expected loss %v, got %v", i, test.loss, loss)
+		}
+
+		if !mat.EqualApprox(test.output, test.grad, 1e-9) {
+			t.Errorf("%d: expected grad %v, got %v", i, test.grad, test.output)
+		}
+	}
+}
+
+func Test_Train_Reproducible(t *testing.T) {
+	root := t.TempDir()
+
+	docs := sliceSource{
+		{6, 7, 8, 9, 2},
+		{8, 9, 6, 2},
+		{7, 6, 9, 8, 7, 2},
+	}
+
+	cfg := TrainConfig{
+		DropoutP: .2,
+		LR:       .01,
+		Workers:  1,
+		Epochs:   2,
+		Seed:     5,
+		Shuffle:  true,
+	}
+
+	run := func(name string) *LLM {
+		llm := NewWith(Config{CtxSize: 4, Vocab: vocab.Len(), Dim: 4, Layers: 1, Heads: 2, Seed: 3})
+		cfg.SaveIn = filepath.Join(root, name)
+		Train(llm, docs, vocab, cfg)
+		return llm
+	}
+
+	first, second := run("a.gob"), run("b.gob")
+
+	for name, w := range first.Params() {
+		if !mat.Equal(w, second.Params()[name]) {
+			t.Errorf("%s differs between runs", name)
+		}
+	}
+
+	// продолжение с чекпоинта повторяет ту же последовательность dropout
+	loaded := Load(filepath.Join(root, "a.gob"))
+	input := []int{6, 7, 8, 9}
+	expected := first.Forward(input, .5)
+
+	if !mat.Equal(expected, loaded.Forward(input, .5)) {
+		t.Errorf("loaded RNG state differs")
+	}
+}
@@ -0,0 +1,190 @@
+package lora
+
+import (
+	"encoding/gob"
+	"gonum.org/v1/gonum/mat"
+	"llm/pkg/lib"
+	"os"
+)
+
+/*
+Adapter - низкоранговая добавка A·B·Scale к матрице весов W.
+Методы допускают nil получателя, тогда они ничего не делают.
+*/
+type Adapter struct {
+	A,
+	B *mat.Dense
+	Scale  float64
+	lr     float64
+	params lib.Params
+	state  State
+}
+
+// State - активации одного вызова Forward, нужные Backward.
+type State struct {
+	input,
+	hidden *mat.Dense
+}
+
+// Forward прибавляет к output вклад адаптера для input.
+func (ad *Adapter) Forward(input, output *mat.Dense) {
+	if ad == nil {
+		return
+	}
+
+	ad.ForwardWith(&ad.state, input, output)
+}
+
+// ForwardWith аналогичен Forward, но сохраняет активации в state.
+func (ad *Adapter) ForwardWith(state *State, input, output *mat.Dense) {
+	if ad == nil {
+		return
+	}
+
+	state.input, state.hidden = input, ad.add(input, output)
+}
+
+// Infer аналогичен Forward, но ничего не сохраняет для Backward.
+func (ad *Adapter) Infer(input, output *mat.Dense) {
+	if ad == nil {
+		return
+	}
+
+	ad.add(input, output)
+}
+
+func (ad *Adapter) add(input, output *mat.Dense) *mat.Dense {
+	var hidden mat.Dense
+	lib.Mul(&hidden, input, ad.A)
+
+	var delta mat.Dense
+	lib.Mul(&delta, &hidden, ad.B)
+	lib.Scale(&delta, ad.Scale, &delta)
+	lib.Add(output, output, &delta)
+
+	return &hidden
+}
+
+/*
+Backward прибавляет к input градиент адаптера по входу
+и обновляет A и B со скоростью обучения адаптера
+и их настройками, см. Set.SetParams.
+*/
+func (ad *Adapter) Backward(output, input *mat.Dense) {
+	if ad == nil {
+		return
+	}
+
+	ad.BackwardWith(&ad.state, output, input)
+}
+
+// BackwardWith аналогичен Backward для активаций state.
+func (ad *Adapter) BackwardWith(state *State, output, input *mat.Dense) {
+	if ad == nil {
+		return
+	}
+
+	var scaled mat.Dense
+	lib.Scale(&scaled, ad.Scale, output)
+
+	var b, hidden mat.Dense
+	lib.TMul(&b, state.hidden, &scaled)
+	lib.MulT(&hidden, &scaled, ad.B)
+
+	var a, in mat.Dense
+	lib.TMul(&a, state.input, &hidden)
+	lib.MulT(&in, &hidden, ad.A)
+	lib.Add(input, input, &in)
+
+	ad.params.Step(ad.A, &a, ad.lr)
+	ad.params.Step(ad.B, &b, ad.lr)
+}
+
+// Merge прибавляет адаптер к весам w.
+func (ad *Adapter) Merge(w *mat.Dense) {
+	var delta mat.Dense
+	lib.Mul(&delta, ad.A, ad.B)
+	lib.Scale(&delta, ad.Scale, &delta)
+	lib.Add(w, w, &delta)
+}
+
+func (ad *Adapter) ParamN() int {
+	return lib.ParamN(ad.A) + lib.ParamN(ad.B)
+}
+
+/*
+NewAdapter создает адаптер ранга rank для матрицы r×c.
+B нулевая, поэтому новый адаптер не меняет выход модели.
+*/
+func NewAdapter(rng *lib.RNG, r, c, rank int, alpha float64) *Adapter {
+	return &Adapter{
+		A:     lib.Xavier(rng, r, rank),
+		B:     mat.NewDense(rank, c, nil),
+		Scale: alpha / float64(rank),
+	}
+}
+
+// Set - адаптеры модели по именам матриц, например Layers.0.MHA.WOutput.
+type Set struct {
+	Rank     int
+	Alpha    float64
+	Adapters map[string]*Adapter
+}
+
+// SetLR задает скорость обучения всех адаптеров.
+func (set *Set) SetLR(lr float64) {
+	for _, ad := range set.Adapters {
+		ad.lr = lr
+	}
+}
+
+// SetParams задает настройки обновления A и B всех адаптеров.
+func (set *Set) SetParams(params lib.Params) {
+	for _, ad := range set.Adapters {
+		ad.params = params
+	}
+}
+
+func (set *Set) ParamN() int {
+	var sum int
+
+	for _, ad := range set.Adapters {
+		sum += ad.ParamN()
+	}
+
+	return sum
+}
+
+func Load(src string) *Set {
+	var set Set
+
+	file, err := os.Open(src)
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+
+	err = gob.
+		NewDecoder(file).
+		Decode(&set)
+	if err != nil {
+		panic(err)
+	}
+
+	return &set
+}
+
+func (set *Set) Save(trg string) {
+	file, err := os.Create(trg)
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+
+	err = gob.
+		NewEncoder(file).
+		Encode(set)
+	if err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,168 @@
+package lora
+
+import (
+	"gonum.org/v1/gonum/mat"
+	"llm/pkg/lib"
+	"math"
+	"testing"
+)
+
+func Test_Adapter_Forward(t *testing.T) {
+	tests := []struct {
+		ad *Adapter
+		input,
+		output *mat.Dense
+	}{
+		{
+			ad: &Adapter{
+				A: mat.NewDense(2, 1, []float64{
+					.1,
+					.2,
+				}),
+				B: mat.NewDense(1, 2, []float64{
+					.3, .4,
+				}),
+				Scale: 2,
+			},
+			input: mat.NewDense(2, 2, []float64{
+				1, 2,
+				3, 4,
+			}),
+			output: mat.NewDense(2, 2, []float64{
+				1.3, 1.4,
+				1.66, 1.88,
+			}),
+		},
+		{
+			input: mat.NewDense(1, 1, []float64{
+				1,
+			}),
+			output: mat.NewDense(1, 1, []float64{
+				1,
+			}),
+		},
+	}
+
+	for i, test := range tests {
+		output := mat.DenseCopyOf(test.output)
+		output.Apply(func(_, _ int, _ float64) float64 { return 1 }, output)
+
+		test.ad.Forward(test.input, output)
+
+		if !mat.EqualApprox(output, test.output, 1e-9) {
+			t.Errorf("%d: expected %v, got %v", i, test.output, output)
+		}
+	}
+}
+
+func Test_Adapter_Backward(t *testing.T) {
+	const eps = 1e-6
+
+	input := mat.NewDense(3, 2, []float64{
+		.5, -.2,
+		.4, .6,
+		-.3, .1,
+	})
+
+	ad := NewAdapter(lib.NewRNG(1), 2, 4, 2, 4)
+	ad.B = mat.NewDense(2, 4, []float64{
+		.1, -.2, .3, .4,
+		-.5, .6, .7, -.8,
+	})
+
+	grad := mat.NewDense(3, 4, []float64{
+		.1, .2, .3, .4,
+		-.1, .5, .2, -.3,
+		.3, -.4, .1, .2,
+	})
+
+	loss := func() float64 {
+		output := mat.NewDense(3, 4, nil)
+		ad.Forward(input, output)
+		return mat.Sum(mulElem(output, grad))
+	}
+
+	numerical := func(m *mat.Dense) *mat.Dense {
+		r, c := m.Dims()
+		num := mat.NewDense(r, c, nil)
+
+		for i := range r {
+			for j := range c {
+				val := m.At(i, j)
+
+				m.Set(i, j, val+eps)
+				plus := loss()
+				m.Set(i, j, val-eps)
+				minus := loss()
+				m.Set(i, j, val)
+
+				num.Set(i, j, (plus-minus)/(2*eps))
+			}
+		}
+
+		return num
+	}
+
+	expA, expB, expInput := numerical(ad.A), numerical(ad.B), numerical(input)
+
+	a, b := mat.DenseCopyOf(ad.A), mat.DenseCopyOf(ad.B)
+
+	loss()
+	ad.lr = 1
+	dinput := mat.NewDense(3, 2, nil)
+	ad.Backward(grad, dinput)
+
+	var gotA, gotB mat.Dense
+	gotA.Sub(a, ad.A)
+	gotB.Sub(b, ad.B)
+
+	for _, check := range []struct {
+		name string
+		exp,
+		got mat.Matrix
+	}{
+		{"A", expA, &gotA},
+		{"B", expB, &gotB},
+		{"input", expInput, dinput},
+	} {
+		if !mat.EqualApprox(check.exp, check.got, 1e-6) {
+			t.Errorf("%s: expected %v, got %v", check.name,
+				mat.Formatted(check.exp), mat.Formatted(check.got))
+		}
+	}
+}
+
+func Test_Adapter_Merge(t *testing.T) {
+	ad := NewAdapter(lib.NewRNG(1), 2, 2, 1, 1)
+	ad.B = mat.NewDense(1, 2, []float64{.5, -.5})
+
+	w := mat.NewDense(2, 2, []float64{
+		.1, .2,
+		.3, .4,
+	})
+
+	input := mat.NewDense(1, 2, []float64{1, 2})
+
+	var adapted mat.Dense
+	adapted.Mul(input, w)
+	ad.Forward(input, &adapted)
+
+	ad.Merge(w)
+
+	var merged mat.Dense
+	merged.Mul(input, w)
+
+	if !mat.EqualApprox(&adapted, &merged, 1e-12) {
+		t.Errorf("expected %v, got %v", adapted, merged)
+	}
+
+	if math.Abs(ad.Scale-1) > 1e-12 {
+		t.Errorf("expected scale 1, got %v", ad.Scale)
+	}
+}
+
+func mulElem(a, b *mat.Dense) *mat.Dense {
+	var res mat.Dense
+	res.MulElem(a, b)
+	return &res
+}
@@ -1,90 +1,259 @@
 package mha
 
 import (
+	"gonum.org/v1/gonum/floats"
 	"gonum.org/v1/gonum/mat"
 	"llm/pkg/lib"
+	"llm/pkg/lora"
 	"math"
-	"sync"
 )
 
 type Head struct {
 	WQuery *mat.Dense
 	WKey   *mat.Dense
 	WValue *mat.Dense
+	state  HeadState
+	aquery,
+	akey,
+	avalue *lora.Adapter
+	params lib.Params
+}
+
+// HeadState - активации одного вызова Head.ForwardWith, нужные Backward.
+type HeadState struct {
 	input,
 	query,
 	key,
-	value,
-	scores *mat.Dense
+	value *mat.Dense
+	// scores - веса внимания каждой последовательности входа.
+	scores []*mat.Dense
+	// spans - границы последовательностей входа.
+	spans [][2]int
+	aquery,
+	akey,
+	avalue lora.State
+	// arena - память матриц вызова, используемая повторно.
+	arena lib.Arena
+}
+
+// SetParams задает настройки обновления весов головы.
+func (head *Head) SetParams(params lib.Params) {
+	head.params = params
+}
+
+// Adapt подключает адаптеры к WQuery, WKey и WValue, nil отключает.
+func (head *Head) Adapt(query, key, value *lora.Adapter) {
+	head.aquery, head.akey, head.avalue = query, key, value
 }
 
+/*
+Forward вычисляет выход головы и сохраняет активации для Backward.
+В отличие от ForwardWith возвращает новую матрицу, которую следующие
+вызовы не меняют.
+*/
 func (head *Head) Forward(input *mat.Dense) *mat.Dense {
-	var query, key, value mat.Dense
-	query.Mul(input, head.WQuery)
-	key.Mul(input, head.WKey)
-	value.Mul(input, head.WValue)
+	return mat.DenseCopyOf(head.ForwardWith(&head.state, input, nil, nil))
+}
 
-	sqrt := math.Sqrt(float64(lib.Coln(head.WKey)))
+/*
+ForwardWith аналогичен Forward, но сохраняет активации в state.
+Строки input по порядку делятся на независимые последовательности
+длины lens[i], nil означает одну последовательность. Внимание
+не выходит за последовательность и документ строки docs, nil снимает
+ограничение документами. Вызовы с разными state могут выполняться
+одновременно. Память матриц state используется повторно, поэтому выход
+и результат BackwardWith действительны до следующего вызова с тем же state.
+*/
+func (head *Head) ForwardWith(state *HeadState, input *mat.Dense, lens, docs []int) *mat.Dense {
+	state.arena.Reset()
+	query, key, value := head.project(&state.arena, input)
+
+	head.aquery.ForwardWith(&state.aquery, input, query)
+	head.akey.ForwardWith(&state.akey, input, key)
+	head.avalue.ForwardWith(&state.avalue, input, value)
+
+	spans := lib.AppendSpans(state.spans[:0], lens, lib.Rown(input))
+	scores, output := head.attend(&state.arena, state.scores[:0], query, key, value, spans, docs)
+
+	state.input = input
+	state.query = query
+	state.key = key
+	state.value = value
+	state.scores = scores
+	state.spans = spans
+
+	return output
+}
 
-	var scores mat.Dense
-	scores.Mul(&query, key.T())
-	scores.Scale(1./sqrt, &scores)
-	lib.Mask(&scores, &scores)
-	lib.Softmax(&scores, &scores)
+/*
+Infer вычисляет выход головы без ограничения документами, ничего
+не сохраняя для Backward. Может вызываться одновременно из нескольких горутин.
+*/
+func (head *Head) Infer(input *mat.Dense) *mat.Dense {
+	query, key, value := head.project(nil, input)
 
-	var output mat.Dense
-	output.Mul(&scores, &value)
+	head.aquery.Infer(input, query)
+	head.akey.Infer(input, key)
+	head.avalue.Infer(input, value)
 
-	head.input = input
-	head.query = &query
-	head.key = &key
-	head.value = &value
-	head.scores = &scores
+	_, output := head.attend(nil, nil, query, key, value, lib.Spans(nil, lib.Rown(input)), nil)
 
-	return &output
+	return output
 }
 
+/*
+inferCached продолжает последовательности caches: строки input по порядку
+делятся на части длины lens[i], i-я часть - позиции caches[i], следующие
+за уже обработанными. Ключи и значения новых позиций добавляются в кэши
+под номером головы index.
+*/
+func (head *Head) inferCached(index int, caches []*Cache, lens []int, input *mat.Dense) *mat.Dense {
+	query, key, value := head.project(nil, input)
+
+	head.aquery.Infer(input, query)
+	head.akey.Infer(input, key)
+	head.avalue.Infer(input, value)
+
+	wcol := lib.Coln(head.WKey)
+	sqrt := math.Sqrt(float64(wcol))
+	output := mat.NewDense(lib.Rown(input), wcol, nil)
+
+	var start int
+	for i, cache := range caches {
+		end := start + lens[i]
+		if end == start {
+			continue
+		}
+
+		for row := start; row < end; row++ {
+			cache.keys[index] = append(cache.keys[index], key.RawRowView(row)...)
+			cache.values[index] = append(cache.values[index], value.RawRowView(row)...)
+		}
+
+		n := cache.n + lens[i]
+		keys := mat.NewDense(n, wcol, cache.keys[index])
+		values := mat.NewDense(n, wcol, cache.values[index])
+
+		var scores mat.Dense
+		lib.MulT(&scores, lib.Rows(query, start, end), keys)
+		lib.Scale(&scores, 1./sqrt, &scores)
+		lib.CausalMask(&scores, &scores, cache.n)
+		lib.Softmax(&scores, &scores)
+
+		lib.Mul(lib.Rows(output, start, end), &scores, values)
+
+		start = end
+	}
+
+	return output
+}
+
+func (head *Head) project(arena *lib.Arena, input *mat.Dense) (query, key, value *mat.Dense) {
+	rown, wcol := lib.Rown(input), lib.Coln(head.WKey)
+	query, key, value = arena.Get(rown, wcol), arena.Get(rown, wcol), arena.Get(rown, wcol)
+	lib.Mul(query, input, head.WQuery)
+	lib.Mul(key, input, head.WKey)
+	lib.Mul(value, input, head.WValue)
+	return query, key, value
+}
+
+/*
+attend вычисляет внимание отдельно для каждой последовательности spans.
+Веса внимания добавляются к scores.
+*/
+func (head *Head) attend(
+	arena *lib.Arena,
+	scores []*mat.Dense,
+	query, key, value *mat.Dense,
+	spans [][2]int,
+	docs []int) ([]*mat.Dense, *mat.Dense) {
+
+	wcol := lib.Coln(head.WKey)
+	sqrt := math.Sqrt(float64(wcol))
+
+	output := arena.Get(lib.Rown(query), wcol)
+
+	for _, span := range spans {
+		start, end := span[0], span[1]
+
+		var seqdocs []int
+		if docs != nil {
+			seqdocs = docs[start:end]
+		}
+
+		block := arena.Get(end-start, end-start)
+		lib.MulT(block, arena.Rows(query, start, end), arena.Rows(key, start, end))
+		lib.Scale(block, 1./sqrt, block)
+		lib.DocMask(block, block, seqdocs)
+		lib.Softmax(block, block)
+
+		lib.Mul(arena.Rows(output, start, end), block, arena.Rows(value, start, end))
+
+		scores = append(scores, block)
+	}
+
+	return scores, output
+}
+
+// Backward возвращает градиент по входу новой матрицей, как Forward.
 func (head *Head) Backward(output *mat.Dense, lr float64) *mat.Dense {
-	var softmax mat.Dense
-	softmax.Mul(output, head.value.T())
+	return mat.DenseCopyOf(head.BackwardWith(&head.state, output, lr))
+}
 
-	var mul mat.Dense
-	mul.MulElem(&softmax, head.scores)
+// BackwardWith аналогичен Backward для активаций state.
+func (head *Head) BackwardWith(state *HeadState, output *mat.Dense, lr float64) *mat.Dense {
+	rown, wcol := lib.Rown(output), lib.Coln(head.WKey)
+	icol := lib.Rown(head.WKey)
+	sqrt := math.Sqrt(float64(wcol))
+	arena := &state.arena
 
-	var sub mat.Dense
-	lib.SubVec(&sub, &softmax, lib.RowSums(&mul))
+	query, key, value := arena.Get(rown, wcol), arena.Get(rown, wcol), arena.Get(rown, wcol)
 
-	sqrt := math.Sqrt(float64(lib.Coln(head.WKey)))
+	for index, span := range state.spans {
+		start, end := span[0], span[1]
+		weights := state.scores[index]
+		grad := arena.Rows(output, start, end)
 
-	var scores mat.Dense
-	scores.MulElem(head.scores, &sub)
-	scores.Scale(1./sqrt, &scores)
+		softmax := arena.Get(end-start, end-start)
+		lib.MulT(softmax, grad, arena.Rows(state.value, start, end))
 
-	var query, key, value mat.Dense
-	query.Mul(&scores, head.key)
-	key.Mul(scores.T(), head.query)
-	value.Mul(head.scores.T(), output)
+		// scores = weights ⊙ (softmax - Σ softmax ⊙ weights по строке) / sqrt
+		scores := softmax
+		for row := range end - start {
+			srow, wrow := softmax.RawRowView(row), weights.RawRowView(row)
+			sum := floats.Dot(srow, wrow)
 
-	inputT := head.input.T()
+			for col, val := range srow {
+				srow[col] = wrow[col] * (val - sum) / sqrt
+			}
+		}
+
+		lib.Mul(arena.Rows(query, start, end), scores, arena.Rows(state.key, start, end))
+		lib.TMul(arena.Rows(key, start, end), scores, arena.Rows(state.query, start, end))
+		lib.TMul(arena.Rows(value, start, end), weights, grad)
+	}
 
-	var wquery, wkey, wvalue mat.Dense
-	wquery.Mul(inputT, &query)
-	wkey.Mul(inputT, &key)
-	wvalue.Mul(inputT, &value)
+	wquery, wkey, wvalue := arena.Get(icol, wcol), arena.Get(icol, wcol), arena.Get(icol, wcol)
+	lib.TMul(wquery, state.input, query)
+	lib.TMul(wkey, state.input, key)
+	lib.TMul(wvalue, state.input, value)
 
-	var input, input2, input3 mat.Dense
-	input.Mul(&query, head.WQuery.T())
-	input2.Mul(&key, head.WKey.T())
-	input3.Mul(&value, head.WValue.T())
+	input, part := arena.Get(rown, icol), arena.Get(rown, icol)
+	lib.MulT(input, query, head.WQuery)
+	lib.MulT(part, key, head.WKey)
+	lib.Add(input, input, part)
+	lib.MulT(part, value, head.WValue)
+	lib.Add(input, input, part)
 
-	input.Add(&input, &input2)
-	input.Add(&input, &input3)
+	head.aquery.BackwardWith(&state.aquery, query, input)
+	head.akey.BackwardWith(&state.akey, key, input)
+	head.avalue.BackwardWith(&state.avalue, value, input)
 
-	lib.Step(head.WQuery, &wquery, lr)
-	lib.Step(head.WKey, &wkey, lr)
-	lib.Step(head.WValue, &wvalue, lr)
+	head.params.Step(head.WQuery, wquery, lr)
+	head.params.Step(head.WKey, wkey, lr)
+	head.params.Step(head.WValue, wvalue, lr)
 
-	return &input
+	return input
 }
 
 func (head *Head) ParamN() int {
@@ -93,81 +262,218 @@ func (head *Head) ParamN() int {
 		lib.ParamN(head.WValue)
 }
 
-func NewHead(icol, wcol int) *Head {
+func NewHead(rng *lib.RNG, icol, wcol int) *Head {
 	return &Head{
-		WQuery: lib.Xavier(icol, wcol),
-		WKey:   lib.Xavier(icol, wcol),
-		WValue: lib.Xavier(icol, wcol),
+		WQuery: lib.Xavier(rng, icol, wcol),
+		WKey:   lib.Xavier(rng, icol, wcol),
+		WValue: lib.Xavier(rng, icol, wcol),
 	}
 }
 
 type MHA struct {
 	Heads   []*Head
 	WOutput *mat.Dense
+	state   State
+	docs    []int
+	aoutput *lora.Adapter
+	params  lib.Params
+}
+
+// State - активации одного вызова MHA.ForwardWith, нужные Backward.
+type State struct {
+	heads   []HeadState
 	concat  *mat.Dense
+	aoutput lora.State
+	// grads - градиенты входа голов для BackwardWith.
+	grads []*mat.Dense
+	arena lib.Arena
 }
 
-func (mha *MHA) Forward(input *mat.Dense) *mat.Dense {
-	results := make([]*mat.Dense, len(mha.Heads))
-
-	var wg sync.WaitGroup
-	wg.Add(len(mha.Heads))
-	for index := range mha.Heads {
-		go func(index int) {
-			results[index] = mha.Heads[index].Forward(input)
-			wg.Done()
-		}(index)
+// SetParams задает настройки обновления весов блока и всех голов.
+func (mha *MHA) SetParams(params lib.Params) {
+	mha.params = params
+
+	for _, head := range mha.Heads {
+		head.SetParams(params)
 	}
-	wg.Wait()
+}
 
-	var concat mat.Dense
-	for _, res := range results {
-		lib.Concat(&concat, res)
+// Adapt подключает адаптер к WOutput, nil отключает.
+func (mha *MHA) Adapt(output *lora.Adapter) {
+	mha.aoutput = output
+}
+
+/*
+SetDocs задает номера документов для позиций следующих вызовов Forward,
+чтобы внимание не выходило за границы документа. nil снимает ограничение.
+*/
+func (mha *MHA) SetDocs(docs []int) {
+	mha.docs = docs
+}
+
+// Forward аналогичен Head.Forward: выход - новая матрица.
+func (mha *MHA) Forward(input *mat.Dense) *mat.Dense {
+	return mat.DenseCopyOf(mha.ForwardWith(&mha.state, input, nil, mha.docs))
+}
+
+/*
+ForwardWith аналогичен Forward, но сохраняет активации в state,
+а входом служат последовательности lens с документами docs,
+см. Head.ForwardWith. SetDocs не учитывается. Вызовы с разными state
+могут выполняться одновременно, выход действителен до следующего
+вызова с тем же state.
+*/
+func (mha *MHA) ForwardWith(state *State, input *mat.Dense, lens, docs []int) *mat.Dense {
+	if len(state.heads) != len(mha.Heads) {
+		state.heads = make([]HeadState, len(mha.Heads))
 	}
+	state.arena.Reset()
+
+	concat := mha.heads(&state.arena, input, func(index int, head *Head, input *mat.Dense) *mat.Dense {
+		return head.ForwardWith(&state.heads[index], input, lens, docs)
+	})
+
+	output := state.arena.Get(lib.Rown(input), lib.Coln(mha.WOutput))
+	lib.Mul(output, concat, mha.WOutput)
+	mha.aoutput.ForwardWith(&state.aoutput, concat, output)
+
+	state.concat = concat
+
+	return output
+}
+
+// Infer аналогичен Head.Infer для всех голов.
+func (mha *MHA) Infer(input *mat.Dense) *mat.Dense {
+	concat := mha.heads(nil, input, func(_ int, head *Head, input *mat.Dense) *mat.Dense {
+		return head.Infer(input)
+	})
 
 	var output mat.Dense
-	output.Mul(&concat, mha.WOutput)
+	lib.Mul(&output, concat, mha.WOutput)
+	mha.aoutput.Infer(concat, &output)
 
-	mha.concat = &concat
+	return &output
+}
+
+/*
+Cache - ключи и значения обработанных позиций одной последовательности,
+позволяющие вычислять следующие позиции без повторного прохода по всем.
+Нулевое значение - пустой кэш.
+*/
+type Cache struct {
+	// keys[h] и values[h] - строки головы h подряд.
+	keys,
+	values [][]float64
+	n int
+}
+
+// Len возвращает число позиций в кэше.
+func (cache *Cache) Len() int {
+	return cache.n
+}
+
+// Reset очищает кэш, сохраняя выделенную память.
+func (cache *Cache) Reset() {
+	for index := range cache.keys {
+		cache.keys[index] = cache.keys[index][:0]
+		cache.values[index] = cache.values[index][:0]
+	}
+	cache.n = 0
+}
+
+/*
+InferCached аналогичен Infer для продолжения нескольких последовательностей
+сразу: строки input по порядку делятся на части длины lens[i], i-я часть -
+позиции, следующие за caches[i]. Внимание не выходит за свою
+последовательность, ключи и значения новых позиций добавляются в кэши.
+Кэш одновременно может продолжать только один вызов.
+*/
+func (mha *MHA) InferCached(caches []*Cache, lens []int, input *mat.Dense) *mat.Dense {
+	for _, cache := range caches {
+		if cache.keys == nil {
+			cache.keys = make([][]float64, len(mha.Heads))
+			cache.values = make([][]float64, len(mha.Heads))
+		}
+	}
+
+	concat := mha.heads(nil, input, func(index int, head *Head, input *mat.Dense) *mat.Dense {
+		return head.inferCached(index, caches, lens, input)
+	})
+
+	for index, cache := range caches {
+		cache.n += lens[index]
+	}
+
+	var output mat.Dense
+	lib.Mul(&output, concat, mha.WOutput)
+	mha.aoutput.Infer(concat, &output)
 
 	return &output
 }
 
+/*
+heads вызывает forward всех голов параллельно и склеивает результаты
+в матрицу из arena.
+*/
+func (mha *MHA) heads(
+	arena *lib.Arena,
+	input *mat.Dense,
+	forward func(int, *Head, *mat.Dense) *mat.Dense) *mat.Dense {
+
+	wcol := lib.Coln(mha.Heads[0].WKey)
+	concat := arena.Get(lib.Rown(input), len(mha.Heads)*wcol)
+
+	lib.Parallel(len(mha.Heads), func(index int) {
+		res := forward(index, mha.Heads[index], input)
+		for row := range lib.Rown(res) {
+			copy(concat.RawRowView(row)[index*wcol:], res.RawRowView(row))
+		}
+	})
+
+	return concat
+}
+
 func (mha *MHA) Backward(output *mat.Dense, lr float64) *mat.Dense {
-	var concat mat.Dense
-	concat.Mul(output, mha.WOutput.T())
+	return mat.DenseCopyOf(mha.BackwardWith(&mha.state, output, lr))
+}
 
-	grads := lib.Split(&concat, len(mha.Heads))
-	var input mat.Dense
+// BackwardWith аналогичен Backward для активаций state.
+func (mha *MHA) BackwardWith(state *State, output *mat.Dense, lr float64) *mat.Dense {
+	arena := &state.arena
 
-	var mut sync.Mutex
+	concat := arena.Get(lib.Rown(output), lib.Rown(mha.WOutput))
+	lib.MulT(concat, output, mha.WOutput)
+	mha.aoutput.BackwardWith(&state.aoutput, output, concat)
 
-	var wg sync.WaitGroup
-	wg.Add(len(grads))
-	for index := range grads {
-		go func(index int) {
-			defer wg.Done()
+	n, wcol := len(mha.Heads), lib.Coln(mha.Heads[0].WKey)
+	if len(state.grads) != n {
+		state.grads = make([]*mat.Dense, n)
+	}
 
-			res := mha.Heads[index].Backward(grads[index], lr)
+	for index := range n {
+		state.grads[index] = arena.Cols(concat, index*wcol, (index+1)*wcol)
+	}
 
-			mut.Lock()
-			defer mut.Unlock()
+	woutput := arena.Get(lib.Rown(mha.WOutput), lib.Coln(mha.WOutput))
 
-			if input.IsEmpty() {
-				input.CloneFrom(res)
-				return
-			}
+	// последняя задача обновляет WOutput параллельно с головами
+	lib.Parallel(n+1, func(index int) {
+		if index == n {
+			lib.TMul(woutput, state.concat, output)
+			mha.params.Step(mha.WOutput, woutput, lr)
+			return
+		}
 
-			input.Add(&input, res)
-		}(index)
-	}
+		state.grads[index] = mha.Heads[index].BackwardWith(&state.heads[index], state.grads[index], lr)
+	})
 
-	var woutput mat.Dense
-	woutput.Mul(mha.concat.T(), output)
-	lib.Step(mha.WOutput, &woutput, lr)
+	// сумма по порядку голов не зависит от порядка их завершения
+	input := arena.Get(lib.Rown(output), lib.Coln(mha.WOutput))
+	for _, res := range state.grads {
+		lib.Add(input, input, res)
+	}
 
-	wg.Wait()
-	return &input
+	return input
 }
 
 func (mha *MHA) ParamN() int {
@@ -180,15 +486,15 @@ func (mha *MHA) ParamN() int {
 	return sum
 }
 
-func New(h, icol int, wcol int) *MHA {
+func New(rng *lib.RNG, h, icol int, wcol int) *MHA {
 	heads := make([]*Head, h)
 
 	for index := range h {
-		heads[index] = NewHead(icol, wcol)
+		heads[index] = NewHead(rng, icol, wcol)
 	}
 
 	return &MHA{
 		Heads:   heads,
-		WOutput: lib.Xavier(h*wcol, icol),
+		WOutput: lib.Xavier(rng, h*wcol, icol),
 	}
 }
@@ -1,8 +1,10 @@
 package mha
 
 import (
+	"fmt"
 	"gonum.org/v1/gonum/floats"
 	"gonum.org/v1/gonum/mat"
+	"llm/pkg/gradcheck"
 	"llm/pkg/lib"
 	"testing"
 )
@@ -168,7 +170,7 @@ func Test_Head_New(t *testing.T) {
 	}
 
 	for i, test := range tests {
-		head := NewHead(test.icol, test.wcol)
+		head := NewHead(lib.NewRNG(1), test.icol, test.wcol)
 
 		if lib.Rown(head.WQuery) != lib.Rown(head.WKey) ||
 			lib.Coln(head.WQuery) != lib.Coln(head.WKey) ||
@@ -329,3 +331,131 @@ func Test_Backward(t *testing.T) {
 		}
 	}
 }
+
+func Test_Gradcheck(t *testing.T) {
+	input := lib.Xavier(lib.NewRNG(1), 3, 4)
+
+	head := NewHead(lib.NewRNG(1), 4, 2)
+	mha := New(lib.NewRNG(1), 2, 4, 2)
+
+	params := map[string]*mat.Dense{"WOutput": mha.WOutput}
+	for index, head := range mha.Heads {
+		params[fmt.Sprintf("Heads.%d.WQuery", index)] = head.WQuery
+		params[fmt.Sprintf("Heads.%d.WKey", index)] = head.WKey
+		params[fmt.Sprintf("Heads.%d.WValue", index)] = head.WValue
+	}
+
+	tests := []struct {
+		module gradcheck.Module
+		params map[string]*mat.Dense
+	}{
+		{
+			module: head,
+			params: map[string]*mat.Dense{
+				"WQuery": head.WQuery,
+				"WKey":   head.WKey,
+				"WValue": head.WValue,
+			},
+		},
+		{
+			module: mha,
+			params: params,
+		},
+	}
+
+	for i, test := range tests {
+		results := gradcheck.Check(test.module, input, test.params)
+
+		for _, res := range gradcheck.Failed(results, gradcheck.Tolerance) {
+			t.Errorf("%d: %v", i, res)
+		}
+	}
+}
+
+func Test_InferCached(t *testing.T) {
+	rng := lib.NewRNG(1)
+	mha := New(rng, 2, 4, 2)
+
+	first, second := lib.Xavier(rng, 5, 4), lib.Xavier(rng, 3, 4)
+	caches := []*Cache{{}, {}}
+
+	var input mat.Dense
+	input.Stack(first.Slice(0, 2, 0, 4), second)
+
+	output := mha.InferCached(caches, []int{2, 3}, &input)
+	rest := mha.InferCached(caches[:1], []int{3}, mat.DenseCopyOf(first.Slice(2, 5, 0, 4)))
+
+	var got mat.Dense
+	got.Stack(output.Slice(0, 2, 0, 4), rest)
+
+	tests := []struct {
+		expected,
+		got mat.Matrix
+		n int
+	}{
+		{expected: mha.Infer(first), got: &got, n: 5},
+		{expected: mha.Infer(second), got: output.Slice(2, 5, 0, 4), n: 3},
+	}
+
+	for i, test := range tests {
+		if !mat.EqualApprox(test.expected, test.got, 1e-12) {
+			t.Errorf("%d: expected %v, got %v", i, mat.Formatted(test.expected), mat.Formatted(test.got))
+		}
+
+		if caches[i].Len() != test.n {
+			t.Errorf("%d: expected %d cached positions, got %d", i, test.n, caches[i].Len())
+		}
+	}
+}
+
+// Test_Forward_Fresh - выход Forward не меняется следующими вызовами.
+func Test_Forward_Fresh(t *testing.T) {
+	rng := lib.NewRNG(1)
+	mha := New(rng, 2, 4, 2)
+	first, second := lib.Xavier(rng, 3, 4), lib.Xavier(rng, 3, 4)
+
+	output := mha.Forward(first)
+	head := mha.Heads[0].Forward(first)
+	expected, expHead := mat.DenseCopyOf(output), mat.DenseCopyOf(head)
+
+	input := mha.Backward(lib.Xavier(rng, 3, 4), 0)
+	expInput := mat.DenseCopyOf(input)
+
+	mha.Forward(second)
+	mha.Heads[0].Forward(second)
+	mha.Backward(lib.Xavier(rng, 3, 4), 0)
+
+	if !mat.Equal(output, expected) || !mat.Equal(head, expHead) {
+		t.Errorf("Forward output changed by the next call")
+	}
+
+	if !mat.Equal(input, expInput) {
+		t.Errorf("Backward output changed by the next call")
+	}
+}
+
+func Benchmark_Head_Forward(b *testing.B) {
+	rng := lib.NewRNG(1)
+	head := NewHead(rng, 64, 16)
+	input := lib.Xavier(rng, 64, 64)
+
+	var state HeadState
+
+	b.ReportAllocs()
+	for range b.N {
+		head.ForwardWith(&state, input, nil, nil)
+	}
+}
+
+func Benchmark_Forward(b *testing.B) {
+	rng := lib.NewRNG(1)
+	mha := New(rng, 4, 64, 16)
+	input := lib.Xavier(rng, 64, 64)
+
+	var state State
+
+	b.ReportAllocs()
+	for range b.N {
+		mha.ForwardWith(&state, input, nil, nil)
+	}
+}
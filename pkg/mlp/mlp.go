@@ -3,54 +3,223 @@ package mlp
 import (
 	"gonum.org/v1/gonum/mat"
 	"llm/pkg/lib"
+	"llm/pkg/lora"
 )
 
 type Layer struct {
 	Weights *mat.Dense
 	Bias    *mat.Dense
 
+	state   LayerState
+	adapter *lora.Adapter
+	params  lib.Params
+}
+
+// LayerState - активации одного вызова Layer.ForwardWith, нужные Backward.
+type LayerState struct {
 	input, output *mat.Dense
+	pos           []int
+	adapter       lora.State
+	// arena - память матриц вызова, используемая повторно.
+	arena lib.Arena
+}
+
+// SetParams задает настройки обновления Weights и Bias.
+func (layer *Layer) SetParams(params lib.Params) {
+	layer.params = params
+}
+
+// Adapt подключает адаптер к Weights, nil отключает.
+func (layer *Layer) Adapt(adapter *lora.Adapter) {
+	layer.adapter = adapter
 }
 
+/*
+Forward сохраняет активации для Backward в самом слое, но в отличие
+от ForwardWith возвращает новую матрицу: предыдущий выход остается
+действительным после следующих вызовов.
+*/
 func (layer *Layer) Forward(input *mat.Dense) *mat.Dense {
+	return mat.DenseCopyOf(layer.ForwardWith(&layer.state, input, nil))
+}
+
+/*
+ForwardWith аналогичен Forward, но сохраняет активации в state.
+Если pos задан, строки стоят на позициях pos, см. InferAt.
+Память матриц state используется повторно, поэтому выход и результат
+BackwardWith действительны до следующего вызова с тем же state.
+*/
+func (layer *Layer) ForwardWith(state *LayerState, input *mat.Dense, pos []int) *mat.Dense {
+	state.arena.Reset()
+
+	output := state.arena.Get(lib.Rown(input), lib.Coln(layer.Weights))
+	lib.Mul(output, input, layer.Weights)
+	layer.adapter.ForwardWith(&state.adapter, input, output)
+	layer.addBias(output, pos)
+	state.input, state.output, state.pos = input, output, pos
+	return output
+}
+
+// Infer аналогичен Forward, но ничего не сохраняет для Backward.
+func (layer *Layer) Infer(input *mat.Dense) *mat.Dense {
+	return layer.InferAt(input, nil)
+}
+
+/*
+InferAt аналогичен Infer для строк, стоящих на позициях pos:
+к строке row прибавляется строка смещения pos[row].
+*/
+func (layer *Layer) InferAt(input *mat.Dense, pos []int) *mat.Dense {
 	var output mat.Dense
-	output.Mul(input, layer.Weights)
-	output.Add(&output, layer.Bias)
-	layer.input, layer.output = input, &output
+	lib.Mul(&output, input, layer.Weights)
+	layer.adapter.Infer(input, &output)
+	layer.addBias(&output, pos)
 	return &output
 }
 
+func (layer *Layer) addBias(output *mat.Dense, pos []int) {
+	if pos == nil {
+		lib.Add(output, output, layer.Bias)
+		return
+	}
+
+	lib.GatherAdd(output, layer.Bias, pos)
+}
+
+// Backward, как и Forward, возвращает новую матрицу.
 func (layer *Layer) Backward(output *mat.Dense, lr float64) *mat.Dense {
-	var input, weights mat.Dense
-	weights.Mul(layer.input.T(), output)
-	input.Mul(output, layer.Weights.T())
-	lib.Step(layer.Weights, &weights, lr)
-	lib.Step(layer.Bias, output, lr)
-	return &input
+	return mat.DenseCopyOf(layer.BackwardWith(&layer.state, output, lr))
+}
+
+// BackwardWith аналогичен Backward для активаций state.
+func (layer *Layer) BackwardWith(state *LayerState, output *mat.Dense, lr float64) *mat.Dense {
+	arena := &state.arena
+
+	weights := arena.Get(lib.Rown(layer.Weights), lib.Coln(layer.Weights))
+	lib.TMul(weights, state.input, output)
+	input := arena.Get(lib.Rown(output), lib.Rown(layer.Weights))
+	lib.MulT(input, output, layer.Weights)
+	layer.adapter.BackwardWith(&state.adapter, output, input)
+	layer.params.Step(layer.Weights, weights, lr)
+
+	bias := output
+	if state.pos != nil {
+		bias = arena.Get(lib.Rown(layer.Bias), lib.Coln(layer.Bias))
+		lib.ScatterAdd(bias, output, state.pos)
+	}
+	layer.params.Step(layer.Bias, bias, lr)
+
+	return input
 }
 
 func (layer *Layer) ParamN() int {
 	return lib.ParamN(layer.Weights) + lib.ParamN(layer.Bias)
 }
 
-func NewLayer(irow, icol, wcol int) *Layer {
+func NewLayer(rng *lib.RNG, irow, icol, wcol int) *Layer {
 	return &Layer{
-		Weights: lib.He(icol, wcol),
+		Weights: lib.He(rng, icol, wcol),
 		Bias:    mat.NewDense(irow, wcol, nil),
 	}
 }
 
+/*
+MLP - последовательность слоев с функцией активации Act между ними.
+Если Gate задан, MLP содержит ровно два слоя и вычисляет
+
+	Layers[1](Act(Gate(x)) ⊙ Layers[0](x)),
+
+что при ActSilu дает SwiGLU, при ActGelu - GeGLU.
+*/
 type MLP struct {
 	Layers []*Layer
+	Act    lib.Act
+	Gate   *Layer
+
+	state State
+}
+
+// State - активации одного вызова MLP.ForwardWith, нужные Backward.
+type State struct {
+	layers []LayerState
+	gate   LayerState
+	act    *mat.Dense
+	arena  lib.Arena
 }
 
+func (mlp *MLP) SetParams(params lib.Params) {
+	for _, layer := range mlp.Layers {
+		layer.SetParams(params)
+	}
+
+	if mlp.Gate != nil {
+		mlp.Gate.SetParams(params)
+	}
+}
+
+// Forward возвращает новую матрицу, см. Layer.Forward.
 func (mlp *MLP) Forward(input *mat.Dense) *mat.Dense {
+	return mat.DenseCopyOf(mlp.ForwardWith(&mlp.state, input, nil))
+}
+
+/*
+ForwardWith аналогичен Forward, но сохраняет активации в state.
+Если pos задан, строки стоят на позициях pos, см. Layer.InferAt.
+Вызовы с разными state могут выполняться одновременно, выход
+действителен до следующего вызова с тем же state.
+*/
+func (mlp *MLP) ForwardWith(state *State, input *mat.Dense, pos []int) *mat.Dense {
+	if len(state.layers) != len(mlp.Layers) {
+		state.layers = make([]LayerState, len(mlp.Layers))
+	}
+	state.arena.Reset()
+
+	if mlp.Gate != nil {
+		return mlp.gatedForward(state, input, pos)
+	}
+
 	for index, layer := range mlp.Layers {
-		input = layer.Forward(input)
+		input = layer.ForwardWith(&state.layers[index], input, pos)
+
+		if index != len(mlp.Layers)-1 {
+			act := state.arena.Get(input.Dims())
+			mlp.Act.Apply(act, input)
+			input = act
+		}
+	}
+
+	return input
+}
+
+/*
+Infer вычисляет выход, ничего не сохраняя для Backward.
+Может вызываться одновременно из нескольких горутин.
+*/
+func (mlp *MLP) Infer(input *mat.Dense) *mat.Dense {
+	return mlp.infer(input, (*Layer).Infer)
+}
+
+// InferAt аналогичен Infer для строк, стоящих на позициях pos, см. Layer.InferAt.
+func (mlp *MLP) InferAt(input *mat.Dense, pos []int) *mat.Dense {
+	return mlp.infer(input, func(layer *Layer, input *mat.Dense) *mat.Dense {
+		return layer.InferAt(input, pos)
+	})
+}
+
+func (mlp *MLP) infer(input *mat.Dense, infer func(*Layer, *mat.Dense) *mat.Dense) *mat.Dense {
+	if mlp.Gate != nil {
+		var act, hidden mat.Dense
+		mlp.Act.Apply(&act, infer(mlp.Gate, input))
+		lib.MulElem(&hidden, &act, infer(mlp.Layers[0], input))
+		return infer(mlp.Layers[1], &hidden)
+	}
+
+	for index, layer := range mlp.Layers {
+		input = infer(layer, input)
 
 		if index != len(mlp.Layers)-1 {
 			var act mat.Dense
-			lib.Relu(&act, input)
+			mlp.Act.Apply(&act, input)
 			input = &act
 		}
 	}
@@ -59,19 +228,57 @@ func (mlp *MLP) Forward(input *mat.Dense) *mat.Dense {
 }
 
 func (mlp *MLP) Backward(output *mat.Dense, lr float64) *mat.Dense {
+	return mat.DenseCopyOf(mlp.BackwardWith(&mlp.state, output, lr))
+}
+
+// BackwardWith аналогичен Backward для активаций state.
+func (mlp *MLP) BackwardWith(state *State, output *mat.Dense, lr float64) *mat.Dense {
+	if mlp.Gate != nil {
+		return mlp.gatedBackward(state, output, lr)
+	}
+
 	for index := len(mlp.Layers) - 1; index >= 0; index-- {
-		output = mlp.Layers[index].Backward(output, lr)
+		output = mlp.Layers[index].BackwardWith(&state.layers[index], output, lr)
 
 		if index != 0 {
-			var relu mat.Dense
-			lib.ReluDeriv(&relu, mlp.Layers[index-1].output)
-			output.MulElem(&relu, output)
+			deriv := state.arena.Get(state.layers[index-1].output.Dims())
+			mlp.Act.Deriv(deriv, state.layers[index-1].output)
+			lib.MulElem(output, deriv, output)
 		}
 	}
 
 	return output
 }
 
+func (mlp *MLP) gatedForward(state *State, input *mat.Dense, pos []int) *mat.Dense {
+	up := mlp.Layers[0].ForwardWith(&state.layers[0], input, pos)
+	gate := mlp.Gate.ForwardWith(&state.gate, input, pos)
+
+	act, hidden := state.arena.Get(gate.Dims()), state.arena.Get(gate.Dims())
+	mlp.Act.Apply(act, gate)
+	lib.MulElem(hidden, act, up)
+
+	state.act = act
+
+	return mlp.Layers[1].ForwardWith(&state.layers[1], hidden, pos)
+}
+
+func (mlp *MLP) gatedBackward(state *State, output *mat.Dense, lr float64) *mat.Dense {
+	hidden := mlp.Layers[1].BackwardWith(&state.layers[1], output, lr)
+
+	arena := &state.arena
+	up, gate, deriv := arena.Get(hidden.Dims()), arena.Get(hidden.Dims()), arena.Get(hidden.Dims())
+	lib.MulElem(up, hidden, state.act)
+	lib.MulElem(gate, hidden, state.layers[0].output)
+	mlp.Act.Deriv(deriv, state.gate.output)
+	lib.MulElem(gate, gate, deriv)
+
+	input := mlp.Layers[0].BackwardWith(&state.layers[0], up, lr)
+	lib.Add(input, input, mlp.Gate.BackwardWith(&state.gate, gate, lr))
+
+	return input
+}
+
 func (mlp *MLP) ParamN() int {
 	var sum int
 
@@ -79,16 +286,32 @@ func (mlp *MLP) ParamN() int {
 		sum += layer.ParamN()
 	}
 
+	if mlp.Gate != nil {
+		sum += mlp.Gate.ParamN()
+	}
+
 	return sum
 }
 
-func New(irow, icol int, wcoln ...int) *MLP {
+func New(rng *lib.RNG, irow, icol int, wcoln ...int) *MLP {
 	layers := make([]*Layer, len(wcoln))
 
 	for index, wcol := range wcoln {
-		layers[index] = NewLayer(irow, icol, wcol)
+		layers[index] = NewLayer(rng, irow, icol, wcol)
 		icol = wcol
 	}
 
 	return &MLP{Layers: layers}
 }
+
+// NewGated создает MLP с затвором и скрытым слоем ширины hidden.
+func NewGated(rng *lib.RNG, irow, icol, hidden int, act lib.Act) *MLP {
+	return &MLP{
+		Layers: []*Layer{
+			NewLayer(rng, irow, icol, hidden),
+			NewLayer(rng, irow, hidden, icol),
+		},
+		Act:  act,
+		Gate: NewLayer(rng, irow, icol, hidden),
+	}
+}
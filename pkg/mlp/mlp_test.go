@@ -1,7 +1,10 @@
 package mlp
 
 import (
+	"fmt"
 	"gonum.org/v1/gonum/mat"
+	"llm/pkg/gradcheck"
+	"llm/pkg/lib"
 	"testing"
 )
 
@@ -93,7 +96,7 @@ func Test_Layer_New(t *testing.T) {
 	}
 
 	for i, test := range tests {
-		layer := NewLayer(test.irow, test.icol, test.wcol)
+		layer := NewLayer(lib.NewRNG(1), test.irow, test.icol, test.wcol)
 		row, col := layer.Bias.Dims()
 		if test.irow != row || test.wcol != col {
 			t.Errorf("%d: bias: expected %dx%d, got %dx%d", i, test.irow, test.wcol, row, col)
@@ -220,7 +223,7 @@ func Test_New(t *testing.T) {
 	}
 
 	for i, test := range tests {
-		mlp := New(test.irow, test.icol, test.wcoln...)
+		mlp := New(lib.NewRNG(1), test.irow, test.icol, test.wcoln...)
 
 		for index, layer := range mlp.Layers {
 			row, col := layer.Bias.Dims()
@@ -238,3 +241,90 @@ func Test_New(t *testing.T) {
 		}
 	}
 }
+
+func Test_Backward_Numerical(t *testing.T) {
+	tests := []struct {
+		act   lib.Act
+		gated bool
+	}{
+		{act: lib.ActLeakyRelu},
+		{act: lib.ActRelu},
+		{act: lib.ActGelu},
+		{act: lib.ActSilu},
+		{act: lib.ActSilu, gated: true},
+		{act: lib.ActGelu, gated: true},
+	}
+
+	input := mat.NewDense(2, 3, []float64{
+		.5, -.2, .9,
+		-.4, .6, .3,
+	})
+
+	for i, test := range tests {
+		mlp := New(lib.NewRNG(1), 2, 3, 5, 3)
+		if test.gated {
+			mlp = NewGated(lib.NewRNG(1), 2, 3, 5, test.act)
+		}
+		mlp.Act = test.act
+
+		params := make(map[string]*mat.Dense)
+		for index, layer := range mlp.Layers {
+			params[fmt.Sprintf("Layers.%d.Weights", index)] = layer.Weights
+			params[fmt.Sprintf("Layers.%d.Bias", index)] = layer.Bias
+		}
+		if mlp.Gate != nil {
+			params["Gate.Weights"] = mlp.Gate.Weights
+			params["Gate.Bias"] = mlp.Gate.Bias
+		}
+
+		results := gradcheck.Check(mlp, input, params)
+
+		for _, res := range gradcheck.Failed(results, gradcheck.Tolerance) {
+			t.Errorf("%d: %v", i, res)
+		}
+	}
+}
+
+// Test_Forward_Fresh - выход Forward не меняется следующими вызовами.
+func Test_Forward_Fresh(t *testing.T) {
+	rng := lib.NewRNG(1)
+	tests := []*MLP{
+		New(rng, 3, 4, 6, 4),
+		NewGated(rng, 3, 4, 6, lib.ActSilu),
+	}
+	first, second := lib.Xavier(rng, 3, 4), lib.Xavier(rng, 3, 4)
+
+	for i, mlp := range tests {
+		output := mlp.Forward(first)
+		layer := mlp.Layers[0].Forward(first)
+		expected, expLayer := mat.DenseCopyOf(output), mat.DenseCopyOf(layer)
+
+		input := mlp.Backward(lib.Xavier(rng, 3, 4), 0)
+		expInput := mat.DenseCopyOf(input)
+
+		mlp.Forward(second)
+		mlp.Layers[0].Forward(second)
+		mlp.Backward(lib.Xavier(rng, 3, 4), 0)
+
+		if !mat.Equal(output, expected) || !mat.Equal(layer, expLayer) {
+			t.Errorf("%d: Forward output changed by the next call", i)
+		}
+
+		if !mat.Equal(input, expInput) {
+			t.Errorf("%d: Backward output changed by the next call", i)
+		}
+	}
+}
+
+func Benchmark_Forward(b *testing.B) {
+	rng := lib.NewRNG(1)
+	mlp := New(rng, 64, 64, 256, 64)
+	input := lib.Xavier(rng, 64, 64)
+
+	var state State
+
+	b.ReportAllocs()
+	for range b.N {
+		mlp.ForwardWith(&state, input, nil)
+	}
+}
@@ -0,0 +1,502 @@
+package moe
+
+import (
+	"gonum.org/v1/gonum/floats"
+	"gonum.org/v1/gonum/mat"
+	"llm/pkg/lib"
+	"llm/pkg/mlp"
+	"math"
+	"slices"
+)
+
+/*
+MoE - смесь экспертов. Router выбирает для каждой строки входа TopK
+экспертов с наибольшей вероятностью softmax(input·Router), выход строки -
+сумма выходов выбранных экспертов, умноженных на их вероятности.
+
+Эксперт получает только направленные к нему строки, собранные
+в плотную матрицу вместе с их позициями, поэтому смещения экспертов
+остаются привязанными к позициям, как в mlp.MLP, а вычисления эксперта
+пропорциональны числу его строк.
+*/
+type MoE struct {
+	Experts []*mlp.MLP
+	Router  *mat.Dense
+	TopK    int
+	/*
+		Capacity ограничивает число строк на эксперта величиной
+		ceil(Capacity·rows·TopK/len(Experts)). Строки сверх емкости
+		не попадают к эксперту. 0 снимает ограничение.
+	*/
+	Capacity float64
+	// Balance - вес вспомогательной ошибки равномерной загрузки экспертов.
+	Balance float64
+
+	state  State
+	params lib.Params
+}
+
+// State - активации одного вызова ForwardWith, нужные Backward.
+type State struct {
+	input,
+	probs *mat.Dense
+	/*
+		rows[e] - строки, направленные к эксперту e, pos[e] - их позиции.
+		outputs[e] - выход эксперта на этих строках по порядку,
+		inputs[e] - градиент входа эксперта.
+	*/
+	rows,
+	pos [][]int
+	routes [][]bool
+	outputs,
+	inputs []*mat.Dense
+	experts []mlp.State
+	aux     float64
+	// counts - статистика градиента ошибки балансировки, см. SetCounts.
+	counts Counts
+	// arena - память матриц вызова, используемая повторно.
+	arena lib.Arena
+}
+
+// Aux возвращает ошибку балансировки вызова ForwardWith.
+func (state *State) Aux() float64 {
+	return state.aux
+}
+
+// Counts - число назначений каждому эксперту и число строк вызова.
+type Counts struct {
+	Experts []int
+	Rows    int
+}
+
+// Counts возвращает назначения экспертам вызова ForwardWith.
+func (state *State) Counts() Counts {
+	return state.counts
+}
+
+/*
+SetCounts заменяет назначения, по которым BackwardWith считает градиент
+ошибки балансировки. Части одного шага, вычисленные разными вызовами,
+получают тот же градиент, что и один вызов для всего шага, если каждой
+передана сумма Counts всех частей.
+*/
+func (state *State) SetCounts(counts Counts) {
+	state.counts = counts
+}
+
+func (moe *MoE) SetParams(params lib.Params) {
+	moe.params = params
+
+	for _, expert := range moe.Experts {
+		expert.SetParams(params)
+	}
+}
+
+// Aux возвращает ошибку балансировки последнего вызова Forward.
+func (moe *MoE) Aux() float64 {
+	return moe.state.Aux()
+}
+
+// Forward возвращает новую матрицу, которую следующие вызовы не меняют.
+func (moe *MoE) Forward(input *mat.Dense) *mat.Dense {
+	return mat.DenseCopyOf(moe.ForwardWith(&moe.state, input, nil, nil))
+}
+
+/*
+ForwardWith аналогичен Forward, но сохраняет активации и ошибку
+балансировки в state. Вызовы с разными state могут выполняться одновременно.
+
+Если lens задан, строки input по порядку делятся на последовательности
+длины lens[i], стоящие на позициях pos, и емкость считается для каждой
+последовательности отдельно, как в InferAt. Ошибка балансировки
+считается по всем строкам. Выход действителен до следующего вызова
+с тем же state.
+*/
+func (moe *MoE) ForwardWith(state *State, input *mat.Dense, pos, lens []int) *mat.Dense {
+	state.arena.Reset()
+
+	probs := moe.router(&state.arena, input)
+	routes, counts := moe.route(probs, lens, state.routes)
+
+	state.input, state.probs, state.routes = input, probs, routes
+	state.rows, state.pos = gather(routes, pos, state.rows, state.pos)
+
+	state.aux = 0
+	for index := range moe.Experts {
+		state.aux += moe.fraction(probs, counts[index]) * meanProb(probs, index)
+	}
+	state.aux *= moe.Balance * float64(len(moe.Experts))
+	state.counts = Counts{counts, lib.Rown(input)}
+
+	if len(state.experts) != len(moe.Experts) {
+		state.experts = make([]mlp.State, len(moe.Experts))
+	}
+	if len(state.outputs) != len(moe.Experts) {
+		state.outputs = make([]*mat.Dense, len(moe.Experts))
+	}
+	moe.experts(&state.arena, input, state.rows, state.pos, state.outputs, func(index int, expert *mlp.MLP, input *mat.Dense, pos []int) *mat.Dense {
+		return expert.ForwardWith(&state.experts[index], input, pos)
+	})
+
+	return combine(&state.arena, probs, input, state.rows, state.outputs)
+}
+
+/*
+Infer вычисляет выход, ничего не сохраняя для Backward, Aux не меняется.
+Может вызываться одновременно из нескольких горутин.
+*/
+func (moe *MoE) Infer(input *mat.Dense) *mat.Dense {
+	probs := moe.router(nil, input)
+	routes, _ := moe.route(probs, nil, nil)
+
+	return moe.infer(probs, input, routes, nil)
+}
+
+/*
+InferAt аналогичен Infer для продолжения нескольких последовательностей:
+строки input по порядку делятся на части длины lens[i] и стоят на позициях
+pos. counts[i] - число строк i-й последовательности, уже направленных
+к каждому эксперту, и обновляется. Емкость считается для полного окна,
+поэтому выход совпадает с выходом Infer для тех же строк окна.
+*/
+func (moe *MoE) InferAt(input *mat.Dense, pos, lens []int, counts [][]int) *mat.Dense {
+	probs := moe.router(nil, input)
+	routes := moe.assignSeqs(probs, lens, counts, nil)
+
+	return moe.infer(probs, input, routes, pos)
+}
+
+func (moe *MoE) infer(probs, input *mat.Dense, routes [][]bool, pos []int) *mat.Dense {
+	rows, at := gather(routes, pos, nil, nil)
+	outputs := make([]*mat.Dense, len(moe.Experts))
+
+	moe.experts(nil, input, rows, at, outputs, func(_ int, expert *mlp.MLP, input *mat.Dense, pos []int) *mat.Dense {
+		return expert.InferAt(input, pos)
+	})
+
+	return combine(nil, probs, input, rows, outputs)
+}
+
+func (moe *MoE) router(arena *lib.Arena, input *mat.Dense) *mat.Dense {
+	probs := arena.Get(lib.Rown(input), lib.Coln(moe.Router))
+	lib.Mul(probs, input, moe.Router)
+	lib.Softmax(probs, probs)
+	return probs
+}
+
+/*
+gather переводит отметки routes в номера строк каждого эксперта и их
+позиции: pos[row] или row, если pos не задан. Срезы rows и at
+используются повторно.
+*/
+func gather(routes [][]bool, pos []int, rows, at [][]int) ([][]int, [][]int) {
+	if len(rows) != len(routes) {
+		rows, at = make([][]int, len(routes)), make([][]int, len(routes))
+	}
+
+	for index, marks := range routes {
+		rows[index], at[index] = rows[index][:0], at[index][:0]
+
+		for row, ok := range marks {
+			if !ok {
+				continue
+			}
+
+			rows[index] = append(rows[index], row)
+			if pos != nil {
+				at[index] = append(at[index], pos[row])
+			} else {
+				at[index] = append(at[index], row)
+			}
+		}
+	}
+
+	return rows, at
+}
+
+/*
+experts собирает строки rows[e] входа в матрицу из arena и вызывает
+на ней forward эксперта e, эксперты считаются параллельно. Выход
+записывается в outputs[e], эксперты без строк получают nil.
+*/
+func (moe *MoE) experts(
+	arena *lib.Arena,
+	input *mat.Dense,
+	rows,
+	pos [][]int,
+	outputs []*mat.Dense,
+	forward func(int, *mlp.MLP, *mat.Dense, []int) *mat.Dense,
+) {
+	// до вызова forward outputs[e] содержит строки входа эксперта e
+	for index := range moe.Experts {
+		outputs[index] = nil
+		if len(rows[index]) == 0 {
+			continue
+		}
+
+		outputs[index] = arena.Get(len(rows[index]), lib.Coln(input))
+		lib.GatherAdd(outputs[index], input, rows[index])
+	}
+
+	lib.Parallel(len(moe.Experts), func(index int) {
+		if outputs[index] != nil {
+			outputs[index] = forward(index, moe.Experts[index], outputs[index], pos[index])
+		}
+	})
+}
+
+// combine складывает выходы экспертов с весами probs.
+func combine(arena *lib.Arena, probs, input *mat.Dense, rows [][]int, outputs []*mat.Dense) *mat.Dense {
+	output := arena.Get(lib.Rown(probs), lib.Coln(input))
+
+	for index, res := range outputs {
+		for i, row := range rows[index] {
+			floats.AddScaled(output.RawRowView(row), probs.At(row, index), res.RawRowView(i))
+		}
+	}
+
+	return output
+}
+
+/*
+route распределяет строки по экспертам с учетом емкости и возвращает
+отметки строк каждого эксперта и их число. Если lens задан, емкость
+считается для каждой последовательности, см. ForwardWith. Память
+отметок routes используется повторно.
+*/
+func (moe *MoE) route(probs *mat.Dense, lens []int, routes [][]bool) ([][]bool, []int) {
+	counts := make([]int, len(moe.Experts))
+
+	if lens == nil {
+		routes := moe.assign(probs, moe.limit(lib.Rown(probs)), routes, func(int) []int {
+			return counts
+		})
+		return routes, counts
+	}
+
+	seqs := make([][]int, len(lens))
+	for index := range seqs {
+		seqs[index] = make([]int, len(moe.Experts))
+	}
+
+	routes = moe.assignSeqs(probs, lens, seqs, routes)
+	for _, seq := range seqs {
+		for index, n := range seq {
+			counts[index] += n
+		}
+	}
+
+	return routes, counts
+}
+
+/*
+assignSeqs вызывает assign для строк последовательностей длины lens[i]
+со счетчиками counts[i] и емкостью полного окна.
+*/
+func (moe *MoE) assignSeqs(probs *mat.Dense, lens []int, counts [][]int, routes [][]bool) [][]bool {
+	seqs := make([]int, 0, lib.Rown(probs))
+	for index, n := range lens {
+		for range n {
+			seqs = append(seqs, index)
+		}
+	}
+
+	window := lib.Rown(moe.Experts[0].Layers[0].Bias)
+
+	return moe.assign(probs, moe.limit(window), routes, func(row int) []int {
+		return counts[seqs[row]]
+	})
+}
+
+// limit возвращает емкость эксперта для окна из rown строк.
+func (moe *MoE) limit(rown int) int {
+	n := len(moe.Experts)
+	topk := min(max(1, moe.TopK), n)
+
+	if moe.Capacity > 0 {
+		return int(math.Ceil(moe.Capacity * float64(rown*topk) / float64(n)))
+	}
+	return rown * topk
+}
+
+/*
+assign направляет строки по порядку к TopK экспертам, у которых
+counts(row) не достиг limit, и увеличивает эти счетчики. Отметки
+записываются в routes, если их хватает.
+*/
+func (moe *MoE) assign(probs *mat.Dense, limit int, routes [][]bool, counts func(row int) []int) [][]bool {
+	rown, n := lib.Rown(probs), len(moe.Experts)
+	topk := min(max(1, moe.TopK), n)
+
+	if len(routes) != n {
+		routes = make([][]bool, n)
+	}
+	for index := range routes {
+		if cap(routes[index]) < rown {
+			routes[index] = make([]bool, rown)
+		}
+		routes[index] = routes[index][:rown]
+		clear(routes[index])
+	}
+
+	order := make([]int, n)
+
+	for row := range rown {
+		vals := probs.RawRowView(row)
+
+		for index := range order {
+			order[index] = index
+		}
+		slices.SortStableFunc(order, func(a, b int) int {
+			switch {
+			case vals[a] > vals[b]:
+				return -1
+			case vals[a] < vals[b]:
+				return 1
+			}
+			return 0
+		})
+
+		counts := counts(row)
+		for _, index := range order[:topk] {
+			if counts[index] < limit {
+				routes[index][row] = true
+				counts[index]++
+			}
+		}
+	}
+
+	return routes
+}
+
+// fraction - доля назначений, выпавших эксперту.
+func (moe *MoE) fraction(probs *mat.Dense, count int) float64 {
+	return float64(count) / float64(lib.Rown(probs)*min(max(1, moe.TopK), len(moe.Experts)))
+}
+
+func meanProb(probs *mat.Dense, index int) float64 {
+	var sum float64
+	for row := range lib.Rown(probs) {
+		sum += probs.At(row, index)
+	}
+	return sum / float64(lib.Rown(probs))
+}
+
+func (moe *MoE) Backward(output *mat.Dense, lr float64) *mat.Dense {
+	return mat.DenseCopyOf(moe.BackwardWith(&moe.state, output, lr))
+}
+
+// BackwardWith аналогичен Backward для активаций state.
+func (moe *MoE) BackwardWith(state *State, output *mat.Dense, lr float64) *mat.Dense {
+	rown, n := lib.Rown(state.probs), len(moe.Experts)
+	arena := &state.arena
+
+	// dprobs - градиент по вероятностям маршрутизатора.
+	dprobs := arena.Get(rown, n)
+
+	for index, rows := range state.rows {
+		for i, row := range rows {
+			dprobs.Set(row, index, floats.Dot(
+				output.RawRowView(row), state.outputs[index].RawRowView(i)))
+		}
+	}
+
+	// доля и среднее считаются по всем строкам шага, см. SetCounts
+	total, topk := state.counts.Rows, min(max(1, moe.TopK), n)
+	for index := range n {
+		grad := moe.Balance * float64(n) * float64(state.counts.Experts[index]) / float64(total*topk*total)
+
+		for row := range rown {
+			dprobs.Set(row, index, dprobs.At(row, index)+grad)
+		}
+	}
+
+	if len(state.inputs) != n {
+		state.inputs = make([]*mat.Dense, n)
+	}
+	inputs := state.inputs
+
+	// до вызова BackwardWith inputs[e] содержит градиент выхода эксперта e на его строках
+	for index, rows := range state.rows {
+		inputs[index] = nil
+		if len(rows) == 0 {
+			continue
+		}
+
+		inputs[index] = arena.Get(len(rows), lib.Coln(output))
+		for i, row := range rows {
+			floats.AddScaled(inputs[index].RawRowView(i), state.probs.At(row, index), output.RawRowView(row))
+		}
+	}
+
+	// логиты: dl = p ⊙ (dp - Σ dp·p)
+	dlogits := arena.Get(rown, n)
+	for row := range rown {
+		probs, dp := state.probs.RawRowView(row), dprobs.RawRowView(row)
+
+		dot := floats.Dot(probs, dp)
+
+		for index := range n {
+			dlogits.Set(row, index, probs[index]*(dp[index]-dot))
+		}
+	}
+
+	input := arena.Get(rown, lib.Rown(moe.Router))
+	router := arena.Get(lib.Rown(moe.Router), n)
+
+	// последняя задача считает градиенты маршрутизатора параллельно с экспертами
+	lib.Parallel(n+1, func(index int) {
+		switch {
+		case index == n:
+			lib.MulT(input, dlogits, moe.Router)
+			lib.TMul(router, state.input, dlogits)
+		case inputs[index] != nil:
+			inputs[index] = moe.Experts[index].BackwardWith(&state.experts[index], inputs[index], lr)
+		}
+	})
+
+	moe.params.Step(moe.Router, router, lr)
+
+	for index, res := range inputs {
+		if res != nil {
+			lib.ScatterAdd(input, res, state.rows[index])
+		}
+	}
+
+	return input
+}
+
+// ParamN возвращает число параметров всех экспертов и маршрутизатора.
+func (moe *MoE) ParamN() int {
+	sum := lib.ParamN(moe.Router)
+
+	for _, expert := range moe.Experts {
+		sum += expert.ParamN()
+	}
+
+	return sum
+}
+
+// ActiveParamN возвращает число параметров, участвующих в вычислении одной строки.
+func (moe *MoE) ActiveParamN() int {
+	return lib.ParamN(moe.Router) +
+		min(max(1, moe.TopK), len(moe.Experts))*moe.Experts[0].ParamN()
+}
+
+/*
+New создает n экспертов mlp.New(irow, icol, hidden, icol) и маршрутизатор
+с выбором topk экспертов на строку.
+*/
+func New(rng *lib.RNG, irow, icol, hidden, n, topk int) *MoE {
+	experts := make([]*mlp.MLP, n)
+
+	for index := range n {
+		experts[index] = mlp.New(rng, irow, icol, hidden, icol)
+	}
+
+	return &MoE{
+		Experts: experts,
+		Router:  lib.Xavier(rng, icol, n),
+		TopK:    topk,
+	}
+}
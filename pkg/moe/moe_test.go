@@ -0,0 +1,155 @@
+package moe
+
+import (
+	"gonum.org/v1/gonum/mat"
+	"llm/pkg/lib"
+	"testing"
+)
+
+func Test_Forward_Capacity(t *testing.T) {
+	tests := []struct {
+		topk     int
+		capacity float64
+		limit    int
+	}{
+		{topk: 1, limit: 6},
+		{topk: 2, limit: 12},
+		{topk: 1, capacity: 1, limit: 2},
+		{topk: 2, capacity: 1.5, limit: 6},
+	}
+
+	for i, test := range tests {
+		moe := New(lib.NewRNG(1), 6, 4, 5, 3, test.topk)
+		moe.Capacity = test.capacity
+
+		input := mat.NewDense(6, 4, nil)
+		for row := range 6 {
+			input.SetRow(row, []float64{1, .5, -.3, .2})
+		}
+
+		moe.Forward(input)
+
+		var total int
+		for index, rows := range moe.state.rows {
+			count := len(rows)
+
+			// эксперт считает только свои строки
+			if out := moe.state.outputs[index]; count != 0 && lib.Rown(out) != count || count == 0 && out != nil {
+				t.Errorf("%d %d: expected output of %d rows", i, index, count)
+			}
+
+			if count > test.limit {
+				t.Errorf("%d %d: expected at most %d rows, got %d", i, index, test.limit, count)
+			}
+
+			total += count
+		}
+
+		if test.capacity == 0 && total != 6*test.topk {
+			t.Errorf("%d: expected %d routes, got %d", i, 6*test.topk, total)
+		}
+	}
+}
+
+func Test_Backward(t *testing.T) {
+	const eps = 1e-6
+
+	tests := []struct {
+		topk int
+		balance,
+		capacity float64
+	}{
+		{topk: 1},
+		{topk: 2, balance: .1},
+		{topk: 2, balance: .1, capacity: 1},
+	}
+
+	input := mat.NewDense(3, 4, []float64{
+		.5, -.2, .9, .1,
+		-.4, .6, .3, -.7,
+		.2, .8, -.5, .4,
+	})
+
+	grad := mat.NewDense(3, 4, []float64{
+		.1, .2, -.3, .4,
+		-.1, .5, .2, -.2,
+		.3, -.4, .1, .6,
+	})
+
+	for i, test := range tests {
+		moe := New(lib.NewRNG(1), 3, 4, 6, 3, test.topk)
+		moe.Balance = test.balance
+		moe.Capacity = test.capacity
+
+		loss := func() float64 {
+			var prod mat.Dense
+			prod.MulElem(moe.Forward(input), grad)
+			return mat.Sum(&prod) + moe.Aux()
+		}
+
+		numerical := func(m *mat.Dense) *mat.Dense {
+			r, c := m.Dims()
+			num := mat.NewDense(r, c, nil)
+
+			for row := range r {
+				for col := range c {
+					val := m.At(row, col)
+
+					m.Set(row, col, val+eps)
+					plus := loss()
+					m.Set(row, col, val-eps)
+					minus := loss()
+					m.Set(row, col, val)
+
+					num.Set(row, col, (plus-minus)/(2*eps))
+				}
+			}
+
+			return num
+		}
+
+		params := []*mat.Dense{moe.Router}
+		for _, expert := range moe.Experts {
+			for _, layer := range expert.Layers {
+				params = append(params, layer.Weights, layer.Bias)
+			}
+		}
+
+		expInput := numerical(input)
+		expected := make([]*mat.Dense, len(params))
+		before := make([]*mat.Dense, len(params))
+		for index, param := range params {
+			expected[index] = numerical(param)
+			before[index] = mat.DenseCopyOf(param)
+		}
+
+		loss()
+		dinput := moe.Backward(mat.DenseCopyOf(grad), 1)
+
+		if !mat.EqualApprox(dinput, expInput, 1e-5) {
+			t.Errorf("%d: input: expected %v, got %v", i, expInput, dinput)
+		}
+
+		for index, param := range params {
+			var got mat.Dense
+			got.Sub(before[index], param)
+
+			if !mat.EqualApprox(&got, expected[index], 1e-5) {
+				t.Errorf("%d %d: expected %v, got %v", i, index, expected[index], &got)
+			}
+		}
+	}
+}
+
+func Test_ParamN(t *testing.T) {
+	moe := New(lib.NewRNG(1), 2, 4, 8, 4, 2)
+
+	expert := 4*8 + 2*8 + 8*4 + 2*4
+	if moe.ParamN() != 4*4+4*expert {
+		t.Errorf("expected %d params, got %d", 4*4+4*expert, moe.ParamN())
+	}
+
+	if moe.ActiveParamN() != 4*4+2*expert {
+		t.Errorf("expected %d active params, got %d", 4*4+2*expert, moe.ActiveParamN())
+	}
+}
@@ -0,0 +1,452 @@
+/*
+Package server отдает модель по HTTP. /v1/completions повторяет форму
+текстовых дополнений OpenAI, включая потоковую выдачу server-sent events,
+/v1/tokenize и /v1/detokenize переводят текст в токены и обратно,
+/v1/models и /v1/info описывают модель.
+*/
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"llm/pkg/bpe"
+	"llm/pkg/lib"
+	"llm/pkg/llm"
+	"math/rand/v2"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultMaxTokens - Config.MaxTokens по умолчанию.
+	DefaultMaxTokens = 256
+
+	// maxBody ограничивает размер тела запроса.
+	maxBody = 1 << 20
+)
+
+type Config struct {
+	// Name - имя модели в ответах, запросы с другим model отклоняются.
+	Name string
+	/*
+		Concurrency ограничивает число одновременных запросов генерации,
+		0 означает Scheduler.MaxBatch.
+	*/
+	Concurrency int
+	// Timeout ограничивает время одного запроса, 0 снимает ограничение.
+	Timeout time.Duration
+	/*
+		MaxTokens - число новых токенов по умолчанию и его верхняя граница,
+		0 означает DefaultMaxTokens.
+	*/
+	MaxTokens int
+	// Scheduler задает объединение генераций в общие шаги модели.
+	Scheduler llm.SchedulerConfig
+}
+
+type Server struct {
+	llm   *llm.LLM
+	bpe   *bpe.BPE
+	cfg   Config
+	sched *llm.Scheduler
+	slots chan struct{}
+	ids   atomic.Uint64
+	mux   *http.ServeMux
+}
+
+/*
+New создает сервер для model и tok. Модель только читается, поэтому
+ее нельзя обучать или менять до вызова Close.
+*/
+func New(model *llm.LLM, tok *bpe.BPE, cfg Config) *Server {
+	if tok.Len() != lib.Rown(model.Embeds) {
+		panic("размер словаря не совпадает с моделью")
+	}
+
+	tok.PrepareInv()
+
+	if cfg.Scheduler.MaxBatch <= 0 {
+		cfg.Scheduler.MaxBatch = llm.DefaultMaxBatch
+	}
+
+	if cfg.Concurrency <= 0 {
+		cfg.Concurrency = cfg.Scheduler.MaxBatch
+	}
+
+	if cfg.MaxTokens <= 0 {
+		cfg.MaxTokens = DefaultMaxTokens
+	}
+
+	srv := &Server{
+		llm:   model,
+		bpe:   tok,
+		cfg:   cfg,
+		sched: model.NewScheduler(tok, cfg.Scheduler),
+		slots: make(chan struct{}, cfg.Concurrency),
+		mux:   http.NewServeMux(),
+	}
+
+	srv.mux.HandleFunc("POST /v1/completions", srv.completions)
+	srv.mux.HandleFunc("POST /v1/tokenize", srv.tokenize)
+	srv.mux.HandleFunc("POST /v1/detokenize", srv.detokenize)
+	srv.mux.HandleFunc("GET /v1/models", srv.models)
+	srv.mux.HandleFunc("GET /v1/info", srv.info)
+
+	return srv
+}
+
+func (srv *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	srv.mux.ServeHTTP(w, r)
+}
+
+// Close останавливает планировщик, незаконченные генерации обрываются.
+func (srv *Server) Close() {
+	srv.sched.Close()
+}
+
+/*
+completionRequest - поддерживаемая часть запроса OpenAI.
+Остальные поля, например n и stop, игнорируются.
+*/
+type completionRequest struct {
+	Model     string `json:"model"`
+	Prompt    string `json:"prompt"`
+	MaxTokens int    `json:"max_tokens"`
+	// Temperature по умолчанию 1, 0 выбирает наиболее вероятный токен.
+	Temperature *float64 `json:"temperature"`
+	TopP        float64  `json:"top_p"`
+	TopK        int      `json:"top_k"`
+	// Seed по умолчанию случаен.
+	Seed   *uint64 `json:"seed"`
+	Stream bool    `json:"stream"`
+}
+
+type completion struct {
+	ID      string   `json:"id"`
+	Object  string   `json:"object"`
+	Created int64    `json:"created"`
+	Model   string   `json:"model"`
+	Choices []choice `json:"choices"`
+	Usage   *usage   `json:"usage,omitempty"`
+}
+
+type choice struct {
+	Text     string `json:"text"`
+	Index    int    `json:"index"`
+	Logprobs any    `json:"logprobs"`
+	// FinishReason - "stop" после eot, "length" после max_tokens, в потоке до конца null.
+	FinishReason *string `json:"finish_reason"`
+}
+
+type usage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+func (srv *Server) completions(w http.ResponseWriter, r *http.Request) {
+	var req completionRequest
+	if !decode(w, r, &req) {
+		return
+	}
+
+	if req.Model != "" && req.Model != srv.cfg.Name {
+		writeError(w, http.StatusNotFound, "model_not_found",
+			fmt.Sprintf("модель %q не найдена", req.Model))
+		return
+	}
+
+	cfg, err := srv.genConfig(req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+		return
+	}
+
+	ctx, cancel := srv.context(r)
+	defer cancel()
+
+	if !srv.acquire(ctx) {
+		if closed(ctx.Err()) {
+			return
+		}
+		writeError(w, http.StatusServiceUnavailable, "server_busy", "нет свободных слотов генерации")
+		return
+	}
+	defer srv.release()
+
+	prompt := srv.bpe.GetTextInds(req.Prompt)
+
+	res := completion{
+		ID:      fmt.Sprintf("cmpl-%d", srv.ids.Add(1)),
+		Object:  "text_completion",
+		Created: time.Now().Unix(),
+		Model:   srv.cfg.Name,
+	}
+
+	if req.Stream {
+		srv.stream(ctx, w, res, prompt, cfg)
+		return
+	}
+
+	var inds []int
+	finish, err := srv.generate(ctx, prompt, cfg, func(ind int) {
+		inds = append(inds, ind)
+	})
+	if err != nil {
+		if !closed(err) {
+			writeError(w, http.StatusGatewayTimeout, "timeout", err.Error())
+		}
+		return
+	}
+
+	res.Choices = []choice{{Text: srv.bpe.GetText(inds), FinishReason: &finish}}
+	res.Usage = &usage{
+		PromptTokens:     len(prompt),
+		CompletionTokens: len(inds),
+		TotalTokens:      len(prompt) + len(inds),
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+/*
+stream отправляет каждый токен отдельным событием, затем событие
+с finish_reason и [DONE]. Если время запроса истекло, поток обрывается
+событием с ошибкой без [DONE], после закрытия клиентом - без события.
+*/
+func (srv *Server) stream(
+	ctx context.Context,
+	w http.ResponseWriter,
+	res completion,
+	prompt []int,
+	cfg llm.GenConfig,
+) {
+	flusher, _ := w.(http.Flusher)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(data any) {
+		body, err := json.Marshal(data)
+		if err != nil {
+			panic(err)
+		}
+
+		fmt.Fprintf(w, "data: %s\n\n", body)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	finish, err := srv.generate(ctx, prompt, cfg, func(ind int) {
+		res.Choices = []choice{{Text: srv.bpe.GetText([]int{ind})}}
+		send(res)
+	})
+	if err != nil {
+		if !closed(err) {
+			send(errorBody("timeout", err.Error()))
+		}
+		return
+	}
+
+	res.Choices = []choice{{FinishReason: &finish}}
+	send(res)
+
+	fmt.Fprint(w, "data: [DONE]\n\n")
+	if flusher != nil {
+		flusher.Flush()
+	}
+}
+
+// generate передает emit новые токены и возвращает причину остановки.
+func (srv *Server) generate(
+	ctx context.Context,
+	prompt []int,
+	cfg llm.GenConfig,
+	emit func(int),
+) (string, error) {
+	var n int
+
+	for ind := range srv.sched.Generate(ctx, prompt, cfg) {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+
+		emit(ind)
+		n++
+	}
+
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	if n == cfg.MaxTokens {
+		return "length", nil
+	}
+	return "stop", nil
+}
+
+func (srv *Server) genConfig(req completionRequest) (llm.GenConfig, error) {
+	cfg := llm.GenConfig{
+		MaxTokens:   req.MaxTokens,
+		Temperature: 1,
+		TopK:        req.TopK,
+		TopP:        req.TopP,
+		Seed:        rand.Uint64(),
+	}
+
+	if cfg.MaxTokens == 0 {
+		cfg.MaxTokens = srv.cfg.MaxTokens
+	}
+
+	if req.Temperature != nil {
+		cfg.Temperature = *req.Temperature
+	}
+
+	if req.Seed != nil {
+		cfg.Seed = *req.Seed
+	}
+
+	switch {
+	case cfg.MaxTokens < 0 || cfg.MaxTokens > srv.cfg.MaxTokens:
+		return cfg, fmt.Errorf("max_tokens должен быть от 0 до %d", srv.cfg.MaxTokens)
+	case cfg.Temperature < 0:
+		return cfg, errors.New("temperature не может быть отрицательной")
+	case cfg.TopP < 0 || cfg.TopP > 1:
+		return cfg, errors.New("top_p должен быть от 0 до 1")
+	case cfg.TopK < 0:
+		return cfg, errors.New("top_k не может быть отрицательным")
+	}
+
+	return cfg, nil
+}
+
+/*
+closed сообщает, что запрос прерван закрытием соединения клиента,
+а не истечением Config.Timeout. Такому клиенту ответ не отправляется.
+*/
+func closed(err error) bool {
+	return errors.Is(err, context.Canceled)
+}
+
+func (srv *Server) context(r *http.Request) (context.Context, context.CancelFunc) {
+	if srv.cfg.Timeout > 0 {
+		return context.WithTimeout(r.Context(), srv.cfg.Timeout)
+	}
+	return context.WithCancel(r.Context())
+}
+
+// acquire ждет свободный слот генерации, пока ctx не завершен.
+func (srv *Server) acquire(ctx context.Context) bool {
+	select {
+	case srv.slots <- struct{}{}:
+		return true
+	default:
+	}
+
+	select {
+	case srv.slots <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (srv *Server) release() {
+	<-srv.slots
+}
+
+func (srv *Server) tokenize(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Text string `json:"text"`
+	}
+	if !decode(w, r, &req) {
+		return
+	}
+
+	tokens := srv.bpe.GetTextInds(req.Text)
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"tokens": tokens,
+		"count":  len(tokens),
+	})
+}
+
+func (srv *Server) detokenize(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Tokens []int `json:"tokens"`
+	}
+	if !decode(w, r, &req) {
+		return
+	}
+
+	for _, ind := range req.Tokens {
+		if ind < 0 || ind >= srv.bpe.Len() {
+			writeError(w, http.StatusBadRequest, "invalid_request_error",
+				fmt.Sprintf("токена %d нет в словаре", ind))
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"text": srv.bpe.GetText(req.Tokens)})
+}
+
+func (srv *Server) models(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"object": "list",
+		"data": []map[string]any{{
+			"id":       srv.cfg.Name,
+			"object":   "model",
+			"created":  0,
+			"owned_by": "llm",
+		}},
+	})
+}
+
+func (srv *Server) info(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"id":            srv.cfg.Name,
+		"ctx_size":      srv.llm.CtxSize,
+		"vocab":         srv.bpe.Len(),
+		"dim":           lib.Coln(srv.llm.Embeds),
+		"layers":        len(srv.llm.Layers),
+		"params":        srv.llm.ParamN(),
+		"active_params": srv.llm.ActiveParamN(),
+		"max_tokens":    srv.cfg.MaxTokens,
+		"concurrency":   srv.cfg.Concurrency,
+		"max_batch":     srv.cfg.Scheduler.MaxBatch,
+	})
+}
+
+func decode(w http.ResponseWriter, r *http.Request, req any) bool {
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBody)).Decode(req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request_error",
+			"некорректное тело запроса: "+err.Error())
+		return false
+	}
+	return true
+}
+
+func errorBody(typ, message string) any {
+	return map[string]any{"error": map[string]string{
+		"message": message,
+		"type":    typ,
+	}}
+}
+
+func writeError(w http.ResponseWriter, status int, typ, message string) {
+	writeJSON(w, status, errorBody(typ, message))
+}
+
+func writeJSON(w http.ResponseWriter, status int, data any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	// ошибка записи означает, что клиент уже отключился
+	json.NewEncoder(w).Encode(data)
+}
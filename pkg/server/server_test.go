@@ -0,0 +1,356 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"llm/pkg/bpe"
+	"llm/pkg/llm"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var vocab = func() *bpe.BPE {
+	toks := []string{
+		"eow", "unk", "</eot>", "</pad>",
+		"привет" + "eow",
+		"мир" + "eow",
+		"как" + "eow",
+		"дела" + "eow",
+		"по", "ка" + "eow",
+	}
+
+	val := make(map[string]int)
+	for index, tok := range toks {
+		val[tok] = index
+	}
+
+	return bpe.New(val, "eow", "unk")
+}()
+
+func newServer(t *testing.T, cfg Config) (*Server, *httptest.Server) {
+	model := llm.NewWith(llm.Config{CtxSize: 8, Vocab: vocab.Len(), Dim: 4, Layers: 1, Heads: 2, Seed: 1})
+	cfg.Name = "tiny"
+
+	srv := New(model, vocab, cfg)
+	ts := httptest.NewServer(srv)
+
+	t.Cleanup(func() {
+		ts.Close()
+		srv.Close()
+	})
+
+	return srv, ts
+}
+
+func post(t *testing.T, url, body string, res any) int {
+	resp, err := http.Post(url, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if res != nil {
+		err = json.NewDecoder(resp.Body).Decode(res)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return resp.StatusCode
+}
+
+func Test_Completions(t *testing.T) {
+	srv, ts := newServer(t, Config{MaxTokens: 16})
+
+	tests := []string{
+		`{"model": "tiny", "prompt": "привет мир", "max_tokens": 5, "temperature": 0}`,
+		`{"prompt": "как дела", "max_tokens": 16, "temperature": 0.8, "top_k": 3, "seed": 7}`,
+		`{"prompt": "", "temperature": 1, "top_p": 0.9, "seed": 1}`,
+	}
+
+	for i, body := range tests {
+		var req completionRequest
+		json.Unmarshal([]byte(body), &req)
+
+		cfg, err := srv.genConfig(req)
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+
+		prompt := vocab.GetTextInds(req.Prompt)
+		inds := slices.Collect(srv.llm.Generate(vocab, prompt, cfg))
+
+		var res completion
+		if status := post(t, ts.URL+"/v1/completions", body, &res); status != http.StatusOK {
+			t.Fatalf("%d: expected status 200, got %d", i, status)
+		}
+
+		if len(res.Choices) != 1 || res.Object != "text_completion" || res.Model != "tiny" {
+			t.Fatalf("%d: unexpected response %+v", i, res)
+		}
+
+		if res.Choices[0].Text != vocab.GetText(inds) {
+			t.Errorf("%d: expected %q, got %q", i, vocab.GetText(inds), res.Choices[0].Text)
+		}
+
+		finish := "stop"
+		if len(inds) == cfg.MaxTokens {
+			finish = "length"
+		}
+		if *res.Choices[0].FinishReason != finish {
+			t.Errorf("%d: expected finish %s, got %s", i, finish, *res.Choices[0].FinishReason)
+		}
+
+		expected := usage{len(prompt), len(inds), len(prompt) + len(inds)}
+		if *res.Usage != expected {
+			t.Errorf("%d: expected usage %v, got %v", i, expected, *res.Usage)
+		}
+	}
+}
+
+func Test_Completions_Stream(t *testing.T) {
+	_, ts := newServer(t, Config{MaxTokens: 16})
+
+	const body = `{"prompt": "привет", "max_tokens": 10, "temperature": 0.9, "seed": 3`
+
+	var full completion
+	post(t, ts.URL+"/v1/completions", body+`}`, &full)
+
+	resp, err := http.Post(ts.URL+"/v1/completions", "application/json",
+		strings.NewReader(body+`, "stream": true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Errorf("unexpected content type %s", resp.Header.Get("Content-Type"))
+	}
+
+	var (
+		text   strings.Builder
+		events []string
+		finish string
+	)
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		events = append(events, line)
+
+		if line == "[DONE]" {
+			continue
+		}
+
+		var chunk completion
+		if err := json.Unmarshal([]byte(line), &chunk); err != nil {
+			t.Fatal(err)
+		}
+
+		text.WriteString(chunk.Choices[0].Text)
+		if chunk.Choices[0].FinishReason != nil {
+			finish = *chunk.Choices[0].FinishReason
+		}
+	}
+
+	if len(events) < 2 || events[len(events)-1] != "[DONE]" {
+		t.Fatalf("unexpected events %v", events)
+	}
+
+	if text.String() != full.Choices[0].Text || finish != *full.Choices[0].FinishReason {
+		t.Errorf("expected %q %s, got %q %s",
+			full.Choices[0].Text, *full.Choices[0].FinishReason, text.String(), finish)
+	}
+}
+
+func Test_Completions_Errors(t *testing.T) {
+	_, ts := newServer(t, Config{MaxTokens: 16})
+
+	tests := []struct {
+		body   string
+		status int
+		typ    string
+	}{
+		{body: `{"prompt": `, status: http.StatusBadRequest, typ: "invalid_request_error"},
+		{body: `{"prompt": ["a"]}`, status: http.StatusBadRequest, typ: "invalid_request_error"},
+		{body: `{"model": "other"}`, status: http.StatusNotFound, typ: "model_not_found"},
+		{body: `{"max_tokens": 17}`, status: http.StatusBadRequest, typ: "invalid_request_error"},
+		{body: `{"max_tokens": -1}`, status: http.StatusBadRequest, typ: "invalid_request_error"},
+		{body: `{"temperature": -1}`, status: http.StatusBadRequest, typ: "invalid_request_error"},
+		{body: `{"top_p": 2}`, status: http.StatusBadRequest, typ: "invalid_request_error"},
+		{body: `{"top_k": -2}`, status: http.StatusBadRequest, typ: "invalid_request_error"},
+	}
+
+	for i, test := range tests {
+		var res struct {
+			Error struct {
+				Message,
+				Type string
+			}
+		}
+
+		status := post(t, ts.URL+"/v1/completions", test.body, &res)
+		if status != test.status || res.Error.Type != test.typ || res.Error.Message == "" {
+			t.Errorf("%d: expected %d %s, got %d %+v", i, test.status, test.typ, status, res.Error)
+		}
+	}
+
+	resp, err := http.Get(ts.URL + "/v1/completions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("expected status 405, got %d", resp.StatusCode)
+	}
+}
+
+func Test_Completions_Limits(t *testing.T) {
+	srv, ts := newServer(t, Config{Concurrency: 1, Timeout: 50 * time.Millisecond})
+
+	// занятый слот не освобождается до истечения времени запроса
+	srv.slots <- struct{}{}
+
+	var res map[string]map[string]string
+	if status := post(t, ts.URL+"/v1/completions", `{}`, &res); status != http.StatusServiceUnavailable {
+		t.Errorf("expected status 503, got %d", status)
+	}
+
+	srv.release()
+
+	srv.cfg.Timeout = time.Nanosecond
+	if status := post(t, ts.URL+"/v1/completions", `{"prompt": "привет"}`, &res); status != http.StatusGatewayTimeout {
+		t.Errorf("expected status 504, got %d", status)
+	}
+
+	if len(srv.slots) != 0 {
+		t.Errorf("slot not released")
+	}
+}
+
+func Test_Completions_Closed(t *testing.T) {
+	srv, _ := newServer(t, Config{Timeout: time.Minute})
+
+	tests := []string{
+		`{"prompt": "привет"}`,
+		`{"prompt": "привет", "stream": true}`,
+	}
+
+	for i, body := range tests {
+		// клиент закрыл соединение до начала генерации
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		req := httptest.NewRequest(http.MethodPost, "/v1/completions", strings.NewReader(body)).WithContext(ctx)
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, req)
+
+		if rec.Code == http.StatusGatewayTimeout || strings.Contains(rec.Body.String(), "timeout") {
+			t.Errorf("%d: expected no timeout response, got %d %q", i, rec.Code, rec.Body)
+		}
+	}
+
+	if len(srv.slots) != 0 {
+		t.Errorf("slot not released")
+	}
+}
+
+func Test_Completions_Concurrent(t *testing.T) {
+	_, ts := newServer(t, Config{Concurrency: 2})
+
+	const body = `{"prompt": "как дела", "max_tokens": 6, "seed": 11}`
+
+	var expected completion
+	post(t, ts.URL+"/v1/completions", body, &expected)
+
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			var res completion
+			if status := post(t, ts.URL+"/v1/completions", body, &res); status != http.StatusOK {
+				t.Errorf("expected status 200, got %d", status)
+				return
+			}
+
+			if res.Choices[0].Text != expected.Choices[0].Text {
+				t.Errorf("expected %q, got %q", expected.Choices[0].Text, res.Choices[0].Text)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func Test_Tokenize(t *testing.T) {
+	_, ts := newServer(t, Config{})
+
+	var tokens struct {
+		Tokens []int
+		Count  int
+	}
+	post(t, ts.URL+"/v1/tokenize", `{"text": "Привет, мир пока"}`, &tokens)
+
+	if !slices.Equal(tokens.Tokens, []int{4, 1, 0, 5, 8, 9}) || tokens.Count != 6 {
+		t.Errorf("unexpected tokens %+v", tokens)
+	}
+
+	var text struct{ Text string }
+	post(t, ts.URL+"/v1/detokenize", `{"tokens": [4, 5, 8, 9]}`, &text)
+
+	if text.Text != "привет мир пока " {
+		t.Errorf("unexpected text %q", text.Text)
+	}
+
+	if status := post(t, ts.URL+"/v1/detokenize", `{"tokens": [10]}`, nil); status != http.StatusBadRequest {
+		t.Errorf("expected status 400, got %d", status)
+	}
+}
+
+func Test_Info(t *testing.T) {
+	srv, ts := newServer(t, Config{})
+
+	get := func(path string, res any) {
+		resp, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		if err := json.NewDecoder(resp.Body).Decode(res); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var models struct {
+		Object string
+		Data   []struct{ ID, Object string }
+	}
+	get("/v1/models", &models)
+
+	if models.Object != "list" || len(models.Data) != 1 || models.Data[0].ID != "tiny" {
+		t.Errorf("unexpected models %+v", models)
+	}
+
+	var info struct {
+		CtxSize int `json:"ctx_size"`
+		Vocab,
+		Params int
+	}
+	get("/v1/info", &info)
+
+	if info.CtxSize != 8 || info.Vocab != vocab.Len() || info.Params != srv.llm.ParamN() {
+		t.Errorf("unexpected info %+v", info)
+	}
+}
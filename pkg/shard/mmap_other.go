@@ -0,0 +1,16 @@
+//go:build !unix
+
+package shard
+
+import "os"
+
+func mmap(src string) []byte {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		panic(err)
+	}
+
+	return data
+}
+
+func munmap([]byte) {}
@@ -0,0 +1,44 @@
+//go:build unix
+
+package shard
+
+import (
+	"os"
+	"syscall"
+)
+
+func mmap(src string) []byte {
+	file, err := os.Open(src)
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		panic(err)
+	}
+
+	if info.Size() == 0 {
+		return nil
+	}
+
+	data, err := syscall.Mmap(int(file.Fd()), 0, int(info.Size()),
+		syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		panic(err)
+	}
+
+	return data
+}
+
+func munmap(data []byte) {
+	if data == nil {
+		return
+	}
+
+	err := syscall.Munmap(data)
+	if err != nil {
+		panic(err)
+	}
+}
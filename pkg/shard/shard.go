@@ -0,0 +1,282 @@
+package shard
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"llm/pkg/llm"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+/*
+Формат шарда (little endian):
+
+	magic   [8]byte
+	version uint32
+	width   uint32 - 2 или 4 байта на токен
+	hash    [32]byte - отпечаток словаря bpe.Hash
+	docn    uint64
+	tokn    uint64
+	offsets [docn+1]uint64 - начало каждого документа в токенах
+	tokens  [tokn]uint16 или [tokn]uint32
+*/
+const (
+	magic   = "LLMSHARD"
+	version = 1
+	ext     = ".shard"
+
+	headerSize = 64
+
+	// DefaultSize - число токенов в шарде по умолчанию.
+	DefaultSize = 1 << 26
+)
+
+type header struct {
+	Magic [8]byte
+	Version,
+	Width uint32
+	Hash [sha256.Size]byte
+	DocN,
+	TokN uint64
+}
+
+/*
+Prepare токенизирует документы source один раз и записывает их в каталог trg
+шардами не более чем по size токенов. hash и vocab - отпечаток и размер
+словаря, которым токенизирован source.
+*/
+func Prepare(source llm.Source, trg string, hash [sha256.Size]byte, vocab, size int) {
+	if size <= 0 {
+		size = DefaultSize
+	}
+
+	width := 2
+	if vocab > math.MaxUint16+1 {
+		width = 4
+	}
+
+	err := os.MkdirAll(trg, os.ModePerm)
+	if err != nil {
+		panic(err)
+	}
+
+	var (
+		docs [][]int
+		tokn,
+		n int
+	)
+
+	flush := func() {
+		if len(docs) == 0 {
+			return
+		}
+
+		name := filepath.Join(trg, fmt.Sprintf("%05d%s", n, ext))
+		write(name, docs, hash, width)
+		log.Printf("записал шард %s\n", name)
+
+		docs, tokn = nil, 0
+		n++
+	}
+
+	for doc, mask := range llm.Prefetch(source, nil, 0) {
+		if mask != nil {
+			panic("шарды не хранят маску ошибки")
+		}
+
+		if tokn != 0 && tokn+len(doc) > size {
+			flush()
+		}
+
+		docs = append(docs, doc)
+		tokn += len(doc)
+	}
+
+	flush()
+}
+
+func write(trg string, docs [][]int, hash [sha256.Size]byte, width int) {
+	file, err := os.Create(trg)
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+
+	offsets := make([]uint64, 1, len(docs)+1)
+	for _, doc := range docs {
+		offsets = append(offsets, offsets[len(offsets)-1]+uint64(len(doc)))
+	}
+
+	head := header{
+		Version: version,
+		Width:   uint32(width),
+		Hash:    hash,
+		DocN:    uint64(len(docs)),
+		TokN:    offsets[len(offsets)-1],
+	}
+	copy(head.Magic[:], magic)
+
+	buf := bufio.NewWriter(file)
+
+	err = binary.Write(buf, binary.LittleEndian, head)
+	if err != nil {
+		panic(err)
+	}
+
+	err = binary.Write(buf, binary.LittleEndian, offsets)
+	if err != nil {
+		panic(err)
+	}
+
+	tok := make([]byte, width)
+	for _, doc := range docs {
+		for _, ind := range doc {
+			if width == 2 {
+				binary.LittleEndian.PutUint16(tok, uint16(ind))
+			} else {
+				binary.LittleEndian.PutUint32(tok, uint32(ind))
+			}
+
+			buf.Write(tok)
+		}
+	}
+
+	err = buf.Flush()
+	if err != nil {
+		panic(err)
+	}
+}
+
+type shard struct {
+	data,
+	offsets,
+	tokens []byte
+	width,
+	docn int
+}
+
+func (s *shard) offset(index int) int {
+	return int(binary.LittleEndian.Uint64(s.offsets[index*8:]))
+}
+
+func (s *shard) doc(index int) []int {
+	from, to := s.offset(index), s.offset(index+1)
+
+	inds := make([]int, to-from)
+	for i := range inds {
+		pos := (from + i) * s.width
+
+		if s.width == 2 {
+			inds[i] = int(binary.LittleEndian.Uint16(s.tokens[pos:]))
+		} else {
+			inds[i] = int(binary.LittleEndian.Uint32(s.tokens[pos:]))
+		}
+	}
+
+	return inds
+}
+
+func open(src string, hash [sha256.Size]byte) *shard {
+	data := mmap(src)
+
+	if len(data) < headerSize {
+		panic(fmt.Sprintf("шард %s поврежден", src))
+	}
+
+	var head header
+	err := binary.Read(bytes.NewReader(data[:headerSize]), binary.LittleEndian, &head)
+	if err != nil {
+		panic(err)
+	}
+
+	if string(head.Magic[:]) != magic {
+		panic(fmt.Sprintf("%s не является шардом", src))
+	}
+
+	if head.Version != version {
+		panic(fmt.Sprintf("неподдерживаемая версия шарда %s", src))
+	}
+
+	if head.Hash != hash {
+		panic(fmt.Sprintf("шард %s подготовлен другим токенизатором", src))
+	}
+
+	offsets := headerSize + int(head.DocN+1)*8
+	if len(data) != offsets+int(head.TokN)*int(head.Width) {
+		panic(fmt.Sprintf("шард %s поврежден", src))
+	}
+
+	return &shard{
+		data:    data,
+		offsets: data[headerSize:offsets],
+		tokens:  data[offsets:],
+		width:   int(head.Width),
+		docn:    int(head.DocN),
+	}
+}
+
+/*
+Dataset - документы всех шардов каталога, отображенные в память.
+Реализует llm.Source.
+*/
+type Dataset struct {
+	shards []*shard
+	firsts []int
+	n      int
+}
+
+/*
+Open открывает шарды каталога src. Если шарды подготовлены токенизатором
+с другим отпечатком, Open завершается паникой.
+*/
+func Open(src string, hash [sha256.Size]byte) *Dataset {
+	dir, err := os.ReadDir(src)
+	if err != nil {
+		panic(err)
+	}
+
+	var names []string
+	for _, entry := range dir {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ext) {
+			names = append(names, entry.Name())
+		}
+	}
+	slices.Sort(names)
+
+	if len(names) == 0 {
+		panic(fmt.Sprintf("в каталоге %s нет шардов", src))
+	}
+
+	var ds Dataset
+	for _, name := range names {
+		s := open(filepath.Join(src, name), hash)
+		ds.shards = append(ds.shards, s)
+		ds.firsts = append(ds.firsts, ds.n)
+		ds.n += s.docn
+	}
+
+	return &ds
+}
+
+func (ds *Dataset) Len() int { return ds.n }
+
+func (ds *Dataset) Doc(index int) ([]int, []bool) {
+	n, _ := slices.BinarySearch(ds.firsts, index+1)
+	s := n - 1
+	return ds.shards[s].doc(index - ds.firsts[s]), nil
+}
+
+func (ds *Dataset) Close() {
+	for _, s := range ds.shards {
+		munmap(s.data)
+	}
+
+	ds.shards = nil
+}
@@ -0,0 +1,114 @@
+package shard
+
+import (
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+type source [][]int
+
+func (src source) Len() int { return len(src) }
+
+func (src source) Doc(index int) ([]int, []bool) { return slices.Clone(src[index]), nil }
+
+func Test_Prepare_Open(t *testing.T) {
+	hash := sha256.Sum256([]byte("bpe"))
+
+	tests := []struct {
+		docs source
+		vocab,
+		size,
+		shards int
+	}{
+		{
+			docs:   source{{1, 2, 3}, {4}, {}, {5, 6, 7, 8}, {65535, 0}},
+			vocab:  1 << 16,
+			size:   5,
+			shards: 3,
+		},
+		{
+			docs:   source{{1, 70000}, {1 << 20, 3, 4}},
+			vocab:  1 << 21,
+			shards: 1,
+		},
+	}
+
+	for i, test := range tests {
+		trg := t.TempDir()
+
+		Prepare(test.docs, trg, hash, test.vocab, test.size)
+
+		names, err := filepath.Glob(filepath.Join(trg, "*"+ext))
+		if err != nil {
+			panic(err)
+		}
+
+		if len(names) != test.shards {
+			t.Errorf("%d: expected %d shards, got %d", i, test.shards, len(names))
+		}
+
+		ds := Open(trg, hash)
+
+		if ds.Len() != len(test.docs) {
+			t.Fatalf("%d: expected %d docs, got %d", i, len(test.docs), ds.Len())
+		}
+
+		for index, doc := range test.docs {
+			got, mask := ds.Doc(index)
+
+			if mask != nil {
+				t.Errorf("%d %d: unexpected mask %v", i, index, mask)
+			}
+
+			if !reflect.DeepEqual(got, doc) && len(got)+len(doc) != 0 {
+				t.Errorf("%d %d: expected %v, got %v", i, index, doc, got)
+			}
+		}
+
+		ds.Close()
+	}
+}
+
+func Test_Open_Hash(t *testing.T) {
+	trg := t.TempDir()
+
+	Prepare(source{{1, 2}}, trg, sha256.Sum256([]byte("bpe")), 8, 0)
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected panic on tokenizer mismatch")
+		}
+	}()
+
+	Open(trg, sha256.Sum256([]byte("other")))
+}
+
+func Test_Open_Corrupted(t *testing.T) {
+	trg := t.TempDir()
+	hash := sha256.Sum256([]byte("bpe"))
+
+	Prepare(source{{1, 2}}, trg, hash, 8, 0)
+
+	name := filepath.Join(trg, "00000"+ext)
+	data, err := os.ReadFile(name)
+	if err != nil {
+		panic(err)
+	}
+
+	err = os.WriteFile(name, data[:len(data)-1], os.ModePerm)
+	if err != nil {
+		panic(err)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected panic on corrupted shard")
+		}
+	}()
+
+	Open(trg, hash)
+}